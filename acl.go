@@ -0,0 +1,192 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RightsMode says how SetACL applies rights to those an identifier
+// already has.
+type RightsMode int
+
+const (
+	RightsReplace RightsMode = iota // the rights become exactly these
+	RightsAdd                       // "+rights": these are added
+	RightsRemove                    // "-rights": these are taken away
+)
+
+// SetACL changes the rights (e.g. "lrswi") of identifier on mailbox, as
+// mode says; rights are single letters, in any order.  It needs the ACL
+// capability (RFC 4314).
+func (imap *IMAP) SetACL(mailbox, identifier string, mode RightsMode, rights string) error {
+	if err := imap.require("ACL"); err != nil {
+		return err
+	}
+	switch mode {
+	case RightsAdd:
+		rights = "+" + rights
+	case RightsRemove:
+		rights = "-" + rights
+	case RightsReplace:
+		if strings.HasPrefix(rights, "+") || strings.HasPrefix(rights, "-") {
+			return fmt.Errorf("imap: rights %q to replace start with a mode", rights)
+		}
+	default:
+		return fmt.Errorf("imap: bad rights mode %d", mode)
+	}
+	// The user's own rights may be among those changed.
+	delete(imap.myRights, mailbox)
+	_, err := imap.sendSync("SETACL ", imap.mailbox(mailbox), " ", astring(identifier), " ", astring(rights))
+	return err
+}
+
+// ResponseListRights contains the rights that may be granted to an
+// identifier on a mailbox, from LISTRIGHTS.  Required rights are
+// always granted; each of Optional is a group of rights that are
+// granted or not together, as in "wi".
+type ResponseListRights struct {
+	Mailbox    string
+	Identifier string
+	Required   string
+	Optional   []string
+}
+
+// ListRights returns the rights that may be granted to identifier on
+// mailbox.  It needs the ACL capability.
+func (imap *IMAP) ListRights(mailbox, identifier string) (*ResponseListRights, error) {
+	if err := imap.require("ACL"); err != nil {
+		return nil, err
+	}
+	resp, err := imap.sendSync("LISTRIGHTS ", imap.mailbox(mailbox), " ", astring(identifier))
+	if err != nil {
+		return nil, err
+	}
+
+	var rights *ResponseListRights
+	for _, extra := range resp.extra {
+		if r, ok := extra.(*ResponseListRights); ok && sameMailbox(r.Mailbox, mailbox) {
+			rights = r
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	if rights == nil {
+		return nil, fmt.Errorf("imap: no LISTRIGHTS response for %q", mailbox)
+	}
+	return rights, nil
+}
+
+func (r *reader) readLISTRIGHTS() *ResponseListRights {
+	/*
+		listrights-data = "LISTRIGHTS" SP mailbox SP identifier
+		                  SP rights *(SP rights)
+	*/
+	mailbox, err := r.readAstring()
+	check(err)
+	check(r.expect(" "))
+	identifier, err := r.readAstring()
+	check(err)
+	check(r.expect(" "))
+	required, err := r.readAstring()
+	check(err)
+
+	rights := &ResponseListRights{
+		Mailbox:    r.mailboxName(mailbox),
+		Identifier: identifier,
+		Required:   required,
+	}
+	for r.moreOnLine() {
+		optional, err := r.readAstring()
+		check(err)
+		rights.Optional = append(rights.Optional, optional)
+	}
+	return rights
+}
+
+// ResponseMyRights contains the rights the user has on a mailbox, from
+// MYRIGHTS.
+type ResponseMyRights struct {
+	Mailbox string
+	Rights  string
+}
+
+// MyRights returns the rights (e.g. "lrswipkxte") the user has on
+// mailbox.  It needs the ACL capability.
+func (imap *IMAP) MyRights(mailbox string) (string, error) {
+	if err := imap.require("ACL"); err != nil {
+		return "", err
+	}
+	resp, err := imap.sendSync("MYRIGHTS ", imap.mailbox(mailbox))
+	if err != nil {
+		return "", err
+	}
+
+	var rights *ResponseMyRights
+	for _, extra := range resp.extra {
+		if r, ok := extra.(*ResponseMyRights); ok && sameMailbox(r.Mailbox, mailbox) {
+			rights = r
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	if rights == nil {
+		return "", fmt.Errorf("imap: no MYRIGHTS response for %q", mailbox)
+	}
+	return rights.Rights, nil
+}
+
+func (r *reader) readMYRIGHTS() *ResponseMyRights {
+	/* myrights-data = "MYRIGHTS" SP mailbox SP rights */
+	mailbox, err := r.readAstring()
+	check(err)
+	check(r.expect(" "))
+	rights, err := r.readAstring()
+	check(err)
+	check(r.expectEOL())
+	return &ResponseMyRights{Mailbox: r.mailboxName(mailbox), Rights: rights}
+}
+
+// RightsError is returned, with CheckRights set, for an operation the
+// user lacks the rights on a mailbox for.
+type RightsError struct {
+	Mailbox   string
+	Right     byte   // e.g. 'x'
+	Operation string // e.g. "delete it"
+}
+
+func (e *RightsError) Error() string {
+	return fmt.Sprintf("imap: you lack the '%c' right on %q to %s", e.Right, e.Mailbox, e.Operation)
+}
+
+// checkRight fails with a *RightsError if CheckRights is set and the
+// user lacks right on mailbox.  Servers following RFC 2086 rather than
+// RFC 4314 grant 'd' in place of 't', 'e' and 'x'.  If the rights can't
+// be had, say because the mailbox doesn't exist, the command is left to
+// fail on its own.
+func (imap *IMAP) checkRight(mailbox string, right byte, operation string) error {
+	if !imap.CheckRights {
+		return nil
+	}
+	rights, ok := imap.myRights[mailbox]
+	if !ok {
+		acl, err := imap.supports("ACL")
+		if err != nil || !acl {
+			return err
+		}
+		rights, err = imap.MyRights(mailbox)
+		if _, refused := err.(*IMAPError); refused {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if imap.myRights == nil {
+			imap.myRights = make(map[string]string)
+		}
+		imap.myRights[mailbox] = rights
+	}
+	if strings.IndexByte(rights, right) >= 0 ||
+		strings.IndexByte("tex", right) >= 0 && strings.IndexByte(rights, 'd') >= 0 {
+		return nil
+	}
+	return &RightsError{mailbox, right, operation}
+}
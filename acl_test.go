@@ -0,0 +1,127 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetACL(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ACL")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`SETACL "Shared" fred +rw`)
+	s.Done("OK SETACL completed")
+	s.Expect(`SETACL "Shared" fred -d`)
+	s.Done("OK SETACL completed")
+	s.Expect(`SETACL "Shared" "Ann Smith" lrs`)
+	s.Done("OK SETACL completed")
+
+	if err := im.SetACL("Shared", "fred", RightsAdd, "rw"); err != nil {
+		t.Fatalf("setacl: %s", err)
+	}
+	if err := im.SetACL("Shared", "fred", RightsRemove, "d"); err != nil {
+		t.Fatalf("setacl: %s", err)
+	}
+	if err := im.SetACL("Shared", "Ann Smith", RightsReplace, "lrs"); err != nil {
+		t.Fatalf("setacl: %s", err)
+	}
+	if err := im.SetACL("Shared", "fred", RightsReplace, "+lrs"); err == nil {
+		t.Fatalf("expected an error for rights with a mode")
+	}
+	waitFake(t, s)
+}
+
+func TestListRights(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ACL")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`LISTRIGHTS "~/Mail/saved" smith`)
+	s.Send(`* LISTRIGHTS ~/Mail/saved smith la r swicdkxte`)
+	s.Done("OK Listrights completed")
+	s.Expect(`LISTRIGHTS "archive" anyone`)
+	s.Send(`* LISTRIGHTS archive anyone "" l r s w i p k x t e`)
+	s.Done("OK Listrights completed")
+
+	rights, err := im.ListRights("~/Mail/saved", "smith")
+	if err != nil {
+		t.Fatalf("listrights: %s", err)
+	}
+	expected := &ResponseListRights{"~/Mail/saved", "smith", "la", []string{"r", "swicdkxte"}}
+	if !reflect.DeepEqual(rights, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", rights, expected)
+	}
+
+	rights, err = im.ListRights("archive", "anyone")
+	if err != nil {
+		t.Fatalf("listrights: %s", err)
+	}
+	if rights.Required != "" || len(rights.Optional) != 10 || rights.Optional[9] != "e" {
+		t.Fatalf("unexpected rights %#v", rights)
+	}
+	waitFake(t, s)
+}
+
+func TestStoreDeletedWithoutRights(t *testing.T) {
+	im, s := startFake(t)
+	im.CheckRights = true
+	s.Expect(`SELECT "Shared"`)
+	s.Send("* 3 EXISTS")
+	s.Done("OK [READ-WRITE] SELECT completed")
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ACL")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`MYRIGHTS "Shared"`)
+	s.Send("* MYRIGHTS Shared lrswi")
+	s.Done("OK MYRIGHTS completed")
+	// The cached rights serve the second check; only the flag change
+	// that needs none is sent.
+	s.Expect(`STORE 1:3 +FLAGS (\Seen)`)
+	s.Send(`* 1 FETCH (FLAGS (\Seen))`)
+	s.Done("OK STORE completed")
+
+	if _, err := im.Select("Shared"); err != nil {
+		t.Fatalf("select: %s", err)
+	}
+	err := im.Store("1:3", "+FLAGS", []string{`\Deleted`})
+	if e, ok := err.(*RightsError); !ok || e.Right != 't' || e.Mailbox != "Shared" {
+		t.Fatalf("expected a rights error, got %v", err)
+	}
+	if err := im.UIDStore("4", "-FLAGS.SILENT", []string{`\Deleted`}); err == nil {
+		t.Fatalf("expected a rights error")
+	}
+	if err := im.Store("1:3", "+FLAGS", []string{`\Seen`}); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestDeleteWithRights(t *testing.T) {
+	im, s := startFake(t)
+	im.CheckRights = true
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ACL")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`MYRIGHTS "Old"`)
+	// An RFC 2086 server's 'd' will do.
+	s.Send("* MYRIGHTS Old lrswipcda")
+	s.Done("OK MYRIGHTS completed")
+	s.Expect(`DELETE "Old"`)
+	s.Done("OK DELETE completed")
+	s.Expect(`MYRIGHTS "Gone"`)
+	s.Done("NO Mailbox doesn't exist")
+	s.Expect(`RENAME "Gone" "Here"`)
+	s.Done("NO Mailbox doesn't exist")
+
+	if err := im.Delete("Old"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	// Without rights to go by, the command is sent and fails itself.
+	if err := im.Rename("Gone", "Here"); err == nil {
+		t.Fatalf("expected rename to fail")
+	} else if _, ok := err.(*IMAPError); !ok {
+		t.Fatalf("expected the server's refusal, got %v", err)
+	}
+	waitFake(t, s)
+}
@@ -0,0 +1,316 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BodyStructure describes the MIME structure of a message, as returned
+// by FETCH BODYSTRUCTURE.  A multipart body has Parts and a Subtype;
+// the other fields describe single parts.  Parameter names are
+// lower-cased, since MIME treats them case-insensitively.
+//
+// The MD5, disposition, language and location fields, and a
+// multipart's Params, are extension data, which servers may omit and
+// which FETCH BODY, the non-extensible form, never has; they are left
+// zero then.
+type BodyStructure struct {
+	Type, Subtype string
+	Params        map[string]string
+	ID            string
+	Description   string
+	Encoding      string
+	Size          int
+	Lines         int // text and message/rfc822 parts only
+
+	// message/rfc822 parts only.
+	Envelope *ResponseFetchEnvelope
+	Body     *BodyStructure
+
+	// Multipart only.  A multipart's Params, including its boundary,
+	// are extension data.
+	Parts []*BodyStructure
+
+	MD5               string
+	Disposition       string
+	DispositionParams map[string]string
+	Language          []string
+	Location          string
+
+	// Path is the part's section number (e.g. [2 1] for "2.1"); it
+	// is empty for a top-level multipart.
+	Path []int
+}
+
+// Section returns the part's section number in the dotted form used by
+// FETCH BODY[...], e.g. "2.1".
+func (b *BodyStructure) Section() string {
+	strs := make([]string, len(b.Path))
+	for i, n := range b.Path {
+		strs[i] = strconv.Itoa(n)
+	}
+	return strings.Join(strs, ".")
+}
+
+// Charset returns the charset parameter of a text part (e.g.
+// "iso-8859-1"), or "us-ascii", the MIME default, if it has none.
+func (b *BodyStructure) Charset() string {
+	if charset := b.Params["charset"]; charset != "" {
+		return charset
+	}
+	return "us-ascii"
+}
+
+// Attachments returns the parts below b that are attachments: those
+// with an "attachment" disposition or a filename parameter.  Their
+// Path says where to FETCH them from.
+func (b *BodyStructure) Attachments() []*BodyStructure {
+	var parts []*BodyStructure
+	if strings.EqualFold(b.Disposition, "attachment") || b.DispositionParams["filename"] != "" {
+		return append(parts, b)
+	}
+	for _, part := range b.Parts {
+		parts = append(parts, part.Attachments()...)
+	}
+	if b.Body != nil {
+		parts = append(parts, b.Body.Attachments()...)
+	}
+	return parts
+}
+
+// FindPart returns the part with section number path, or nil if there
+// is none.
+func (b *BodyStructure) FindPart(path []int) *BodyStructure {
+	if equalPaths(b.Path, path) {
+		return b
+	}
+	for _, part := range b.Parts {
+		if found := part.FindPart(path); found != nil {
+			return found
+		}
+	}
+	if b.Body != nil {
+		return b.Body.FindPart(path)
+	}
+	return nil
+}
+
+func equalPaths(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// number assigns section numbers to b and the parts below it, per RFC
+// 3501 section 6.4.5: the parts of a multipart are numbered from 1, and
+// the body of an encapsulated message/rfc822 is numbered as if it were
+// the top level of a message.
+func (b *BodyStructure) number(path []int) {
+	b.Path = path
+	for i, part := range b.Parts {
+		part.number(appendPath(path, i+1))
+	}
+	if b.Body != nil {
+		if b.Body.Parts != nil {
+			b.Body.number(path)
+		} else {
+			b.Body.number(appendPath(path, 1))
+		}
+	}
+}
+
+func appendPath(path []int, n int) []int {
+	return append(append([]int(nil), path...), n)
+}
+
+// parseBodyStructure converts the value of a FETCH BODYSTRUCTURE or
+// BODY item.  The two differ only in BODY lacking extension data, which
+// is optional anyway, so either parses the same way.
+func parseBodyStructure(s sexp) *BodyStructure {
+	b := bodyStructureFromSexp(s)
+	if b.Parts != nil {
+		b.number(nil)
+	} else {
+		b.number([]int{1})
+	}
+	return b
+}
+
+func bodyStructureFromSexp(s sexp) *BodyStructure {
+	list, ok := s.([]sexp)
+	if !ok || len(list) == 0 {
+		panic(fmt.Errorf("bad body structure %#v", s))
+	}
+	if _, multi := list[0].([]sexp); multi {
+		return multipartFromSexp(list)
+	}
+
+	/*
+		body-type-1part = (body-type-basic / body-type-msg / body-type-text)
+		                  [SP body-ext-1part]
+		body-type-basic = media-basic SP body-fields
+		body-type-msg   = media-message SP body-fields SP envelope
+		                  SP body SP body-fld-lines
+		body-type-text  = media-text SP body-fields SP body-fld-lines
+		body-fields     = body-fld-param SP body-fld-id SP body-fld-desc SP
+		                  body-fld-enc SP body-fld-octets
+	*/
+	if len(list) < 7 {
+		panic(fmt.Errorf("body part needed 7 fields, had %d", len(list)))
+	}
+	b := &BodyStructure{
+		Type:        sexpString(list[0]),
+		Subtype:     sexpString(list[1]),
+		Params:      paramsFromSexp(list[2]),
+		ID:          sexpString(list[3]),
+		Description: sexpString(list[4]),
+		Encoding:    sexpString(list[5]),
+		Size:        sexpNumber(list[6]),
+	}
+
+	ext := 7
+	switch {
+	case strings.EqualFold(b.Type, "message") && strings.EqualFold(b.Subtype, "rfc822"):
+		if len(list) < 10 {
+			panic(fmt.Errorf("message/rfc822 part needed 10 fields, had %d", len(list)))
+		}
+		env := envelopeFromSexp(list[7])
+		b.Envelope = &env
+		b.Body = bodyStructureFromSexp(list[8])
+		b.Lines = sexpNumber(list[9])
+		ext = 10
+	case strings.EqualFold(b.Type, "text"):
+		if len(list) < 8 {
+			panic(fmt.Errorf("text part needed 8 fields, had %d", len(list)))
+		}
+		b.Lines = sexpNumber(list[7])
+		ext = 8
+	}
+
+	/*
+		body-ext-1part  = body-fld-md5 [SP body-fld-dsp [SP body-fld-lang
+		                  [SP body-fld-loc *(SP body-extension)]]]
+	*/
+	ext1 := list[ext:]
+	if len(ext1) > 0 {
+		b.MD5 = sexpString(ext1[0])
+		b.extensionFromSexp(ext1[1:])
+	}
+	return b
+}
+
+func multipartFromSexp(list []sexp) *BodyStructure {
+	/*
+		body-type-mpart = 1*body SP media-subtype
+		                  [SP body-ext-mpart]
+	*/
+	b := &BodyStructure{Type: "multipart"}
+	i := 0
+	for ; i < len(list); i++ {
+		if _, ok := list[i].([]sexp); !ok {
+			break
+		}
+		b.Parts = append(b.Parts, bodyStructureFromSexp(list[i]))
+	}
+	if i == len(list) {
+		panic(errors.New("multipart body missing subtype"))
+	}
+	b.Subtype = sexpString(list[i])
+
+	/*
+		body-ext-mpart  = body-fld-param [SP body-fld-dsp [SP body-fld-lang
+		                  [SP body-fld-loc *(SP body-extension)]]]
+	*/
+	if ext := list[i+1:]; len(ext) > 0 {
+		b.Params = paramsFromSexp(ext[0])
+		b.extensionFromSexp(ext[1:])
+	}
+	return b
+}
+
+// extensionFromSexp fills in the trailing extension data shared by
+// single parts and multiparts: disposition, language and location,
+// any of which may be missing or NIL.
+func (b *BodyStructure) extensionFromSexp(ext []sexp) {
+	/*
+		body-fld-dsp    = "(" string SP body-fld-param ")" / nil
+		body-fld-lang   = nstring / "(" string *(SP string) ")"
+		body-fld-loc    = nstring
+	*/
+	if len(ext) > 0 && ext[0] != nil {
+		dsp, ok := ext[0].([]sexp)
+		if !ok || len(dsp) != 2 {
+			panic(fmt.Errorf("bad body disposition %#v", ext[0]))
+		}
+		b.Disposition = sexpString(dsp[0])
+		b.DispositionParams = paramsFromSexp(dsp[1])
+	}
+	if len(ext) > 1 && ext[1] != nil {
+		if langs, ok := ext[1].([]sexp); ok {
+			for _, lang := range langs {
+				b.Language = append(b.Language, sexpString(lang))
+			}
+		} else {
+			b.Language = []string{sexpString(ext[1])}
+		}
+	}
+	if len(ext) > 2 {
+		b.Location = sexpString(ext[2])
+	}
+}
+
+// paramsFromSexp converts a body-fld-param ("(" string SP string ... ")"
+// or NIL) to a map keyed by lower-cased parameter name.
+func paramsFromSexp(s sexp) map[string]string {
+	if s == nil {
+		return nil
+	}
+	list, ok := s.([]sexp)
+	if !ok || len(list)%2 != 0 {
+		panic(fmt.Errorf("bad body parameters %#v", s))
+	}
+	params := make(map[string]string, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		params[strings.ToLower(sexpString(list[i]))] = sexpString(list[i+1])
+	}
+	return params
+}
+
+// sexpString returns the text of a string or literal, and "" for NIL.
+func sexpString(s sexp) string {
+	switch s := s.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	}
+	panic(fmt.Errorf("expected string, got %#v", s))
+}
+
+// sexpBytes returns the data of an nstring: nil for NIL, and a
+// non-nil slice for any string, even an empty one.
+func sexpBytes(s sexp) []byte {
+	switch s := s.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return s
+	}
+	return []byte(sexpString(s))
+}
+
+func sexpNumber(s sexp) int {
+	n, err := strconv.Atoi(sexpString(s))
+	check(err)
+	return n
+}
@@ -0,0 +1,209 @@
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type bodyStructureTest struct {
+	input    string
+	expected *BodyStructure
+}
+
+func (test bodyStructureTest) Run(t *testing.T) {
+	p := newParser(bytes.NewBufferString(test.input))
+	s, err := p.readSexp()
+	if err != nil {
+		t.Fatalf("parsing %s: %s", test.input, err)
+	}
+	var b *BodyStructure
+	func() {
+		defer recoverError(&err)
+		b = bodyStructureFromSexp(s)
+	}()
+	if err != nil {
+		t.Fatalf("parsing %s: %s", test.input, err)
+	}
+	if !reflect.DeepEqual(b, test.expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", b, test.expected)
+	}
+}
+
+func TestBodyStructureExtension(t *testing.T) {
+	tests := []bodyStructureTest{
+		{
+			`("TEXT" "PLAIN" ("CHARSET" "US-ASCII") NIL NIL "7BIT" 1152 23)`,
+			&BodyStructure{
+				Type:     "TEXT",
+				Subtype:  "PLAIN",
+				Params:   map[string]string{"charset": "US-ASCII"},
+				Encoding: "7BIT",
+				Size:     1152,
+				Lines:    23,
+			},
+		},
+		{
+			`("APPLICATION" "PDF" ("NAME" "x.pdf") "<id@host>" NIL "BASE64" 4554 "Q2hlY2s=" ("attachment" ("filename" "x.pdf")) ("en" "fr") "http://example.com/x.pdf")`,
+			&BodyStructure{
+				Type:              "APPLICATION",
+				Subtype:           "PDF",
+				Params:            map[string]string{"name": "x.pdf"},
+				ID:                "<id@host>",
+				Encoding:          "BASE64",
+				Size:              4554,
+				MD5:               "Q2hlY2s=",
+				Disposition:       "attachment",
+				DispositionParams: map[string]string{"filename": "x.pdf"},
+				Language:          []string{"en", "fr"},
+				Location:          "http://example.com/x.pdf",
+			},
+		},
+		{
+			`("TEXT" "HTML" NIL NIL NIL "QUOTED-PRINTABLE" 300 10 NIL NIL "en")`,
+			&BodyStructure{
+				Type:     "TEXT",
+				Subtype:  "HTML",
+				Encoding: "QUOTED-PRINTABLE",
+				Size:     300,
+				Lines:    10,
+				Language: []string{"en"},
+			},
+		},
+		{
+			`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1) ("IMAGE" "PNG" NIL NIL NIL "BASE64" 200 NIL ("inline" NIL)) "MIXED")`,
+			&BodyStructure{
+				Type:    "multipart",
+				Subtype: "MIXED",
+				Parts: []*BodyStructure{
+					{Type: "TEXT", Subtype: "PLAIN", Encoding: "7BIT", Size: 10, Lines: 1},
+					{Type: "IMAGE", Subtype: "PNG", Encoding: "BASE64", Size: 200, Disposition: "inline"},
+				},
+			},
+		},
+		{
+			`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1) "MIXED" ("BOUNDARY" "x") ("attachment" ("filename" "f")) "en" "loc")`,
+			&BodyStructure{
+				Type:              "multipart",
+				Subtype:           "MIXED",
+				Params:            map[string]string{"boundary": "x"},
+				Parts:             []*BodyStructure{{Type: "TEXT", Subtype: "PLAIN", Encoding: "7BIT", Size: 10, Lines: 1}},
+				Disposition:       "attachment",
+				DispositionParams: map[string]string{"filename": "f"},
+				Language:          []string{"en"},
+				Location:          "loc",
+			},
+		},
+		{
+			`(("TEXT" "PLAIN" ("CHARSET" "UTF-8") NIL NIL "QUOTED-PRINTABLE" 120 4 NIL NIL NIL) ("TEXT" "HTML" ("CHARSET" "UTF-8") NIL NIL "QUOTED-PRINTABLE" 480 12 NIL NIL NIL) "ALTERNATIVE" ("BOUNDARY" "xyz") NIL NIL)`,
+			&BodyStructure{
+				Type:    "multipart",
+				Subtype: "ALTERNATIVE",
+				Params:  map[string]string{"boundary": "xyz"},
+				Parts: []*BodyStructure{
+					{Type: "TEXT", Subtype: "PLAIN", Params: map[string]string{"charset": "UTF-8"}, Encoding: "QUOTED-PRINTABLE", Size: 120, Lines: 4},
+					{Type: "TEXT", Subtype: "HTML", Params: map[string]string{"charset": "UTF-8"}, Encoding: "QUOTED-PRINTABLE", Size: 480, Lines: 12},
+				},
+			},
+		},
+		{
+			`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1) ("TEXT" "HTML" NIL NIL NIL "7BIT" 20 1) "ALTERNATIVE" ("BOUNDARY" "xyz" "X-Extra" "1") ("inline" NIL))`,
+			&BodyStructure{
+				Type:    "multipart",
+				Subtype: "ALTERNATIVE",
+				Params:  map[string]string{"boundary": "xyz", "x-extra": "1"},
+				Parts: []*BodyStructure{
+					{Type: "TEXT", Subtype: "PLAIN", Encoding: "7BIT", Size: 10, Lines: 1},
+					{Type: "TEXT", Subtype: "HTML", Encoding: "7BIT", Size: 20, Lines: 1},
+				},
+				Disposition: "inline",
+			},
+		},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+}
+
+func TestFetchBodyStructure(t *testing.T) {
+	r := &reader{parser: newParser(bytes.NewBufferString(
+		"* 3 FETCH (BODYSTRUCTURE (\"APPLICATION\" \"OCTET-STREAM\" NIL NIL NIL \"BASE64\" 12))\r\n"))}
+	_, resp, err := r.readResponse()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	b := resp.(*ResponseFetch).BodyStructure
+	if b == nil || b.Subtype != "OCTET-STREAM" || b.Size != 12 || b.Disposition != "" {
+		t.Fatalf("unexpected body structure %#v", b)
+	}
+}
+
+func TestFetchBodyVsBodyStructure(t *testing.T) {
+	part := `"TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 20 2`
+	ext := ` NIL ("INLINE" NIL) NIL "http://example.com/a"`
+	r := &reader{parser: newParser(strings.NewReader(
+		"* 3 FETCH (BODY ((" + part + ")(" + part + ") \"MIXED\"))\r\n" +
+			"* 3 FETCH (BODYSTRUCTURE ((" + part + ext + ")(" + part + ext + ") \"MIXED\" (\"BOUNDARY\" \"x\") NIL (\"en\")))\r\n"))}
+	_, resp, err := r.readResponse()
+	if err != nil {
+		t.Fatalf("BODY: %s", err)
+	}
+	body := resp.(*ResponseFetch).BodyStructure
+	_, resp, err = r.readResponse()
+	if err != nil {
+		t.Fatalf("BODYSTRUCTURE: %s", err)
+	}
+	full := resp.(*ResponseFetch).BodyStructure
+
+	// The same structure either way, with extension data only from
+	// BODYSTRUCTURE.
+	for _, b := range []*BodyStructure{body, full} {
+		if len(b.Parts) != 2 || b.Subtype != "MIXED" || b.Parts[1].Section() != "2" ||
+			b.Parts[0].Lines != 2 || b.Parts[0].Params["charset"] != "us-ascii" {
+			t.Fatalf("unexpected structure %#v", b)
+		}
+	}
+	if body.Params != nil || body.Language != nil || body.Parts[0].Disposition != "" || body.Parts[0].Location != "" {
+		t.Fatalf("extension data in BODY: %#v %#v", body, body.Parts[0])
+	}
+	if full.Params["boundary"] != "x" || !reflect.DeepEqual(full.Language, []string{"en"}) ||
+		full.Parts[0].Disposition != "INLINE" || full.Parts[0].Location != "http://example.com/a" {
+		t.Fatalf("missing extension data in BODYSTRUCTURE: %#v %#v", full, full.Parts[0])
+	}
+}
+
+func TestBodyStructureAttachments(t *testing.T) {
+	p := newParser(bytes.NewBufferString(`(` +
+		`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 10 1) ("TEXT" "HTML" NIL NIL NIL "7BIT" 20 1) "ALTERNATIVE") ` +
+		`("APPLICATION" "PDF" ("NAME" "a.pdf") NIL NIL "BASE64" 4554 NIL ("attachment" ("filename" "a.pdf")) NIL NIL) ` +
+		`("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 300 (NIL "Fwd" NIL NIL NIL NIL NIL NIL NIL NIL) ` +
+		`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" 5 1) ("IMAGE" "PNG" NIL NIL NIL "BASE64" 80 NIL ("inline" ("filename" "b.png")) NIL NIL) "MIXED") 12) ` +
+		`"MIXED")`))
+	s, err := p.readSexp()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	b := parseBodyStructure(s)
+
+	var sections []string
+	for _, part := range b.Attachments() {
+		sections = append(sections, part.Section())
+	}
+	if !reflect.DeepEqual(sections, []string{"2", "3.2"}) {
+		t.Fatalf("unexpected attachment sections %q", sections)
+	}
+
+	if part := b.FindPart([]int{1, 2}); part == nil || part.Subtype != "HTML" {
+		t.Fatalf("FindPart(1.2) returned %#v", part)
+	}
+	if part := b.FindPart([]int{3, 1}); part == nil || part.Subtype != "PLAIN" || part.Size != 5 {
+		t.Fatalf("FindPart(3.1) returned %#v", part)
+	}
+	if part := b.FindPart([]int{4}); part != nil {
+		t.Fatalf("FindPart(4) returned %#v", part)
+	}
+	if b.FindPart(nil) != b {
+		t.Fatalf("FindPart() didn't return the top level")
+	}
+}
@@ -0,0 +1,62 @@
+package imap
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// BootstrapOptions says how Bootstrap sets up a session.
+type BootstrapOptions struct {
+	User, Password string
+
+	// TLSConfig is used for STARTTLS, as for StartTLS.
+	TLSConfig *tls.Config
+
+	// RequireTLS makes Bootstrap fail rather than log in over a
+	// connection without TLS, when the server lacks STARTTLS.
+	RequireTLS bool
+
+	// Enable lists the extensions (e.g. "CONDSTORE", "QRESYNC") to
+	// turn on after logging in, those the server lacks being left
+	// out, as with SetAutoEnable.
+	Enable []string
+
+	// Mailbox, if set, is selected last.
+	Mailbox string
+}
+
+// Bootstrap takes a started client through the usual setup: asking
+// for the capabilities, upgrading to TLS with STARTTLS unless the
+// connection is TLS already, logging in, enabling extensions, and
+// selecting a mailbox.  STARTTLS is used whenever the server offers
+// it.  The capabilities are asked for afresh after STARTTLS and after
+// logging in, as either can change them.
+func (imap *IMAP) Bootstrap(opts BootstrapOptions) error {
+	if _, ok := imap.ConnectionState(); !ok {
+		ok, err := imap.supports("STARTTLS")
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := imap.StartTLS(opts.TLSConfig); err != nil {
+				return err
+			}
+		} else if opts.RequireTLS {
+			return errors.New("imap: no TLS, and the server lacks STARTTLS")
+		}
+	}
+
+	if opts.Enable != nil {
+		imap.SetAutoEnable(opts.Enable...)
+	}
+	if _, _, err := imap.Auth(opts.User, opts.Password); err != nil {
+		return err
+	}
+
+	if opts.Mailbox != "" {
+		if _, err := imap.Select(opts.Mailbox); err != nil {
+			return err
+		}
+	}
+	return nil
+}
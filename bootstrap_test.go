@@ -0,0 +1,63 @@
+package imap
+
+import (
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	serverConfig, clientConfig := tlsConfigs(t, "imap.example.com")
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("STARTTLS")
+	s.Done("OK Begin TLS negotiation now")
+	s.StartTLS(serverConfig)
+	s.Expect("LOGIN user pass")
+	s.Done("OK LOGIN completed")
+	// No capabilities came with the OK, so they are asked for.
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ENABLE CONDSTORE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("ENABLE CONDSTORE")
+	s.Send("* ENABLED CONDSTORE")
+	s.Done("OK ENABLE completed")
+	s.Expect(`SELECT "INBOX"`)
+	s.Send("* 3 EXISTS")
+	s.Done("OK [READ-WRITE] SELECT completed")
+
+	err := im.Bootstrap(BootstrapOptions{
+		User:       "user",
+		Password:   "pass",
+		TLSConfig:  clientConfig,
+		RequireTLS: true,
+		Enable:     []string{"CONDSTORE", "QRESYNC"},
+		Mailbox:    "INBOX",
+	})
+	if err != nil {
+		t.Fatalf("bootstrap: %s", err)
+	}
+	if _, ok := im.ConnectionState(); !ok {
+		t.Fatalf("expected a TLS connection")
+	}
+	if !im.IsEnabled("CONDSTORE") || im.IsEnabled("QRESYNC") {
+		t.Fatalf("unexpected enabled set %q", im.enabled)
+	}
+	if im.selected != "INBOX" {
+		t.Fatalf("expected INBOX selected, got %q", im.selected)
+	}
+	waitFake(t, s)
+}
+
+func TestBootstrapRequireTLS(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	err := im.Bootstrap(BootstrapOptions{User: "user", Password: "pass", RequireTLS: true})
+	if err == nil {
+		t.Fatalf("expected an error logging in without TLS")
+	}
+	waitFake(t, s)
+}
@@ -0,0 +1,30 @@
+package imap
+
+import (
+	"compress/flate"
+	"errors"
+)
+
+// Compress turns on COMPRESS=DEFLATE (RFC 4978), compressing the rest
+// of the session both ways.  It needs the COMPRESS=DEFLATE capability.
+func (imap *IMAP) Compress() error {
+	if imap.deflate != nil {
+		return errors.New("imap: compression is already on")
+	}
+	if err := imap.require("COMPRESS=DEFLATE"); err != nil {
+		return err
+	}
+	imap.pendingLock.Lock()
+	imap.startInflate = true
+	imap.pendingLock.Unlock()
+	if err := imap.simple("COMPRESS DEFLATE"); err != nil {
+		imap.pendingLock.Lock()
+		imap.startInflate = false
+		imap.pendingLock.Unlock()
+		return err
+	}
+	// Everything sent so far has been flushed past out.
+	imap.deflate, _ = flate.NewWriter(imap.w, flate.DefaultCompression)
+	imap.out.Reset(imap.deflate)
+	return nil
+}
@@ -0,0 +1,83 @@
+package imap
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCompress(t *testing.T) {
+	im, s := DialPipe()
+	t.Cleanup(func() { s.Close() })
+	s.Send("* OK [CAPABILITY IMAP4rev1 COMPRESS=DEFLATE IDLE] ready")
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	s.Expect("COMPRESS DEFLATE")
+	s.Done("OK DEFLATE active")
+	s.Compress()
+	s.Expect("NOOP")
+	s.Send("* 3 EXISTS")
+	s.Done("OK NOOP completed")
+	s.Expect("APPEND \"INBOX\" {5}\r\nhello")
+	s.Done("OK APPEND completed")
+	s.Expect("IDLE")
+	s.Send("+ idling")
+	s.Send("* 4 EXISTS")
+	s.ExpectLine("DONE")
+	s.Done("OK IDLE terminated")
+
+	// A write left in a buffer would hang the session, not fail it.
+	done := make(chan error, 1)
+	go func() {
+		if err := im.Compress(); err != nil {
+			done <- err
+			return
+		}
+		if err := im.Noop(); err != nil {
+			done <- err
+			return
+		}
+		if err := im.Append("INBOX", nil, []byte("hello")); err != nil {
+			done <- err
+			return
+		}
+		_, err := im.IdleUntil(context.Background(), EventExists)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("compressed session: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("compressed session hung")
+	}
+	waitFake(t, s)
+
+	if err := im.Compress(); err == nil {
+		t.Fatalf("compression turned on twice")
+	}
+}
+
+func TestCompressRefused(t *testing.T) {
+	im, s := DialPipe()
+	t.Cleanup(func() { s.Close() })
+	s.Send("* OK [CAPABILITY IMAP4rev1 COMPRESS=DEFLATE] ready")
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	s.Expect("COMPRESS DEFLATE")
+	s.Done("NO [COMPRESSIONACTIVE] Already compressing")
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	if err := im.Compress(); err == nil {
+		t.Fatalf("refused COMPRESS succeeded")
+	}
+	// The session carries on uncompressed.
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	waitFake(t, s)
+}
@@ -0,0 +1,72 @@
+package imap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// DecodeBody wraps r, a body part fetched with BODY[...], in a decoder
+// for its content transfer encoding (BodyStructure.Encoding).  7BIT,
+// 8BIT and BINARY parts pass through unchanged, as do parts in an
+// unknown encoding; see KnownEncoding.
+func DecodeBody(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// KnownEncoding reports whether DecodeBody knows the content transfer
+// encoding, rather than passing the part through undecoded.
+func KnownEncoding(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "base64", "quoted-printable", "", "7bit", "8bit", "binary":
+		return true
+	}
+	return false
+}
+
+// DecodeText is DecodeBody for a text part, which also converts the text
+// from the part's Charset to UTF-8.  It fails for a charset it doesn't
+// know.
+func DecodeText(r io.Reader, part *BodyStructure) (io.Reader, error) {
+	return charsetReader(part.Charset(), DecodeBody(r, part.Encoding))
+}
+
+// charsetReader converts input from charset to UTF-8, knowing the
+// charsets, and the names for them, that web browsers do.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "us-ascii":
+		return input, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("imap: unsupported charset %q", charset)
+	}
+	return transform.NewReader(input, enc.NewDecoder()), nil
+}
+
+// decodeHeader decodes the RFC 2047 encoded words in s, as servers
+// pass on display names the way they are in the header.  s is returned
+// as is if it can't be decoded, say because of an unknown charset.
+func decodeHeader(s string) string {
+	if !strings.Contains(s, "=?") {
+		return s
+	}
+	decoded, err := (&mime.WordDecoder{CharsetReader: charsetReader}).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
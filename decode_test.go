@@ -0,0 +1,90 @@
+package imap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+type decodeTest struct {
+	encoding, input, expected string
+}
+
+func (test decodeTest) Run(t *testing.T) {
+	out, err := io.ReadAll(DecodeBody(bytes.NewBufferString(test.input), test.encoding))
+	if err != nil {
+		t.Fatalf("decoding %q: %s", test.input, err)
+	}
+	if string(out) != test.expected {
+		t.Fatalf("decoding %q: expected %q, got %q", test.input, test.expected, out)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	// Round-trip a part wrapped at 76 columns, as MIME requires.
+	body := bytes.Repeat([]byte("attachment data \x00\xff "), 20)
+	encoded := base64.StdEncoding.EncodeToString(body)
+	wrapped := ""
+	for len(encoded) > 76 {
+		wrapped += encoded[:76] + "\r\n"
+		encoded = encoded[76:]
+	}
+	wrapped += encoded + "\r\n"
+
+	tests := []decodeTest{
+		{"BASE64", wrapped, string(body)},
+		{"quoted-printable", "caf=C3=A9 =\r\nau lait", "caf\xc3\xa9 au lait"},
+		{"7BIT", "plain text\r\n", "plain text\r\n"},
+		{"x-unknown", "as is", "as is"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+		if known := test.encoding != "x-unknown"; KnownEncoding(test.encoding) != known {
+			t.Fatalf("expected KnownEncoding(%q) to be %v", test.encoding, known)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	part := &BodyStructure{Type: "text", Subtype: "plain", Encoding: "quoted-printable",
+		Params: map[string]string{"charset": "ISO-8859-1"}}
+	if part.Charset() != "ISO-8859-1" {
+		t.Fatalf("unexpected charset %q", part.Charset())
+	}
+	input := strings.Repeat("Caf=E9 cr=E8me br=FBl=E9e, =A39 =\r\n", 100)
+	expected := strings.Repeat("Café crème brûlée, £9 ", 100)
+	r, err := DecodeText(strings.NewReader(input), part)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	// Read in small pieces, so that characters are split.
+	out, err := io.ReadAll(&dripReader{r, 3})
+	if err != nil || string(out) != expected {
+		t.Fatalf("expected %q, got %q %v", expected, out, err)
+	}
+
+	// Without a charset, US-ASCII passes through.
+	plain := &BodyStructure{Type: "text", Subtype: "plain"}
+	if plain.Charset() != "us-ascii" {
+		t.Fatalf("expected the default us-ascii, got %q", plain.Charset())
+	}
+	if r, err := DecodeText(strings.NewReader("hi"), plain); err != nil {
+		t.Fatalf("decode: %s", err)
+	} else if out, _ := io.ReadAll(r); string(out) != "hi" {
+		t.Fatalf("expected hi, got %q", out)
+	}
+
+	// Others are converted too, and unknown ones refused.
+	koi8 := &BodyStructure{Type: "text", Subtype: "plain", Params: map[string]string{"charset": "koi8-r"}}
+	if r, err := DecodeText(strings.NewReader("\xf0\xd2\xc9\xd7\xc5\xd4"), koi8); err != nil {
+		t.Fatalf("decode: %s", err)
+	} else if out, _ := io.ReadAll(r); string(out) != "Привет" {
+		t.Fatalf("expected Привет, got %q", out)
+	}
+	unknown := &BodyStructure{Type: "text", Subtype: "plain", Params: map[string]string{"charset": "x-unknown"}}
+	if _, err := DecodeText(strings.NewReader("hi"), unknown); err == nil {
+		t.Fatalf("expected an error for x-unknown")
+	}
+}
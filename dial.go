@@ -0,0 +1,136 @@
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Dialer establishes connections for the Dial functions.  It is
+// satisfied by *net.Dialer and by golang.org/x/net/proxy's
+// ContextDialer, so connections may be routed through a SOCKS proxy or
+// any custom transport.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// An Option configures a connection made by the Dial functions.
+type Option func(*dialConfig)
+
+type dialConfig struct {
+	tls          *tls.Config // nil for plaintext
+	lenient      bool
+	lenientFlags bool
+	autoEnable   []string
+}
+
+// WithTLS runs TLS over the connection, as for port 993.  A nil config,
+// or one without a ServerName, verifies the certificate against the
+// host being dialed.
+func WithTLS(config *tls.Config) Option {
+	return func(c *dialConfig) {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		c.tls = config
+	}
+}
+
+// WithLenientLineEndings accepts lines ending in a bare LF from the
+// server; see SetLenientLineEndings.
+func WithLenientLineEndings() Option {
+	return func(c *dialConfig) {
+		c.lenient = true
+	}
+}
+
+// WithLenientFlags accepts a single flag without parentheses for a
+// list of them; see SetLenientFlags.
+func WithLenientFlags() Option {
+	return func(c *dialConfig) {
+		c.lenientFlags = true
+	}
+}
+
+// WithAutoEnable enables those of caps the server has once logged in;
+// see SetAutoEnable.
+func WithAutoEnable(caps ...string) Option {
+	return func(c *dialConfig) {
+		c.autoEnable = caps
+	}
+}
+
+// DialWithDialer connects to addr ("host:port") with d and returns a
+// client on the connection.  Start has not been called.
+func DialWithDialer(ctx context.Context, d Dialer, addr string, opts ...Option) (*IMAP, error) {
+	var c dialConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return dial(ctx, d, addr, c)
+}
+
+func dial(ctx context.Context, d Dialer, addr string, c dialConfig) (*IMAP, error) {
+	config := c.tls
+	if config != nil && config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	imap := New(conn, conn)
+	imap.serverName, _, _ = net.SplitHostPort(addr)
+	imap.SetLenientLineEndings(c.lenient)
+	imap.SetLenientFlags(c.lenientFlags)
+	imap.SetAutoEnable(c.autoEnable...)
+	imap.redial = func(ctx context.Context, addr string) (*IMAP, error) {
+		// The certificate to check is the new host's.
+		rc := c
+		if rc.tls != nil {
+			rc.tls = c.tls.Clone()
+			rc.tls.ServerName = ""
+		}
+		return dial(ctx, d, addr, rc)
+	}
+	return imap, nil
+}
+
+// DialTLSWithDialer is DialWithDialer with the WithTLS(config) option.
+func DialTLSWithDialer(ctx context.Context, d Dialer, addr string, config *tls.Config, opts ...Option) (*IMAP, error) {
+	return DialWithDialer(ctx, d, addr, append([]Option{WithTLS(config)}, opts...)...)
+}
+
+// Conn returns the connection the client talks over, or nil if it was
+// made with New on something other than a net.Conn.  It is meant for
+// setting socket options and the like: reading from or writing to it
+// directly will corrupt the session.
+func (imap *IMAP) Conn() net.Conn {
+	conn, _ := imap.w.w.(net.Conn)
+	return conn
+}
+
+// ConnectionState returns the state of the TLS connection the client
+// talks over, as for certificate pinning.  It returns false if the
+// connection isn't TLS.
+func (imap *IMAP) ConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := imap.Conn().(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
@@ -0,0 +1,126 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeDialer hands out the client end of a pipe whose server end runs
+// a FakeServer, optionally behind TLS.
+type pipeDialer struct {
+	addr   string
+	config *tls.Config // server config; nil for plaintext
+	server *FakeServer
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.addr = addr
+	client, server := net.Pipe()
+	if d.config != nil {
+		server = tls.Server(server, d.config)
+	}
+	d.server = newFakeServer(server)
+	d.server.Send("* OK fake server ready")
+	return client, nil
+}
+
+// testCertificate returns a self-signed certificate for hosts and a
+// pool trusting it.
+func testCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDialWithDialer(t *testing.T) {
+	d := &pipeDialer{}
+	im, err := DialWithDialer(context.Background(), d, "imap.example.com:143")
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer d.server.Close()
+	if d.addr != "imap.example.com:143" {
+		t.Fatalf("dialed %q", d.addr)
+	}
+	hello, err := im.Start()
+	if err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	if hello != "fake server ready" {
+		t.Fatalf("unexpected greeting %q", hello)
+	}
+	if im.Conn() == nil {
+		t.Fatalf("no connection")
+	}
+	if _, ok := im.ConnectionState(); ok {
+		t.Fatalf("TLS state on a plaintext connection")
+	}
+}
+
+func TestDialTLSWithDialer(t *testing.T) {
+	cert, pool := testCertificate(t, "imap.example.com")
+	d := &pipeDialer{config: &tls.Config{Certificates: []tls.Certificate{cert}}}
+
+	im, err := DialTLSWithDialer(context.Background(), d, "imap.example.com:993", &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer d.server.Close()
+	im.Unsolicited = make(chan interface{}, 10)
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	d.server.Expect("NOOP")
+	d.server.Done("OK NOOP completed")
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	state, ok := im.ConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 || !bytes.Equal(state.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Fatalf("unexpected TLS state %v, %v", state, ok)
+	}
+	waitFake(t, d.server)
+}
+
+func TestDialWithTLSOption(t *testing.T) {
+	cert, pool := testCertificate(t, "imap.example.com")
+	d := &pipeDialer{config: &tls.Config{Certificates: []tls.Certificate{cert}}}
+
+	im, err := DialWithDialer(context.Background(), d, "imap.example.com:993", WithTLS(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer d.server.Close()
+	if _, ok := im.ConnectionState(); !ok {
+		t.Fatalf("no TLS state")
+	}
+}
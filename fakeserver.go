@@ -0,0 +1,291 @@
+package imap
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeServer is a scripted IMAP server for tests, both this package's
+// and those of programs built on it.  Steps are queued with Send,
+// Expect and friends, and are played back in order against the client
+// on the other end of an in-memory connection; see DialPipe.
+//
+// If the client sends something the script doesn't expect, the server
+// answers the offending command with a tagged BAD (so the client call
+// fails instead of hanging), drops the rest of the script, and reports
+// the mismatch from Wait.
+type FakeServer struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    io.Writer
+	tag  string // tag of the last command read
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	steps  []func() error
+	busy   bool
+	err    error
+	closed bool
+}
+
+// DialPipe returns a client connected to a new FakeServer over
+// net.Pipe.  Start has not been called on the client; queue a greeting
+// with Send first.  The client's Unsolicited channel is buffered so
+// that tests need not drain it.
+func DialPipe() (*IMAP, *FakeServer) {
+	client, server := net.Pipe()
+	im := New(client, client)
+	im.Unsolicited = make(chan interface{}, 100)
+	return im, newFakeServer(server)
+}
+
+func newFakeServer(conn net.Conn) *FakeServer {
+	s := &FakeServer{conn: conn, r: bufio.NewReader(conn), w: conn}
+	s.cond = sync.NewCond(&s.lock)
+	go s.serve()
+	return s
+}
+
+func (s *FakeServer) serve() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		for len(s.steps) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			return
+		}
+		step := s.steps[0]
+		s.busy = true
+		s.lock.Unlock()
+		err := step()
+		s.lock.Lock()
+		s.busy = false
+		if s.closed {
+			s.cond.Broadcast()
+			return
+		}
+		s.steps = s.steps[1:]
+		if err != nil {
+			if s.err == nil {
+				s.err = err
+			}
+			s.steps = nil
+		}
+		s.cond.Broadcast()
+	}
+}
+
+func (s *FakeServer) queue(step func() error) {
+	s.lock.Lock()
+	s.steps = append(s.steps, step)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// Close hangs up on the client and drops the rest of the script.
+func (s *FakeServer) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.steps = nil
+	conn := s.conn
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	return conn.Close()
+}
+
+// Wait blocks until every step queued so far has been played back and
+// returns the first error the script hit, if any.
+func (s *FakeServer) Wait() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.steps) > 0 || s.busy {
+		s.cond.Wait()
+	}
+	return s.err
+}
+
+// Send queues a line (without the trailing CRLF) to be written to the
+// client, e.g. "* 3 EXISTS" or "+ challenge".  The line may embed
+// literals, as in "* 1 FETCH (RFC822 {5}\r\nhello)".
+func (s *FakeServer) Send(line string) {
+	s.queue(func() error {
+		_, err := io.WriteString(s.w, line+"\r\n")
+		return err
+	})
+}
+
+// Done queues the tagged completion of the last command read, e.g.
+// Done("OK NOOP completed").
+func (s *FakeServer) Done(status string) {
+	s.queue(func() error {
+		_, err := io.WriteString(s.w, s.tag+" "+status+"\r\n")
+		return err
+	})
+}
+
+// Compress queues turning on COMPRESS=DEFLATE for the rest of the
+// session, as after answering COMPRESS DEFLATE with Done("OK ...").
+func (s *FakeServer) Compress() {
+	s.queue(func() error {
+		s.r = bufio.NewReader(flate.NewReader(s.r))
+		w, err := flate.NewWriter(s.conn, flate.DefaultCompression)
+		s.w = &flushWriter{w}
+		return err
+	})
+}
+
+// StartTLS queues running the server side of a TLS handshake with
+// config and carrying on over it, as after answering STARTTLS with
+// Done("OK ...").
+func (s *FakeServer) StartTLS(config *tls.Config) {
+	s.queue(func() error {
+		conn := tls.Server(s.conn, config)
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.conn = conn
+		s.lock.Unlock()
+		s.r = bufio.NewReader(conn)
+		s.w = conn
+		return nil
+	})
+}
+
+// flushWriter flushes each write through a compressor, as the client
+// waits on every line.
+type flushWriter struct {
+	w *flate.Writer
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = f.w.Flush()
+	}
+	return n, err
+}
+
+// Expect queues reading a tagged command and checking it against
+// command, which excludes the tag and the trailing CRLF.  Synchronizing
+// literals are answered with a continuation request and their data is
+// expected inline, as in "APPEND INBOX {5}\r\nhello".
+func (s *FakeServer) Expect(command string) {
+	s.queue(func() error {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		space := strings.IndexByte(line, ' ')
+		if space < 0 {
+			return fmt.Errorf("fakeserver: expected command %q, got %q", command, line)
+		}
+		s.tag = line[:space]
+		got := line[space+1:]
+		for {
+			n, ok := literalLength(got)
+			if !ok {
+				break
+			}
+			if _, err = io.WriteString(s.w, "+ Ready for literal data\r\n"); err != nil {
+				return err
+			}
+			data := make([]byte, n)
+			if _, err = io.ReadFull(s.r, data); err != nil {
+				return err
+			}
+			rest, err := s.readLine()
+			if err != nil {
+				return err
+			}
+			got += "\r\n" + string(data) + rest
+		}
+		if got != command {
+			return s.reject(fmt.Errorf("fakeserver: expected command %q, got %q", command, got))
+		}
+		return nil
+	})
+}
+
+// ExpectHead queues reading a tagged command line that ends by
+// announcing a synchronizing literal, without answering it, so that
+// the script can Send a continuation request or reject the command
+// with Done.  Like Expect, command excludes the tag and the CRLF.
+func (s *FakeServer) ExpectHead(command string) {
+	s.queue(func() error {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		space := strings.IndexByte(line, ' ')
+		if space >= 0 {
+			s.tag = line[:space]
+		}
+		if got := line[space+1:]; got != command {
+			return s.reject(fmt.Errorf("fakeserver: expected command %q, got %q", command, got))
+		}
+		return nil
+	})
+}
+
+// ExpectLine queues reading one untagged line from the client, such as
+// a SASL response or IDLE's DONE, and checking it against line.
+func (s *FakeServer) ExpectLine(line string) {
+	s.queue(func() error {
+		got, err := s.readLine()
+		if err != nil {
+			return err
+		}
+		if got != line {
+			return s.reject(fmt.Errorf("fakeserver: expected line %q, got %q", line, got))
+		}
+		return nil
+	})
+}
+
+// reject fails the current command on the wire and returns err.
+func (s *FakeServer) reject(err error) error {
+	if s.tag == "" {
+		return err
+	}
+	io.WriteString(s.w, s.tag+" BAD "+err.Error()+"\r\n")
+	return err
+}
+
+// readLine reads a CRLF-terminated line, returning it without the CRLF.
+func (s *FakeServer) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("fakeserver: line %q not terminated by CRLF", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// literalLength reports the length of the synchronizing literal that
+// ends line, if any.
+func literalLength(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndex(line, "{")
+	if open < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(line[open+1 : len(line)-1])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,86 @@
+package imap
+
+// FetchIter steps through the results of a FETCH as they are read off
+// the connection, so that a large mailbox need not be held in memory.
+// The read thread waits for each result to be taken, which leaves the
+// rest of the response in the TCP window until the caller is ready.
+//
+//	it, err := imap.FetchIter("1:*", []string{"RFC822"})
+//	...
+//	for it.Next() {
+//		save(it.Result())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type FetchIter struct {
+	imap   *IMAP
+	ch     chan interface{}
+	result *ResponseFetch
+	status *ResponseStatus
+	err    error
+	done   bool
+}
+
+// FetchIter starts a FETCH and returns an iterator over its results.
+// The iterator must be run to completion or closed before the
+// connection is used for anything else.
+func (imap *IMAP) FetchIter(sequence string, fields []string) (*FetchIter, error) {
+	cmd, err := formatFetch(sequence, fields)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan interface{})
+	if err := imap.Send(ch, "%s", cmd); err != nil {
+		return nil, err
+	}
+	return &FetchIter{imap: imap, ch: ch}, nil
+}
+
+// Next reads the next result, which is then available from Result.  It
+// returns false once the command has completed or failed.
+func (it *FetchIter) Next() bool {
+	it.result = nil
+	for !it.done {
+		switch r := (<-it.ch).(type) {
+		case *ResponseFetch:
+			it.result = r
+			return true
+		case *ResponseStatus:
+			if !r.tagged {
+				it.imap.unsolicited(r)
+				continue
+			}
+			it.done = true
+			it.status = r
+			it.imap.lastStatus = r
+			if r.status != OK {
+				it.err = &IMAPError{r.status, r.text, r.code}
+			}
+		case error:
+			it.done = true
+			it.err = r
+		default:
+			it.imap.unsolicited(r)
+		}
+	}
+	return false
+}
+
+// Result returns the result read by the last call to Next.
+func (it *FetchIter) Result() *ResponseFetch {
+	return it.result
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *FetchIter) Err() error {
+	return it.err
+}
+
+// Close skips any remaining results and waits for the command to
+// complete, leaving the connection ready for the next command.
+func (it *FetchIter) Close() error {
+	for it.Next() {
+	}
+	return it.err
+}
@@ -0,0 +1,121 @@
+package imap
+
+import "context"
+
+// EventMask selects the kinds of mailbox update IdleUntil waits for.
+type EventMask int
+
+const (
+	EventExists  EventMask = 1 << iota // *ResponseExists: new mail
+	EventExpunge                       // *ResponseExpunge
+	EventFetch                         // *FlagUpdate or another *ResponseFetch
+	EventStatus                        // *MailboxStatus, for other mailboxes under NOTIFY
+)
+
+// Update is a mailbox update reported during IDLE: a *ResponseExists,
+// *ResponseExpunge, *FlagUpdate, *ResponseFetch or *MailboxStatus.
+type Update interface{}
+
+// matches reports whether update is of a kind in m.
+func (m EventMask) matches(update interface{}) bool {
+	switch update.(type) {
+	case *ResponseExists:
+		return m&EventExists != 0
+	case *ResponseExpunge:
+		return m&EventExpunge != 0
+	case *FlagUpdate, *ResponseFetch:
+		return m&EventFetch != 0
+	case *MailboxStatus:
+		return m&EventStatus != 0
+	}
+	return false
+}
+
+// IdleUntil idles (RFC 2177) until an update of a kind in events
+// arrives or ctx is done, then ends the IDLE and returns the update, or
+// ctx's error.  Other responses, including updates not in events, go to
+// the Unsolicited channel as they arrive.  If the server ends the IDLE
+// itself, IdleUntil returns nil and no error, and may just be called
+// again.  It needs the IDLE capability.
+//
+// CommandTimeout doesn't apply, as an IDLE lasts as long as it must.
+// To end one on shutdown without waiting on the server, call Close.
+func (imap *IMAP) IdleUntil(ctx context.Context, events EventMask) (Update, error) {
+	if err := imap.require("IDLE"); err != nil {
+		return nil, err
+	}
+	ch := make(chan interface{}, 1)
+	tag, err := imap.begin(ch)
+	if err != nil {
+		return nil, err
+	}
+	if err := imap.write(tag.String() + " IDLE\r\n"); err != nil {
+		imap.abort(err)
+		return nil, err
+	}
+
+	var update Update
+	idling, stop := false, false
+	done := ctx.Done()
+	for !idling || !stop {
+		select {
+		case r := <-ch:
+			switch r := r.(type) {
+			case *ResponseContinuation:
+				idling = true
+			case *ResponseStatus:
+				if r.tagged {
+					return nil, imap.idleDone(r)
+				}
+				imap.unsolicited(r)
+			case error:
+				return nil, r
+			default:
+				r = unilateral(r)
+				if !stop && events.matches(r) {
+					update, stop = r, true
+				} else {
+					imap.unsolicited(r)
+				}
+			}
+		case <-done:
+			// DONE has to wait for the continuation, if it hasn't
+			// come yet.
+			stop, done = true, nil
+		}
+	}
+
+	if err := imap.write("DONE\r\n"); err != nil {
+		imap.abort(err)
+		return nil, err
+	}
+	for {
+		switch r := (<-ch).(type) {
+		case *ResponseStatus:
+			if r.tagged {
+				if err := imap.idleDone(r); err != nil {
+					return nil, err
+				}
+				if update == nil {
+					return nil, ctx.Err()
+				}
+				return update, nil
+			}
+			imap.unsolicited(r)
+		case error:
+			return nil, r
+		default:
+			imap.unsolicited(r)
+		}
+	}
+}
+
+// idleDone handles the completion of an IDLE.
+func (imap *IMAP) idleDone(r *ResponseStatus) error {
+	imap.updateCapabilities(r)
+	imap.lastStatus = r
+	if r.status != OK {
+		return &IMAPError{r.status, r.text, r.code}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package imap
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIdleUntilExists(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 IDLE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("IDLE")
+	s.Send("+ idling")
+	s.Send("* 2 FETCH (FLAGS (\\Seen))")
+	s.Send("* 5 EXISTS")
+	s.ExpectLine("DONE")
+	s.Send("* 6 EXISTS")
+	s.Done("OK IDLE terminated")
+
+	update, err := im.IdleUntil(context.Background(), EventExists)
+	if err != nil {
+		t.Fatalf("idle: %s", err)
+	}
+	if !reflect.DeepEqual(update, &ResponseExists{Count: 5}) {
+		t.Fatalf("unexpected update %#v", update)
+	}
+	waitFake(t, s)
+
+	// The flag change, and what came after DONE, went on as usual.
+	if update, ok := (<-im.Unsolicited).(*FlagUpdate); !ok || update.SeqNum != 2 {
+		t.Fatalf("expected the flag change, got %#v", update)
+	}
+	if exists, ok := (<-im.Unsolicited).(*ResponseExists); !ok || exists.Count != 6 {
+		t.Fatalf("expected the later EXISTS, got %#v", exists)
+	}
+}
+
+func TestIdleUntilCancel(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 IDLE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("IDLE")
+	s.Send("+ idling")
+	s.ExpectLine("DONE")
+	s.Done("OK IDLE terminated")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	update, err := im.IdleUntil(ctx, EventExists)
+	if err != context.Canceled || update != nil {
+		t.Fatalf("expected cancellation, got %#v, %v", update, err)
+	}
+	waitFake(t, s)
+}
+
+func TestIdleUntilClose(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 IDLE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("IDLE")
+	s.Send("+ idling")
+
+	if _, err := im.Capability(); err != nil {
+		t.Fatalf("capability: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := im.IdleUntil(context.Background(), EventExists)
+		done <- err
+	}()
+	waitFake(t, s)
+
+	start := time.Now()
+	if err := im.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("IDLE still running after Close")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("IDLE took %s to end", elapsed)
+	}
+	if err := im.Noop(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatalf("second close: %s", err)
+	}
+}
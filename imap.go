@@ -1,10 +1,23 @@
 package imap
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/mail"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"weak"
 )
 
 func check(err error) {
@@ -15,199 +28,1847 @@ func check(err error) {
 
 type IMAP struct {
 	// Client thread.
-	nextTag int
+	nextTag      int
+	capabilities []string // as last reported by the server
+	appendLimit  int64    // from APPENDLIMIT=n, or -1 if there is none
+	delimiter    *string  // cached by Delimiter
+	selected     string   // the mailbox last selected, if any
+	uidValidity  int      // the selected mailbox's UIDVALIDITY
+	autoEnable   []string // for ENABLE after logging in
+	enabled      []string // turned on by ENABLE
+
+	myRights map[string]string // by mailbox, cached by checkRight
 
 	Unsolicited chan interface{}
 
+	// CommandTimeout, if set, bounds how long a command sent with
+	// SendSync (or a method built on it) may take to complete.  Past
+	// it the command fails with ErrTimeout and the connection is
+	// closed, since where the session stands in the protocol is then
+	// unknown.
+	CommandTimeout time.Duration
+
+	// CheckRights makes Delete, Rename and a Store of \Deleted first
+	// look up the user's rights on the mailbox with MYRIGHTS, if the
+	// server has ACL, and fail with a *RightsError rather than send a
+	// command that is sure to be refused.  The rights are cached for
+	// the session, so each mailbox costs one round trip.
+	CheckRights bool
+
+	// KeepRaw makes FETCH responses and status responses carry the
+	// bytes they were parsed from, literals included, for logging or
+	// passing on verbatim; see ResponseFetch.Raw and
+	// ResponseStatus.Raw.  It must be set before Start.
+	KeepRaw bool
+
+	// FollowReferrals makes LoginReferred and SelectReferred follow
+	// a [REFERRAL] to another server, rather than fail with it.
+	FollowReferrals bool
+
+	// Logger, if set, gets the client's warnings, as about a client
+	// dropped without Close, or a message part FetchTextBody can't
+	// decode.  If nil they are dropped.
+	Logger *log.Logger
+
+	// redial connects to another server the way this client's
+	// connection was made, if it was made by a Dial function.
+	redial func(ctx context.Context, addr string) (*IMAP, error)
+
+	// serverName is the host dialed by a Dial function, whose
+	// certificate StartTLS checks by default.
+	serverName string
+
+	// upgradedTLS is the config StartTLS used, without its ServerName,
+	// so that servers referred to can be upgraded the same way.
+	upgradedTLS *tls.Config
+
 	// Background thread.
 	r *reader
-	w io.Writer
+	w *countingWriter
+
+	// out buffers commands on their way to w, through deflate once
+	// COMPRESS is on; see flush.
+	out     *bufio.Writer
+	deflate *flate.Writer
+
+	// Apart from the client, as the read thread counts into them.
+	bytesRead, bytesWritten *atomic.Int64
+
+	alertHandler atomic.Pointer[func(*Alert)]
 
 	pendingLock sync.Mutex
 	pendingTag  tag
 	pendingChan chan interface{}
+	err         error // set once the connection is dead
+
+	// pendingFirst is the first tag of a pipelined batch of commands
+	// ending with pendingTag, or pendingTag itself.
+	pendingFirst tag
+
+	// startInflate makes the read thread decompress what follows the
+	// OK completing the pending command, COMPRESS.
+	startInflate bool
+
+	// startTLS makes the read thread run a TLS handshake with it after
+	// the OK completing the pending command, STARTTLS.
+	startTLS *tls.Config
+
+	lastStatus *ResponseStatus
+}
+
+// SetLenientLineEndings makes the client accept lines from the server
+// that end in a bare LF rather than CRLF, as a few broken servers send.
+// It is off by default.
+func (imap *IMAP) SetLenientLineEndings(on bool) {
+	imap.r.lenient.Store(on)
+}
+
+// SetLenientFlags makes the client accept a single flag where a list
+// of them belongs, as in "FLAGS \Seen" for "FLAGS (\Seen)", which a few
+// broken servers and proxies send.  It is off by default.
+func (imap *IMAP) SetLenientFlags(on bool) {
+	imap.r.lenientFlags.Store(on)
+}
+
+// SetUnknownResponseHandler makes untagged responses the package doesn't
+// recognize go to h, or, if h is nil, be dropped as they are by default.
+// It may be called at any time.
+func (imap *IMAP) SetUnknownResponseHandler(h UnknownResponseHandler) {
+	if h == nil {
+		imap.r.unknown.Store(nil)
+		return
+	}
+	imap.r.unknown.Store(&h)
 }
 
+// ErrAppendTooBig is returned by Append and the like for a message
+// larger than the server's APPENDLIMIT, without sending it.
+var ErrAppendTooBig = errors.New("imap: message exceeds the server's APPENDLIMIT")
+
+// ErrEmptySequence is returned by Fetch and the like for an empty
+// sequence set, as from a SearchSeqSet that matched nothing, which
+// FETCH can't take.
+var ErrEmptySequence = errors.New("imap: empty sequence set")
+
+// ErrTimeout is the error of a command that ran past CommandTimeout,
+// and of every command after it.
+var ErrTimeout = errors.New("imap: command timed out")
+
 func New(r io.Reader, w io.Writer) *IMAP {
-	return &IMAP{
-		r: &reader{newParser(r)},
-		w: w,
+	imap := &IMAP{appendLimit: -1, bytesRead: new(atomic.Int64), bytesWritten: new(atomic.Int64)}
+	imap.r = &reader{parser: newParser(&countingReader{r, imap.bytesRead})}
+	imap.w = &countingWriter{w, imap.bytesWritten}
+	imap.out = bufio.NewWriter(imap.w)
+	if _, ok := w.(io.Closer); ok {
+		runtime.SetFinalizer(imap, (*IMAP).finalize)
+	}
+	return imap
+}
+
+// finalize closes the connection of a client that was dropped while
+// it was still open.  It is only a safety net: the server is never
+// logged out of, and until the garbage collector gets around to it the
+// connection stays open.
+func (imap *IMAP) finalize() {
+	if imap.dead() == nil {
+		imap.logf("imap: client dropped without Close; closing its connection")
+	}
+	imap.close()
+}
+
+// logf logs a warning to imap.Logger, if set.
+func (imap *IMAP) logf(format string, args ...interface{}) {
+	if imap.Logger != nil {
+		imap.Logger.Printf(format, args...)
+	}
+}
+
+// write sends s and flushes it.
+func (imap *IMAP) write(s string) error {
+	if _, err := io.WriteString(imap.out, s); err != nil {
+		return err
+	}
+	return imap.flush()
+}
+
+// flush commits what has been written to the connection: the buffered
+// bytes, then, under COMPRESS, what the compressor holds back.  Every
+// command write ends with it, as a server waiting on bytes left in
+// either buffer never answers.
+func (imap *IMAP) flush() error {
+	if err := imap.out.Flush(); err != nil {
+		return err
+	}
+	if imap.deflate != nil {
+		return imap.deflate.Flush()
+	}
+	return nil
+}
+
+// countingReader and countingWriter sit below any buffering and count
+// every byte passing through, literals included.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the server so far.
+// It may be called from any goroutine.
+func (imap *IMAP) BytesRead() int64 {
+	return imap.bytesRead.Load()
+}
+
+// BytesWritten returns the number of bytes written to the server so
+// far.  It may be called from any goroutine.
+func (imap *IMAP) BytesWritten() int64 {
+	return imap.bytesWritten.Load()
+}
+
+func (imap *IMAP) Start() (string, error) {
+	if imap.KeepRaw {
+		imap.r.keepRaw()
+	}
+	tag, r, err := imap.r.readResponse()
+	if err != nil {
+		return "", err
+	}
+	if tag != untagged {
+		return "", fmt.Errorf("expected untagged server hello. got %q", tag)
+	}
+	resp := r.(*ResponseStatus)
+	if resp.status != OK {
+		return "", &IMAPError{resp.status, resp.text, resp.code}
+	}
+	imap.updateCapabilities(resp)
+
+	client, src := weak.Make(imap), imap.r
+	go func() {
+		err := readLoop(client, src)
+		if imap := client.Value(); imap != nil {
+			imap.shutdown(err)
+		}
+	}()
+
+	return resp.text, nil
+}
+
+func (imap *IMAP) Send(ch chan interface{}, format string, args ...interface{}) error {
+	tag, err := imap.begin(ch)
+	if err != nil {
+		return err
+	}
+	return imap.write(fmt.Sprintf("%s %s\r\n", tag, fmt.Sprintf(format, args...)))
+}
+
+// begin allocates the tag for a new command, making ch (if not nil)
+// the channel its responses are delivered to.
+func (imap *IMAP) begin(ch chan interface{}) (tag, error) {
+	tag := tag(imap.nextTag)
+	imap.nextTag++
+
+	imap.pendingLock.Lock()
+	defer imap.pendingLock.Unlock()
+	if imap.err != nil {
+		return tag, imap.err
+	}
+	if ch != nil {
+		imap.pendingFirst = tag
+		imap.pendingTag = tag
+		imap.pendingChan = ch
+	}
+	return tag, nil
+}
+
+// beginBatch allocates the tags for n commands to be pipelined,
+// returning the first, and makes ch the channel their responses,
+// including the completion of each, are delivered to.
+func (imap *IMAP) beginBatch(ch chan interface{}, n int) (tag, error) {
+	first := tag(imap.nextTag)
+	imap.nextTag += n
+
+	imap.pendingLock.Lock()
+	defer imap.pendingLock.Unlock()
+	if imap.err != nil {
+		return first, imap.err
+	}
+	imap.pendingFirst = first
+	imap.pendingTag = first + tag(n-1)
+	imap.pendingChan = ch
+	return first, nil
+}
+
+func (imap *IMAP) SendSync(format string, args ...interface{}) (*ResponseStatus, error) {
+	return imap.sendSync(fmt.Sprintf(format, args...))
+}
+
+// A literal is a command argument sent as a synchronizing literal.
+type literal []byte
+
+// A literalReader is a literal streamed from r, which must yield n
+// bytes.
+type literalReader struct {
+	r io.Reader
+	n int64
+}
+
+// sendSync sends a command made of parts, which are either strings
+// sent as they are or literals (literal or literalReader), and waits for
+// it to complete.
+func (imap *IMAP) sendSync(parts ...interface{}) (*ResponseStatus, error) {
+	ch := make(chan interface{}, 1)
+	tag, err := imap.begin(ch)
+	if err != nil {
+		return nil, err
+	}
+	if imap.CommandTimeout > 0 {
+		timer := time.AfterFunc(imap.CommandTimeout, func() {
+			imap.timeout(tag)
+		})
+		defer timer.Stop()
+	}
+
+	var response *ResponseStatus
+	extra := make([]interface{}, 0)
+
+	line := tag.String() + " "
+Parts:
+	for _, part := range parts {
+		if lit, ok := part.(literal); ok {
+			part = literalReader{bytes.NewReader(lit), int64(len(lit))}
+		}
+		switch part := part.(type) {
+		case string:
+			line += part
+		case literalReader:
+			err = imap.write(fmt.Sprintf("%s{%d}\r\n", line, part.n))
+			if err != nil {
+				imap.abort(err)
+				return nil, err
+			}
+			response, err = imap.writeLiteralSync(ch, part, &extra)
+			if err != nil {
+				return nil, err
+			}
+			if response != nil {
+				// The server completed the command early.
+				break Parts
+			}
+			line = ""
+		default:
+			panic(fmt.Sprintf("bad command part %#v", part))
+		}
+	}
+	if response == nil {
+		if err = imap.write(line + "\r\n"); err != nil {
+			// The command may have been cut off anywhere.
+			imap.abort(err)
+			return nil, err
+		}
+	L:
+		for {
+			r := <-ch
+			switch r := r.(type) {
+			case *ResponseStatus:
+				if !r.tagged {
+					extra = append(extra, r)
+					continue
+				}
+				response = r
+				break L
+			case error:
+				return nil, r
+			default:
+				extra = append(extra, r)
+			}
+		}
+	}
+
+	for _, r := range extra {
+		imap.updateCapabilities(r)
+	}
+	imap.updateCapabilities(response)
+	if len(extra) > 0 {
+		response.extra = extra
+	}
+	imap.lastStatus = response
+	// XXX callers discard unsolicited responses if this is not OK
+	if response.status != OK {
+		return response, &IMAPError{response.status, response.text, response.code}
+	}
+	return response, nil
+}
+
+// LastStatus returns the tagged completion of the most recent command
+// sent with SendSync or any of the methods built on it, whether it
+// succeeded or not.  Its code and text often carry information, such
+// as "[READ-WRITE]" on the completion of SELECT.
+func (imap *IMAP) LastStatus() *ResponseStatus {
+	return imap.lastStatus
+}
+
+// writeLiteralSync sends data as a synchronizing literal.  The caller
+// has already announced it with "{n}\r\n"; this waits for the server's
+// continuation request on ch before writing data.  Responses arriving
+// meanwhile are added to extra.  If the server instead completes the
+// command (say, rejecting it with NO), the data is not sent and the
+// completion is returned.
+//
+// If data's reader runs out early, the server is left waiting for the
+// rest of the literal, so the connection is abandoned.
+func (imap *IMAP) writeLiteralSync(ch chan interface{}, data literalReader, extra *[]interface{}) (*ResponseStatus, error) {
+	for {
+		r := <-ch
+		switch r := r.(type) {
+		case *ResponseContinuation:
+			// The line after the literal flushes it.
+			n, err := io.CopyN(imap.out, data.r, data.n)
+			if n < data.n {
+				if err == io.EOF {
+					err = fmt.Errorf("imap: literal ended after %d of %d bytes", n, data.n)
+				}
+				imap.abort(err)
+			}
+			return nil, err
+		case *ResponseStatus:
+			if r.tagged {
+				return r, nil
+			}
+			*extra = append(*extra, r)
+		case error:
+			return nil, r
+		default:
+			*extra = append(*extra, r)
+		}
+	}
+}
+
+// Noop sends a NOOP, giving the server a chance to report mailbox
+// updates.  They arrive on the Unsolicited channel.
+func (imap *IMAP) Noop() error {
+	_, err := imap.Poll()
+	return err
+}
+
+// MailboxUpdates are the changes to the selected mailbox the server
+// reported during a command.
+type MailboxUpdates struct {
+	Exists   *int             // the new message count, if reported
+	Expunged []int            // message numbers, in the order sent
+	Fetches  []*ResponseFetch // typically flag changes
+}
+
+// Poll is Noop, returning the updates it brought as well as sending
+// them to the Unsolicited channel, for clients that check for new mail
+// this way rather than with IDLE.
+func (imap *IMAP) Poll() (*MailboxUpdates, error) {
+	resp, err := imap.SendSync("NOOP")
+	if err != nil {
+		return nil, err
+	}
+	updates := &MailboxUpdates{}
+	for _, extra := range resp.extra {
+		switch extra := extra.(type) {
+		case *ResponseExists:
+			count := extra.Count
+			updates.Exists = &count
+		case *ResponseExpunge:
+			updates.Expunged = append(updates.Expunged, extra.Msg)
+		case *ResponseFetch:
+			updates.Fetches = append(updates.Fetches, extra)
+		}
+		imap.unsolicited(extra)
+	}
+	return updates, nil
+}
+
+// Auth logs in with LOGIN, and returns the server's text and the
+// capabilities it sent with its answer, if any.  Credentials that can't
+// be sent as atoms or quoted strings, such as ones containing '"' or
+// non-ASCII text, are sent as literals.
+func (imap *IMAP) Auth(user string, pass string) (string, []string, error) {
+	// Logging in may change the capabilities, so any the server sends
+	// along with its answer replace the old ones.
+	imap.capabilities = nil
+	resp, err := imap.sendSync("LOGIN ", astring(user), " ", astring(pass))
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, extra := range resp.extra {
+		if _, ok := extra.(*ResponseCapabilities); !ok {
+			imap.unsolicited(extra)
+		}
+	}
+	if err := imap.enableAuto(); err != nil {
+		return resp.text, imap.capabilities, err
+	}
+	return resp.text, imap.capabilities, nil
+}
+
+// SetAutoEnable makes a successful login go on to ENABLE those of caps
+// (e.g. "CONDSTORE", "QRESYNC") that the server has, ignoring the rest.
+func (imap *IMAP) SetAutoEnable(caps ...string) {
+	imap.autoEnable = caps
+}
+
+// enableAuto enables the capabilities asked for with SetAutoEnable.
+func (imap *IMAP) enableAuto() error {
+	if len(imap.autoEnable) == 0 {
+		return nil
+	}
+	ok, err := imap.supports("ENABLE")
+	if err != nil || !ok {
+		return err
+	}
+	var caps []string
+	for _, c := range imap.autoEnable {
+		if imap.HasCapability(c) {
+			caps = append(caps, c)
+		}
+	}
+	if len(caps) == 0 {
+		return nil
+	}
+	if _, err := imap.Enable(caps...); err != nil {
+		return fmt.Errorf("imap: logged in, but ENABLE failed: %w", err)
+	}
+	return nil
+}
+
+// Unauthenticate ends the session's login with UNAUTHENTICATE (RFC
+// 8437), returning the connection to the not authenticated state so
+// that another user can log in on it.  It needs the UNAUTHENTICATE
+// capability.  Everything remembered about the old session, including
+// the capabilities, is forgotten.
+func (imap *IMAP) Unauthenticate() error {
+	if err := imap.require("UNAUTHENTICATE"); err != nil {
+		return err
+	}
+	// Cleared first, so that any capabilities sent with the answer
+	// are kept.
+	imap.capabilities = nil
+	imap.delimiter = nil
+	imap.enabled = nil
+	resp, err := imap.SendSync("UNAUTHENTICATE")
+	if err != nil {
+		return err
+	}
+	for _, extra := range resp.extra {
+		imap.unsolicited(extra)
+	}
+	imap.lastStatus = nil
+	return nil
+}
+
+// Capabilities returns the server's capabilities as last reported,
+// only asking for them if none have been.  See RefreshCapabilities.
+func (imap *IMAP) Capabilities() ([]string, error) {
+	if imap.capabilities == nil {
+		return imap.Capability()
+	}
+	return append([]string(nil), imap.capabilities...), nil
+}
+
+// RefreshCapabilities is Capability: it always asks the server, as
+// after a feature is turned on at the server, and replaces the cached
+// capabilities and what is worked out from them, such as whether LOGIN
+// is disabled and the APPENDLIMIT.
+func (imap *IMAP) RefreshCapabilities() ([]string, error) {
+	return imap.Capability()
+}
+
+// Capability asks the server for its capabilities, and remembers them
+// for HasCapability.
+func (imap *IMAP) Capability() ([]string, error) {
+	resp, err := imap.SendSync("CAPABILITY")
+	if err != nil {
+		return nil, err
+	}
+
+	caps := make([]string, 0)
+	for _, extra := range resp.extra {
+		switch extra := extra.(type) {
+		case *ResponseCapabilities:
+			caps = extra.Capabilities
+		default:
+			imap.unsolicited(extra)
+		}
+	}
+	imap.applyCapabilities(caps)
+	return caps, nil
+}
+
+// Enable turns on the extensions caps with ENABLE (RFC 5161), and
+// returns the ones the server turned on.  ENABLE is best effort: a
+// server supporting none of them may send an empty ENABLED response or
+// none at all, and the result is then empty, not an error.  Once
+// UTF8=ACCEPT is on, mailbox names are no longer sent in modified
+// UTF-7.  It needs the ENABLE capability.  With no caps nothing is
+// sent.
+func (imap *IMAP) Enable(caps ...string) ([]string, error) {
+	if len(caps) == 0 {
+		// "ENABLE" needs at least one.
+		return []string{}, nil
+	}
+	if err := imap.require("ENABLE"); err != nil {
+		return nil, err
+	}
+	resp, err := imap.SendSync("ENABLE %s", strings.Join(caps, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := make([]string, 0)
+	for _, extra := range resp.extra {
+		if e, ok := extra.(*ResponseEnabled); ok {
+			enabled = append(enabled, e.Capabilities...)
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	for _, c := range enabled {
+		if strings.EqualFold(c, "UTF8=ACCEPT") {
+			imap.r.utf8.Store(true)
+		}
+		if !imap.IsEnabled(c) {
+			imap.enabled = append(imap.enabled, c)
+		}
+	}
+	return enabled, nil
+}
+
+// IsEnabled reports whether capability has been turned on for the
+// session with ENABLE, by Enable or SetAutoEnable.
+func (imap *IMAP) IsEnabled(capability string) bool {
+	for _, c := range imap.enabled {
+		if strings.EqualFold(c, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCapability reports whether the server last advertised capability
+// (e.g. "IDLE"), compared case-insensitively.
+func (imap *IMAP) HasCapability(capability string) bool {
+	for _, c := range imap.capabilities {
+		if strings.EqualFold(c, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// CapabilityError is returned when a command needs a capability the
+// server doesn't have.
+type CapabilityError struct {
+	Capability string
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("imap: server lacks the %s capability", e.Capability)
+}
+
+// supports reports whether the server has capability, asking for the
+// capability list if it hasn't been seen yet.
+func (imap *IMAP) supports(capability string) (bool, error) {
+	if imap.capabilities == nil {
+		if _, err := imap.Capability(); err != nil {
+			return false, err
+		}
+	}
+	return imap.HasCapability(capability), nil
+}
+
+// require fails unless the server has capability.
+func (imap *IMAP) require(capability string) error {
+	ok, err := imap.supports(capability)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &CapabilityError{capability}
+	}
+	return nil
+}
+
+func quote(in string) string {
+	if strings.IndexAny(in, "\r\n") >= 0 {
+		panic("invalid characters in string to quote")
+	}
+	return "\"" + in + "\""
+}
+
+// astring returns s as a command part: an atom if it is one, otherwise
+// a quoted string, or a literal if it has characters a quoted string
+// can't carry.
+func astring(s string) interface{} {
+	switch {
+	case !quotable(s):
+		return literal(s)
+	case s != "" && strings.IndexAny(s, "(){ %*]") < 0:
+		return s
+	}
+	return quote(s)
+}
+
+// quotable reports whether s can go as a quoted string.
+func quotable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			// Escapes inside quoted strings are poorly supported by
+			// servers, so these go as literals too.
+			return false
+		}
+	}
+	return true
+}
+
+func (imap *IMAP) List(reference string, name string) ([]*ResponseList, error) {
+	return imap.list("LIST ", imap.mailbox(reference), " ", imap.mailbox(name))
+}
+
+// ListExtended lists mailboxes with the RFC 5258 selection options
+// (e.g. "SUBSCRIBED", "RECURSIVEMATCH") and return options (e.g.
+// "CHILDREN", "SUBSCRIBED"), either of which may be empty.  It needs
+// the LIST-EXTENDED capability.
+func (imap *IMAP) ListExtended(reference string, name string, selection []string, ret []string) ([]*ResponseList, error) {
+	if err := imap.require("LIST-EXTENDED"); err != nil {
+		return nil, err
+	}
+	cmd := "LIST "
+	if len(selection) > 0 {
+		cmd += "(" + strings.Join(selection, " ") + ") "
+	}
+	parts := []interface{}{cmd, imap.mailbox(reference), " ", imap.mailbox(name)}
+	if len(ret) > 0 {
+		parts = append(parts, " RETURN ("+strings.Join(ret, " ")+")")
+	}
+	return imap.list(parts...)
+}
+
+// MailboxInfoWithStatus is a mailbox listed by ListStatus.
+type MailboxInfoWithStatus struct {
+	*ResponseList
+	Status *MailboxStatus // nil if the mailbox can't be selected, or no items are left to ask for
+}
+
+// ListStatus lists mailboxes along with the status items (e.g.
+// "MESSAGES", "UNSEEN") of each, as for a folder pane.  With the
+// LIST-STATUS capability (RFC 5819) this takes a single command;
+// otherwise each selectable mailbox is asked for its status in turn.
+func (imap *IMAP) ListStatus(reference string, name string, items []string) ([]*MailboxInfoWithStatus, error) {
+	items, err := imap.statusItems(items)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		// "STATUS ()" is a syntax error, so just list.
+		lists, err := imap.List(reference, name)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]*MailboxInfoWithStatus, len(lists))
+		for i, list := range lists {
+			infos[i] = &MailboxInfoWithStatus{ResponseList: list}
+		}
+		return infos, nil
+	}
+	ok, err := imap.supports("LIST-STATUS")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return imap.listThenStatus(reference, name, items)
+	}
+
+	resp, err := imap.sendSync("LIST ", imap.mailbox(reference), " ", imap.mailbox(name),
+		" RETURN (STATUS ("+strings.Join(items, " ")+"))")
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*MailboxInfoWithStatus
+	var lists []*ResponseList
+	for _, extra := range resp.extra {
+		switch extra := extra.(type) {
+		case *ResponseList:
+			infos = append(infos, &MailboxInfoWithStatus{ResponseList: extra})
+			lists = append(lists, extra)
+		case *MailboxStatus:
+			// A STATUS follows the LIST of its mailbox, so look
+			// back from the latest.
+			i := len(infos) - 1
+			for i >= 0 && !sameMailbox(infos[i].Name, extra.Mailbox) {
+				i--
+			}
+			if i < 0 {
+				imap.unsolicited(extra)
+				break
+			}
+			infos[i].Status = extra
+		default:
+			imap.unsolicited(extra)
+		}
+	}
+	imap.checkDelimiters(lists)
+	return infos, nil
+}
+
+// listThenStatus is ListStatus for servers without LIST-STATUS.
+func (imap *IMAP) listThenStatus(reference string, name string, items []string) ([]*MailboxInfoWithStatus, error) {
+	lists, err := imap.List(reference, name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*MailboxInfoWithStatus, len(lists))
+	for i, list := range lists {
+		infos[i] = &MailboxInfoWithStatus{ResponseList: list}
+		if list.Selectable != nil && !*list.Selectable {
+			continue
+		}
+		status, err := imap.Status(list.Name, items)
+		if _, ok := err.(*IMAPError); ok {
+			// The mailbox went away, or can't be examined after all.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos[i].Status = status
+	}
+	return infos, nil
+}
+
+// Delimiter returns the server's hierarchy delimiter (e.g. "/"), or ""
+// for a flat namespace.  The answer is cached after the first call, or
+// taken from an earlier listing.
+func (imap *IMAP) Delimiter() (string, error) {
+	if imap.delimiter != nil {
+		return *imap.delimiter, nil
+	}
+	lists, err := imap.List("", "")
+	if err != nil {
+		return "", err
+	}
+	if len(lists) == 0 {
+		return "", errors.New("imap: no LIST response for the hierarchy delimiter")
+	}
+	delim := lists[0].Delim
+	imap.delimiter = &delim
+	return delim, nil
+}
+
+// DelimiterMismatch is sent to the Unsolicited channel when a LIST
+// reports a mailbox with a different hierarchy delimiter from the one
+// the server gave before.  RFC 3501 allows it, but it is rare enough
+// that it usually points to a confused server, and code building a
+// folder tree from one delimiter will get it wrong.
+type DelimiterMismatch struct {
+	Mailbox  string
+	Delim    string // the mailbox's
+	Expected string // from earlier responses, or Delimiter
+}
+
+// checkDelimiters compares the delimiters in lists, leaving out NIL
+// (a mailbox with no hierarchy), with each other and with any cached
+// by Delimiter, caching the first if none was.
+func (imap *IMAP) checkDelimiters(lists []*ResponseList) {
+	for _, list := range lists {
+		if list.Delim == "" {
+			continue
+		}
+		if imap.delimiter == nil {
+			delim := list.Delim
+			imap.delimiter = &delim
+			continue
+		}
+		if list.Delim != *imap.delimiter {
+			imap.unsolicited(&DelimiterMismatch{list.Name, list.Delim, *imap.delimiter})
+		}
+	}
+}
+
+func (imap *IMAP) list(parts ...interface{}) ([]*ResponseList, error) {
+	/* Responses:  untagged responses: LIST */
+	response, err := imap.sendSync(parts...)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := make([]*ResponseList, 0)
+	for _, extra := range response.extra {
+		if list, ok := extra.(*ResponseList); ok {
+			lists = append(lists, list)
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	imap.checkDelimiters(lists)
+
+	return lists, nil
+}
+
+// ResponseExamine contains the response to examining a mailbox.
+type ResponseExamine struct {
+	Flags          []string
+	Exists         int
+	Recent         int // advisory: zero if the server doesn't report it
+	PermanentFlags []string
+	UIDValidity    int
+	UIDNext        int
+	Unseen         int // the first unseen message, if reported
+
+	// ReadOnly is set if the mailbox can't be changed: from the
+	// completion's READ-ONLY or READ-WRITE code, which is what counts
+	// (a SELECT may be granted only read access), or failing that from
+	// whether it was EXAMINE.
+	ReadOnly bool
+
+	// PermanentFlagsAllowCustom is set if new keywords can be stored.
+	PermanentFlagsAllowCustom bool
+
+	// HighestModSeq is the mailbox's highest mod-sequence, if the
+	// server tracks them (CONDSTORE).
+	HighestModSeq uint64
+
+	// UIDNotSticky is set if the mailbox's UIDs don't persist across
+	// sessions (UIDPLUS), as in some virtual mailboxes, so caching
+	// messages by UID isn't safe there.
+	UIDNotSticky bool
+}
+
+// Select selects mailbox for reading and writing.
+func (imap *IMAP) Select(mailbox string) (*ResponseExamine, error) {
+	return imap.examine("SELECT", mailbox, "")
+}
+
+func (imap *IMAP) Examine(mailbox string) (*ResponseExamine, error) {
+	return imap.examine("EXAMINE", mailbox, "")
+}
+
+// SelectCondstore selects mailbox with the CONDSTORE parameter (RFC
+// 7162), which turns on mod-sequences for it alone, without ENABLE.
+// The result's HighestModSeq is set.  It needs the CONDSTORE
+// capability.
+func (imap *IMAP) SelectCondstore(mailbox string) (*ResponseExamine, error) {
+	if err := imap.require("CONDSTORE"); err != nil {
+		return nil, err
+	}
+	return imap.examine("SELECT", mailbox, " (CONDSTORE)")
+}
+
+// examine sends a SELECT or EXAMINE of mailbox, with the parameters in
+// params if any, and collects the mailbox data.
+func (imap *IMAP) examine(command, mailbox, params string) (*ResponseExamine, error) {
+	/*
+	 Responses:  REQUIRED untagged responses: FLAGS, EXISTS, RECENT
+	 REQUIRED OK untagged responses:  UNSEEN,  PERMANENTFLAGS,
+	 UIDNEXT, UIDVALIDITY
+
+	 RECENT is no longer sent by IMAP4rev2 servers, and some others
+	 always report 0; like the rest, it is left zero if missing.
+	*/
+	// Even a failed SELECT leaves no mailbox selected.
+	imap.selected = ""
+	resp, err := imap.sendSync(command+" ", imap.mailbox(mailbox), params)
+	if err != nil {
+		return nil, err
+	}
+	imap.selected = mailbox
+	imap.uidValidity = 0
+
+	r := &ResponseExamine{ReadOnly: command == "EXAMINE"}
+	switch resp.code {
+	case "READ-ONLY":
+		r.ReadOnly = true
+	case "READ-WRITE":
+		r.ReadOnly = false
+	}
+
+	for _, extra := range resp.extra {
+		switch extra := extra.(type) {
+		case (*ResponseFlags):
+			r.Flags = extra.Flags
+		case (*ResponseExists):
+			r.Exists = extra.Count
+		case (*ResponseRecent):
+			r.Recent = extra.Count
+		case (*ResponseUnseen):
+			r.Unseen = extra.Value
+		case (*ResponsePermanentFlags):
+			r.PermanentFlags = extra.Flags
+			r.PermanentFlagsAllowCustom = extra.AllowCustom
+		case (*ResponseUIDNext):
+			value := extra.Value
+			r.UIDNext = value
+		case (*ResponseUIDValidity):
+			value := extra.Value
+			r.UIDValidity = value
+			imap.uidValidity = value
+		case (*ResponseHighestModSeq):
+			r.HighestModSeq = extra.Value
+		case (*ResponseUIDNotSticky):
+			r.UIDNotSticky = true
+		default:
+			imap.unsolicited(extra)
+		}
+	}
+	return r, nil
+}
+
+// Create creates a mailbox.
+func (imap *IMAP) Create(mailbox string) error {
+	resp, err := imap.sendSync("CREATE ", imap.mailbox(mailbox))
+	if err != nil {
+		return err
+	}
+	for _, extra := range resp.extra {
+		imap.unsolicited(extra)
+	}
+	return nil
+}
+
+// Delete deletes mailbox.
+func (imap *IMAP) Delete(mailbox string) error {
+	if err := imap.checkRight(mailbox, 'x', "delete it"); err != nil {
+		return err
+	}
+	delete(imap.myRights, mailbox)
+	return imap.simple("DELETE ", imap.mailbox(mailbox))
+}
+
+// Rename renames mailbox to newName.
+func (imap *IMAP) Rename(mailbox, newName string) error {
+	if err := imap.checkRight(mailbox, 'x', "rename it"); err != nil {
+		return err
+	}
+	delete(imap.myRights, mailbox)
+	return imap.simple("RENAME ", imap.mailbox(mailbox), " ", imap.mailbox(newName))
+}
+
+// Store changes the flags of the messages in sequence.  item is
+// "FLAGS", "+FLAGS" or "-FLAGS", optionally with ".SILENT"; the
+// resulting FETCH responses go to the Unsolicited channel.
+func (imap *IMAP) Store(sequence, item string, flags []string) error {
+	return imap.store("STORE", sequence, item, flags)
+}
+
+// UIDStore is like Store, but with the messages given by UID.
+func (imap *IMAP) UIDStore(uids, item string, flags []string) error {
+	return imap.store("UID STORE", uids, item, flags)
+}
+
+func (imap *IMAP) store(command, sequence, item string, flags []string) error {
+	if FlagSet(flags).Has(`\Deleted`) && imap.selected != "" {
+		if err := imap.checkRight(imap.selected, 't', `set or clear \Deleted`); err != nil {
+			return err
+		}
+	}
+	return imap.simple(fmt.Sprintf("%s %s %s (%s)", command, sequence, item, strings.Join(flags, " ")))
+}
+
+// Append adds msg to the end of mailbox, with flags (which may be
+// empty) set.  A server may refuse a message before it is sent, in which
+// case the returned *IMAPError carries a code such as "TOOBIG".
+func (imap *IMAP) Append(mailbox string, flags []string, msg []byte) error {
+	return imap.AppendReader(mailbox, flags, time.Time{}, int64(len(msg)), bytes.NewReader(msg))
+}
+
+// AppendOrCreate is like Append, but if the server says mailbox must
+// be created first ("NO [TRYCREATE]"), as a Sent folder may need to
+// be, it creates mailbox and sends the message once more.
+func (imap *IMAP) AppendOrCreate(mailbox string, flags []string, msg []byte) error {
+	err := imap.Append(mailbox, flags, msg)
+	if e, ok := err.(*IMAPError); ok && e.Code == "TRYCREATE" {
+		if err := imap.Create(mailbox); err != nil {
+			return err
+		}
+		err = imap.Append(mailbox, flags, msg)
+	}
+	return err
+}
+
+// AppendAndFindUID is like Append, but returns the UID given to the
+// message.  With UIDPLUS the server reports it; otherwise it is looked
+// up by searching mailbox for msg's Message-ID, and the newest match
+// is taken.  That needs mailbox to be selected already; if it isn't,
+// the message is appended but the result comes with an error saying
+// so.  Once APPEND has succeeded a result is always returned, with any
+// error from the search.  Its UIDValidity is zero if the UID couldn't
+// be found, as when msg has no Message-ID.
+func (imap *IMAP) AppendAndFindUID(mailbox string, flags []string, msg []byte) (*AppendResult, error) {
+	r, err := imap.appendMessage("APPEND", mailbox, flags, time.Time{}, literalReader{bytes.NewReader(msg), int64(len(msg))})
+	if err != nil || r.UIDValidity != 0 {
+		return r, err
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return r, nil
+	}
+	id := m.Header.Get("Message-Id")
+	if id == "" {
+		return r, nil
+	}
+	if imap.selected == "" || !sameMailbox(imap.selected, mailbox) {
+		return r, fmt.Errorf("imap: select %s to find the UID of a message appended to it", mailbox)
+	}
+	resp, err := imap.sendSync("UID SEARCH HEADER Message-ID ", astring(id))
+	if err != nil {
+		return r, err
+	}
+	for _, extra := range resp.extra {
+		if s, ok := extra.(*ResponseSearch); ok {
+			for _, uid := range s.Nums {
+				if uid > r.UID {
+					r.UID = uid
+				}
+			}
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	if r.UID != 0 {
+		r.UIDValidity = imap.uidValidity
+	}
+	return r, nil
+}
+
+// AppendReader is like Append, but streams the message from r instead
+// of holding it in memory.  Literals are sent with their length first,
+// so the size must be known in advance; if r yields fewer bytes the
+// connection is unusable, and is closed.  The message's internal date
+// is set to date unless it is zero.
+func (imap *IMAP) AppendReader(mailbox string, flags []string, date time.Time, size int64, r io.Reader) error {
+	_, err := imap.appendMessage("APPEND", mailbox, flags, date, literalReader{r, size})
+	return err
+}
+
+// AppendContext is like AppendReader, but gives up if ctx is done.
+// Once the message's length has been announced the server counts on
+// that many bytes, and a literal cut short leaves the session beyond
+// repair, so if ctx is done while the message is being sent the
+// connection is closed, failing any later commands too.  A Read of r
+// already under way is waited for.  If ctx is done before the upload
+// starts, nothing is sent and the connection carries on.
+func (imap *IMAP) AppendContext(ctx context.Context, mailbox string, flags []string, date time.Time, size int64, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := imap.appendMessage("APPEND", mailbox, flags, date, literalReader{&ctxReader{ctx, r}, size})
+	return err
+}
+
+// ctxReader is a reader that fails once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("imap: literal cut off, closing the connection: %w", err)
+	}
+	return c.r.Read(p)
+}
+
+// AppendResult contains the UID assigned to an appended message.  It
+// is only known when the server supports UIDPLUS (but see
+// AppendAndFindUID); otherwise UIDValidity is zero.
+type AppendResult struct {
+	UIDValidity int
+	UID         int
+}
+
+// appendMessage sends command (APPEND, or REPLACE with its message
+// number) with the arguments shared by both.
+func (imap *IMAP) appendMessage(command, mailbox string, flags []string, date time.Time, msg literalReader) (*AppendResult, error) {
+	if imap.capabilities != nil && imap.appendLimit >= 0 && msg.n > imap.appendLimit {
+		return nil, ErrAppendTooBig
+	}
+	cmd := " "
+	if len(flags) > 0 {
+		cmd += "(" + strings.Join(flags, " ") + ") "
+	}
+	if !date.IsZero() {
+		cmd += quote(date.Format(DateTimeLayout)) + " "
+	}
+	resp, err := imap.sendSync(command+" ", imap.mailbox(mailbox), cmd, msg)
+	if resp == nil {
+		return nil, err
+	}
+
+	r := &AppendResult{}
+	setUID := func(uids *ResponseAppendUID) {
+		// One message gets one UID; anything else is no use.
+		if uid, ok := parseNzNumber(uids.UIDs); ok {
+			r.UIDValidity = uids.UIDValidity
+			r.UID = int(uid)
+		}
+	}
+	// Keep any [ALERT] sent along with a refusal.
+	for _, extra := range resp.extra {
+		if uids, ok := extra.(*ResponseAppendUID); ok {
+			// REPLACE sends it untagged.
+			setUID(uids)
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	if uids, ok := resp.code.(*ResponseAppendUID); ok {
+		setUID(uids)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Replace atomically replaces message msg with a new message in
+// mailbox (which may be the selected one), as for editing a draft.
+// The old message's expunge arrives on the Unsolicited channel.
+//
+// Without the REPLACE capability (RFC 8508), it falls back to
+// appending the new message, then marking the old one \Deleted and
+// expunging, which also expunges any other message already marked
+// \Deleted.
+func (imap *IMAP) Replace(msg uint32, mailbox string, flags []string, date time.Time, body []byte) (*AppendResult, error) {
+	return imap.replace("", msg, mailbox, flags, date, body)
+}
+
+// UIDReplace is like Replace, but with the old message given by UID.
+// Its fallback only expunges that message if the server has UIDPLUS.
+func (imap *IMAP) UIDReplace(uid uint32, mailbox string, flags []string, date time.Time, body []byte) (*AppendResult, error) {
+	return imap.replace("UID ", uid, mailbox, flags, date, body)
+}
+
+func (imap *IMAP) replace(uid string, msg uint32, mailbox string, flags []string, date time.Time, body []byte) (*AppendResult, error) {
+	ok, err := imap.supports("REPLACE")
+	if err != nil {
+		return nil, err
+	}
+	data := literalReader{bytes.NewReader(body), int64(len(body))}
+	if ok {
+		return imap.appendMessage(fmt.Sprintf("%sREPLACE %d", uid, msg), mailbox, flags, date, data)
+	}
+
+	r, err := imap.appendMessage("APPEND", mailbox, flags, date, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := imap.simple(fmt.Sprintf(`%sSTORE %d +FLAGS.SILENT (\Deleted)`, uid, msg)); err != nil {
+		return nil, err
+	}
+	if uid != "" {
+		ok, err := imap.supports("UIDPLUS")
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			expunged, err := imap.UIDExpunge(strconv.FormatUint(uint64(msg), 10))
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range expunged {
+				imap.unsolicited(&ResponseExpunge{int(n)})
+			}
+			return r, nil
+		}
+	}
+	if err := imap.simple("EXPUNGE"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// UIDExpunge expunges the messages marked \Deleted whose UIDs are in
+// uids, leaving other deleted messages alone, and returns the sequence
+// numbers reported expunged, in the order the server sent them.  It
+// needs the UIDPLUS capability.
+func (imap *IMAP) UIDExpunge(uids string) ([]uint32, error) {
+	if err := imap.require("UIDPLUS"); err != nil {
+		return nil, err
+	}
+	resp, err := imap.SendSync("UID EXPUNGE %s", uids)
+	if err != nil {
+		return nil, err
+	}
+
+	var expunged []uint32
+	for _, extra := range resp.extra {
+		if e, ok := extra.(*ResponseExpunge); ok {
+			expunged = append(expunged, uint32(e.Msg))
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	return expunged, nil
+}
+
+// simple sends command, passing on any responses to it.
+func (imap *IMAP) simple(parts ...interface{}) error {
+	resp, err := imap.sendSync(parts...)
+	if err != nil {
+		return err
+	}
+	for _, extra := range resp.extra {
+		imap.unsolicited(extra)
+	}
+	return nil
+}
+
+// CopyResult contains the UIDs assigned to copied messages.  They are
+// only known when the server supports UIDPLUS; otherwise UIDValidity
+// is zero.
+type CopyResult struct {
+	UIDValidity int
+	Source      string
+	Dest        string
+}
+
+// Copy copies the messages in sequence to the end of mailbox.
+func (imap *IMAP) Copy(sequence string, mailbox string) (*CopyResult, error) {
+	resp, err := imap.sendSync("COPY "+sequence+" ", imap.mailbox(mailbox))
+	if err != nil {
+		return nil, err
+	}
+	for _, extra := range resp.extra {
+		imap.unsolicited(extra)
+	}
+
+	r := &CopyResult{}
+	if uids, ok := resp.code.(*ResponseCopyUID); ok {
+		r.UIDValidity = uids.UIDValidity
+		r.Source = uids.Source
+		r.Dest = uids.Dest
+	}
+	return r, nil
+}
+
+// CopyOrCreate is like Copy, but if the server says the destination
+// must be created first ("NO [TRYCREATE]"), it creates mailbox and
+// tries once more.
+func (imap *IMAP) CopyOrCreate(sequence string, mailbox string) (*CopyResult, error) {
+	r, err := imap.Copy(sequence, mailbox)
+	if e, ok := err.(*IMAPError); ok && e.Code == "TRYCREATE" {
+		if err := imap.Create(mailbox); err != nil {
+			return nil, err
+		}
+		r, err = imap.Copy(sequence, mailbox)
+	}
+	return r, err
+}
+
+// Status requests the status items (e.g. "MESSAGES", "UNSEEN") of
+// mailbox.  SIZE is only requested if the server has the STATUS=SIZE
+// capability.
+func (imap *IMAP) Status(mailbox string, items []string) (*MailboxStatus, error) {
+	request, err := imap.statusItems(items)
+	if err != nil {
+		return nil, err
+	}
+	if len(request) == 0 {
+		// "STATUS mailbox ()" is a syntax error.
+		return &MailboxStatus{Mailbox: mailbox}, nil
+	}
+
+	resp, err := imap.sendSync("STATUS ", imap.mailbox(mailbox), " ("+strings.Join(request, " ")+")")
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MailboxStatus{Mailbox: mailbox}
+	for _, extra := range resp.extra {
+		if s, ok := extra.(*MailboxStatus); ok && sameMailbox(s.Mailbox, mailbox) {
+			status = s
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	return status, nil
+}
+
+// ErrNoModSeq is returned by HighestModSeq for a mailbox that doesn't
+// keep mod-sequences, as the server reports with NOMODSEQ or a
+// HIGHESTMODSEQ of 0.
+var ErrNoModSeq = errors.New("imap: mailbox has no mod-sequences (NOMODSEQ)")
+
+// HighestModSeq returns the highest mod-sequence of mailbox, from
+// STATUS, without selecting it: if it is the same as last time, nothing
+// in the mailbox has changed.  It needs the CONDSTORE capability.
+func (imap *IMAP) HighestModSeq(mailbox string) (uint64, error) {
+	if err := imap.require("CONDSTORE"); err != nil {
+		return 0, err
+	}
+	resp, err := imap.sendSync("STATUS ", imap.mailbox(mailbox), " (HIGHESTMODSEQ)")
+	if err != nil {
+		return 0, err
+	}
+
+	var status *MailboxStatus
+	noModSeq := false
+	for _, extra := range resp.extra {
+		switch extra := extra.(type) {
+		case *MailboxStatus:
+			if sameMailbox(extra.Mailbox, mailbox) && status == nil {
+				status = extra
+				continue
+			}
+		case *ResponseStatus:
+			if extra.code == "NOMODSEQ" {
+				noModSeq = true
+				continue
+			}
+		}
+		imap.unsolicited(extra)
+	}
+	if noModSeq || status != nil && status.HighestModSeq == 0 {
+		return 0, ErrNoModSeq
+	}
+	if status == nil {
+		return 0, fmt.Errorf("imap: no STATUS response for %q", mailbox)
+	}
+	return status.HighestModSeq, nil
+}
+
+// statusItems returns those of items the server may be asked for.
+func (imap *IMAP) statusItems(items []string) ([]string, error) {
+	request := make([]string, 0, len(items))
+	for _, item := range items {
+		var ok bool
+		var err error
+		switch strings.ToUpper(item) {
+		case "SIZE":
+			ok, err = imap.supports("STATUS=SIZE")
+		case "APPENDLIMIT":
+			ok, err = imap.hasAppendLimit()
+		default:
+			ok = true
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			request = append(request, item)
+		}
+	}
+	return request, nil
+}
+
+// StatusMany is Status for each of mailboxes, keyed by mailbox, as for
+// refreshing the unread counts of a folder pane.  With LIST-STATUS it
+// takes a single command; otherwise the STATUS commands are pipelined,
+// so that the whole takes about one round trip.  Mailboxes the server
+// gives no status for, such as ones that don't exist, are left out.
+func (imap *IMAP) StatusMany(mailboxes []string, items []string) (map[string]*MailboxStatus, error) {
+	request, err := imap.statusItems(items)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]*MailboxStatus, len(mailboxes))
+	if len(mailboxes) == 0 || len(request) == 0 {
+		for _, mailbox := range mailboxes {
+			statuses[mailbox] = &MailboxStatus{Mailbox: mailbox}
+		}
+		return statuses, nil
+	}
+	// Responses may come in any order, and name INBOX in any case.
+	requested := func(name string) (string, bool) {
+		for _, mailbox := range mailboxes {
+			if sameMailbox(mailbox, name) {
+				return mailbox, true
+			}
+		}
+		return "", false
+	}
+	collect := func(extra interface{}) {
+		if s, ok := extra.(*MailboxStatus); ok {
+			if mailbox, ok := requested(s.Mailbox); ok {
+				s.Mailbox = mailbox
+				statuses[mailbox] = s
+				return
+			}
+		}
+		imap.unsolicited(extra)
+	}
+
+	names := make([]interface{}, len(mailboxes))
+	pipeline := true
+	for i, mailbox := range mailboxes {
+		names[i] = imap.mailbox(mailbox)
+		if _, ok := names[i].(string); !ok {
+			pipeline = false
+		}
+	}
+
+	ok, err := imap.supports("LIST-STATUS")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		parts := []interface{}{`LIST "" (`}
+		for i, name := range names {
+			if i > 0 {
+				parts = append(parts, " ")
+			}
+			parts = append(parts, name)
+		}
+		parts = append(parts, ") RETURN (STATUS ("+strings.Join(request, " ")+"))")
+		resp, err := imap.sendSync(parts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, extra := range resp.extra {
+			if _, ok := extra.(*ResponseList); !ok {
+				collect(extra)
+			}
+		}
+		return statuses, nil
+	}
+	if !pipeline {
+		// A literal waits for the server's go-ahead, so can't be
+		// pipelined.
+		for _, mailbox := range mailboxes {
+			s, err := imap.Status(mailbox, request)
+			if _, ok := err.(*IMAPError); ok {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			statuses[mailbox] = s
+		}
+		return statuses, nil
+	}
+
+	ch := make(chan interface{}, 1)
+	first, err := imap.beginBatch(ch, len(mailboxes))
+	if err != nil {
+		return nil, err
+	}
+	last := first + tag(len(mailboxes)-1)
+	if imap.CommandTimeout > 0 {
+		timer := time.AfterFunc(imap.CommandTimeout, func() {
+			imap.timeout(last)
+		})
+		defer timer.Stop()
+	}
+	var cmds strings.Builder
+	for i, name := range names {
+		fmt.Fprintf(&cmds, "%s STATUS %s (%s)\r\n", first+tag(i), name, strings.Join(request, " "))
+	}
+	if err := imap.write(cmds.String()); err != nil {
+		imap.abort(err)
+		return nil, err
 	}
+	for done := 0; done < len(mailboxes); {
+		switch r := (<-ch).(type) {
+		case *ResponseStatus:
+			if !r.tagged {
+				imap.unsolicited(r)
+				continue
+			}
+			// A NO just leaves its mailbox out.
+			imap.updateCapabilities(r)
+			imap.lastStatus = r
+			done++
+		case error:
+			return nil, r
+		default:
+			collect(r)
+		}
+	}
+	return statuses, nil
 }
 
-func (imap *IMAP) Start() (string, error) {
-	tag, r, err := imap.r.readResponse()
-	if err != nil {
-		return "", err
+// AppendLimit returns the largest message the server accepts for
+// appending to mailbox, and whether there is a limit.  A limit the
+// server advertises for all mailboxes (APPENDLIMIT=n) is used as is;
+// otherwise, if it has the APPENDLIMIT capability (RFC 7889), the
+// mailbox's limit is asked for with STATUS.  Without it, no limit is
+// known and false is returned.
+func (imap *IMAP) AppendLimit(mailbox string) (uint32, bool, error) {
+	ok, err := imap.hasAppendLimit()
+	if err != nil || !ok {
+		return 0, false, err
 	}
-	if tag != untagged {
-		return "", fmt.Errorf("expected untagged server hello. got %q", tag)
+	if imap.appendLimit >= 0 {
+		return uint32(imap.appendLimit), true, nil
 	}
-	resp := r.(*ResponseStatus)
-	if resp.status != OK {
-		return "", &IMAPError{resp.status, resp.text}
+	status, err := imap.Status(mailbox, []string{"APPENDLIMIT"})
+	if err != nil {
+		return 0, false, err
 	}
-
-	go func() {
-		err := imap.readLoop()
-		// XXX what to do with an error on the read thread?
-		panic(err)
-	}()
-
-	return resp.text, nil
+	if status.AppendLimit == nil {
+		return 0, false, nil
+	}
+	return *status.AppendLimit, true, nil
 }
 
-func (imap *IMAP) Send(ch chan interface{}, format string, args ...interface{}) error {
-	tag := tag(imap.nextTag)
-	imap.nextTag++
-
-	toSend := []byte(fmt.Sprintf("a%d %s\r\n", int(tag), fmt.Sprintf(format, args...)))
+// hasAppendLimit reports whether the server has the APPENDLIMIT
+// capability, in either form.
+func (imap *IMAP) hasAppendLimit() (bool, error) {
+	ok, err := imap.supports("APPENDLIMIT")
+	return ok || imap.appendLimit >= 0, err
+}
 
-	if ch != nil {
-		imap.pendingLock.Lock()
-		imap.pendingTag = tag
-		imap.pendingChan = ch
-		imap.pendingLock.Unlock()
+// sameMailbox reports whether two mailbox names are the same; INBOX is
+// case-insensitive.
+func sameMailbox(a, b string) bool {
+	if strings.EqualFold(a, "INBOX") {
+		return strings.EqualFold(b, "INBOX")
 	}
-
-	_, err := imap.w.Write(toSend)
-	return err
+	return a == b
 }
 
-func (imap *IMAP) SendSync(format string, args ...interface{}) (*ResponseStatus, error) {
-	ch := make(chan interface{}, 1)
-	err := imap.Send(ch, format, args...)
+// Comparator selects the collation used by SORT and SEARCH: the first
+// of order (e.g. "i;unicode-casemap") that the server supports.  With
+// no arguments it just reports the active one.  It returns the active
+// comparator and, if the server listed them, the ones that matched.
+// It needs the I18NLEVEL=2 capability.
+func (imap *IMAP) Comparator(order ...string) (string, []string, error) {
+	if err := imap.require("I18NLEVEL=2"); err != nil {
+		return "", nil, err
+	}
+	cmd := "COMPARATOR"
+	for _, c := range order {
+		cmd += " " + quote(c)
+	}
+	resp, err := imap.SendSync("%s", cmd)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	var response *ResponseStatus
-	extra := make([]interface{}, 0)
-L:
-	for {
-		r := <-ch
-		switch r := r.(type) {
-		case *ResponseStatus:
-			response = r
-			break L
-		default:
-			extra = append(extra, r)
+	var comparator *ResponseComparator
+	for _, extra := range resp.extra {
+		if c, ok := extra.(*ResponseComparator); ok {
+			comparator = c
+		} else {
+			imap.unsolicited(extra)
 		}
 	}
-
-	if len(extra) > 0 {
-		response.extra = extra
-	}
-	// XXX callers discard unsolicited responses if this is not OK
-	if response.status != OK {
-		return response, &IMAPError{response.status, response.text}
+	if comparator == nil {
+		return "", nil, errors.New("imap: no COMPARATOR response")
 	}
-	return response, nil
+	return comparator.Active, comparator.Available, nil
 }
 
-func (imap *IMAP) Auth(user string, pass string) (string, []string, error) {
-	resp, err := imap.SendSync("LOGIN %s %s", user, pass)
+// Search returns the messages matching criteria, which is in SEARCH
+// syntax, e.g. "UNSEEN SINCE 1-Feb-1994".
+func (imap *IMAP) Search(criteria string) (*ResponseSearch, error) {
+	resp, err := imap.SendSync("SEARCH %s", criteria)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	var caps []string
+	search := &ResponseSearch{Nums: make([]int, 0)}
 	for _, extra := range resp.extra {
-		switch extra := extra.(type) {
-		case *ResponseCapabilities:
-			caps = extra.Capabilities
-		default:
-			imap.Unsolicited <- extra
+		if s, ok := extra.(*ResponseSearch); ok {
+			search = s
+		} else {
+			imap.unsolicited(extra)
 		}
 	}
-	return resp.text, caps, nil
+	return search, nil
 }
 
-func quote(in string) string {
-	if strings.IndexAny(in, "\r\n") >= 0 {
-		panic("invalid characters in string to quote")
+// SearchFunc is like Search, but passes each matching number to fn as
+// it is read instead of returning them, so the memory a search takes
+// doesn't grow with the number of matches.  fn is called on the
+// goroutine reading the connection, and mustn't send commands.
+func (imap *IMAP) SearchFunc(criteria string, fn func(num int)) error {
+	imap.r.searchNum.Store(&fn)
+	defer imap.r.searchNum.Store(nil)
+	resp, err := imap.SendSync("SEARCH %s", criteria)
+	if err != nil {
+		return err
 	}
-	return "\"" + in + "\""
+	for _, extra := range resp.extra {
+		if _, ok := extra.(*ResponseSearch); !ok {
+			imap.unsolicited(extra)
+		}
+	}
+	return nil
 }
 
-func (imap *IMAP) List(reference string, name string) ([]*ResponseList, error) {
-	/* Responses:  untagged responses: LIST */
-	response, err := imap.SendSync("LIST %s %s", quote(reference), quote(name))
+// ESearch is like Search, but asks for the RFC 4731 result options in
+// ret (e.g. "MIN", "COUNT", "ALL") instead of the list of matches.  It
+// needs the ESEARCH capability.
+func (imap *IMAP) ESearch(criteria string, ret []string) (*ResponseESearch, error) {
+	if err := imap.require("ESEARCH"); err != nil {
+		return nil, err
+	}
+	resp, err := imap.SendSync("SEARCH RETURN (%s) %s", strings.Join(ret, " "), criteria)
 	if err != nil {
 		return nil, err
 	}
 
-	lists := make([]*ResponseList, 0)
-	for _, extra := range response.extra {
-		if list, ok := extra.(*ResponseList); ok {
-			lists = append(lists, list)
+	search := &ResponseESearch{}
+	for _, extra := range resp.extra {
+		if s, ok := extra.(*ResponseESearch); ok {
+			search = s
 		} else {
-			imap.Unsolicited <- extra
+			imap.unsolicited(extra)
 		}
 	}
-
-	return lists, nil
-}
-
-// ResponseExamine contains the response to examining a mailbox.
-type ResponseExamine struct {
-	Flags          []string
-	Exists         int
-	Recent         int
-	PermanentFlags []string
-	UIDValidity    int
-	UIDNext        int
+	return search, nil
 }
 
-func (imap *IMAP) Examine(mailbox string) (*ResponseExamine, error) {
-	/*
-	 Responses:  REQUIRED untagged responses: FLAGS, EXISTS, RECENT
-	 REQUIRED OK untagged responses:  UNSEEN,  PERMANENTFLAGS,
-	 UIDNEXT, UIDVALIDITY
-	*/
-	resp, err := imap.SendSync("EXAMINE %s", quote(mailbox))
+// SearchSeqSet is like Search, but returns the matches as a set, ready
+// to be passed to Fetch.  The server sends it as a set if it supports
+// ESEARCH; otherwise the numbers are coalesced here.  The set is empty
+// if nothing matched, and Fetch refuses it with ErrEmptySequence.
+func (imap *IMAP) SearchSeqSet(criteria string) (*SeqSet, error) {
+	esearch, err := imap.supports("ESEARCH")
 	if err != nil {
 		return nil, err
 	}
+	if esearch {
+		search, err := imap.ESearch(criteria, []string{"ALL"})
+		if err != nil {
+			return nil, err
+		}
+		if search.All == "" {
+			return &SeqSet{}, nil
+		}
+		return ParseSeqSet(search.All)
+	}
 
-	r := &ResponseExamine{}
+	search, err := imap.Search(criteria)
+	if err != nil {
+		return nil, err
+	}
+	nums := make([]uint32, len(search.Nums))
+	for i, n := range search.Nums {
+		nums[i] = uint32(n)
+	}
+	return NewSeqSet(nums...), nil
+}
 
-	for _, extra := range resp.extra {
-		switch extra := extra.(type) {
-		case (*ResponseFlags):
-			r.Flags = extra.Flags
-		case (*ResponseExists):
-			r.Exists = extra.Count
-		case (*ResponseRecent):
-			r.Recent = extra.Count
-		// XXX unseen
-		case (*ResponsePermanentFlags):
-			r.PermanentFlags = extra.Flags
-		case (*ResponseUIDNext):
-			value := extra.Value
-			r.UIDNext = value
-		case (*ResponseUIDValidity):
-			value := extra.Value
-			r.UIDValidity = value
-		default:
-			imap.Unsolicited <- extra
-		}
+// SearchPartial returns the window of matches numbered from to to (from
+// 1) among all the messages matching criteria, so that a large result
+// can be read a page at a time.  It needs the PARTIAL capability.
+func (imap *IMAP) SearchPartial(criteria string, from, to uint32) (*ESearchPartial, error) {
+	if err := imap.require("PARTIAL"); err != nil {
+		return nil, err
 	}
-	return r, nil
+	search, err := imap.ESearch(criteria, []string{fmt.Sprintf("PARTIAL %d:%d", from, to)})
+	if err != nil {
+		return nil, err
+	}
+	if search.Partial == nil {
+		return &ESearchPartial{From: int(from), To: int(to)}, nil
+	}
+	return search.Partial, nil
 }
 
-func formatFetch(sequence string, fields []string) string {
+func formatFetch(sequence string, fields []string) (string, error) {
+	if sequence == "" {
+		return "", ErrEmptySequence
+	}
 	var fieldsStr string
 	if len(fields) == 1 {
 		fieldsStr = fields[0]
 	} else {
 		fieldsStr = "(" + strings.Join(fields, " ") + ")"
 	}
-	return fmt.Sprintf("FETCH %s %s", sequence, fieldsStr)
+	return fmt.Sprintf("FETCH %s %s", sequence, fieldsStr), nil
+}
+
+// fetchCapabilities are the capabilities needed by FETCH items.
+var fetchCapabilities = map[string]string{
+	"SAVEDATE": "SAVEDATE",
+	"PREVIEW":  "PREVIEW",
 }
 
 func (imap *IMAP) Fetch(sequence string, fields []string) ([]*ResponseFetch, error) {
-	resp, err := imap.SendSync("%s", formatFetch(sequence, fields))
+	for _, field := range fields {
+		// Items may take modifiers, as in "PREVIEW (LAZY)".
+		item, _, _ := strings.Cut(strings.ToUpper(field), " ")
+		if capability, ok := fetchCapabilities[item]; ok {
+			if err := imap.require(capability); err != nil {
+				return nil, err
+			}
+		}
+	}
+	cmd, err := formatFetch(sequence, fields)
+	if err != nil {
+		return nil, err
+	}
+	return imap.fetch(cmd)
+}
+
+// FetchChangedSince is like Fetch, but only returns the messages whose
+// mod-sequence is greater than modseq, each with its ModSeq set.  It
+// needs the CONDSTORE capability.
+func (imap *IMAP) FetchChangedSince(sequence string, fields []string, modseq uint64) ([]*ResponseFetch, error) {
+	if err := imap.require("CONDSTORE"); err != nil {
+		return nil, err
+	}
+	cmd, err := formatFetch(sequence, fields)
+	if err != nil {
+		return nil, err
+	}
+	return imap.fetch(fmt.Sprintf("%s (CHANGEDSINCE %d)", cmd, modseq))
+}
+
+// SeqToUID returns the UIDs of the messages in seqset, keyed by
+// message number.  Numbers with no message are left out.
+func (imap *IMAP) SeqToUID(seqset string) (map[uint32]uint32, error) {
+	return imap.numbers("FETCH "+seqset+" (UID)", false)
+}
+
+// UIDToSeq returns the message numbers of the messages whose UIDs are
+// in uidset, keyed by UID.  UIDs with no message are left out.
+func (imap *IMAP) UIDToSeq(uidset string) (map[uint32]uint32, error) {
+	return imap.numbers("UID FETCH "+uidset+" (UID)", true)
+}
+
+// numbers sends command, a FETCH of UIDs, and maps the message numbers
+// of its results to the UIDs, or the other way if byUID is set.
+func (imap *IMAP) numbers(command string, byUID bool) (map[uint32]uint32, error) {
+	fetches, err := imap.fetch(command)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[uint32]uint32, len(fetches))
+	for _, fetch := range fetches {
+		if fetch.UID == 0 {
+			// Say, a flag change that came along.
+			imap.unsolicited(fetch)
+			continue
+		}
+		seq, uid := uint32(fetch.Msg), uint32(fetch.UID)
+		if byUID {
+			m[uid] = seq
+		} else {
+			m[seq] = uid
+		}
+	}
+	return m, nil
+}
+
+func (imap *IMAP) fetch(command string) ([]*ResponseFetch, error) {
+	resp, err := imap.SendSync("%s", command)
 	if err != nil {
 		return nil, err
 	}
@@ -217,15 +1878,22 @@ func (imap *IMAP) Fetch(sequence string, fields []string) ([]*ResponseFetch, err
 		if list, ok := extra.(*ResponseFetch); ok {
 			lists = append(lists, list)
 		} else {
-			imap.Unsolicited <- extra
+			imap.unsolicited(extra)
 		}
 	}
 	return lists, nil
 }
 
+// FetchAsync streams the results of a FETCH.  The returned channel
+// yields a *ResponseFetch per message, then either the *ResponseStatus
+// completing the command or an error if the response couldn't be read.
 func (imap *IMAP) FetchAsync(sequence string, fields []string) (chan interface{}, error) {
+	cmd, err := formatFetch(sequence, fields)
+	if err != nil {
+		return nil, err
+	}
 	ch := make(chan interface{})
-	err := imap.Send(ch, formatFetch(sequence, fields))
+	err = imap.Send(ch, "%s", cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -240,22 +1908,35 @@ func (imap *IMAP) FetchAsync(sequence string, fields []string) (chan interface{}
 			case *ResponseFetch:
 				outChan <- r
 			case *ResponseStatus:
+				if !r.tagged {
+					imap.unsolicited(r)
+					continue
+				}
+				outChan <- r
+				return
+			case error:
 				outChan <- r
 				return
 			default:
-				imap.Unsolicited <- r
+				imap.unsolicited(r)
 			}
 		}
 	}()
 	return outChan, nil
 }
 
-// Repeatedly reads messages off the connection and dispatches them.
-func (imap *IMAP) readLoop() error {
+// readLoop repeatedly reads messages off the connection and dispatches
+// them.  It holds the client only weakly while waiting on the
+// connection, so that a client dropped without Close can be collected
+// and its finalizer close the connection; readLoop then returns nil.
+func readLoop(client weak.Pointer[IMAP], src *reader) error {
 	var msgChan chan interface{}
 	for {
-		tag, r, err := imap.r.readResponse()
-		check(err)
+		tag, r, err := src.readResponse()
+		imap := client.Value()
+		if imap == nil {
+			return nil
+		}
 
 		if msgChan == nil {
 			imap.pendingLock.Lock()
@@ -263,56 +1944,338 @@ func (imap *IMAP) readLoop() error {
 			imap.pendingLock.Unlock()
 		}
 
+		if err != nil {
+			if imap.r.ioError() != nil {
+				return err
+			}
+			imap.pendingLock.Lock()
+			pendingTag := imap.pendingTag
+			imap.pendingLock.Unlock()
+			perr := &ProtocolError{Snippet: imap.r.snippet(), Err: err}
+			if msgChan == nil {
+				return perr
+			}
+			perr.Tag = pendingTag.String()
+
+			// Malformed input within a command's response fails just
+			// that command, provided its completion can be found.
+
+			// A line with a tag that can't be read could be the
+			// completion, so rather than wait for one that may
+			// never come, it ends the command too.
+			var rerr error
+			if tag == pendingTag || tag == badTag {
+				rerr = imap.r.discardLine()
+			} else {
+				rerr = imap.r.resync(pendingTag)
+			}
+			if rerr != nil {
+				return rerr
+			}
+
+			imap.pendingLock.Lock()
+			imap.pendingChan = nil
+			imap.pendingLock.Unlock()
+			msgChan <- perr
+			msgChan = nil
+			continue
+		}
+
 		if tag == untagged {
 			if msgChan != nil {
 				msgChan <- r
 			} else {
-				imap.Unsolicited <- r
+				imap.unsolicited(r)
+			}
+		} else if tag == continuation {
+			if msgChan == nil {
+				return fmt.Errorf("unexpected continuation request %q", r.(*ResponseContinuation).Text)
 			}
+			msgChan <- r
 		} else {
 			resp := r.(*ResponseStatus)
 
 			imap.pendingLock.Lock()
-			if imap.pendingTag != tag {
+			if tag < imap.pendingFirst || tag > imap.pendingTag {
+				imap.pendingLock.Unlock()
 				return fmt.Errorf("expected response tag %s, got %s", imap.pendingTag, tag)
 			}
-			imap.pendingChan = nil
+			// Earlier commands of a batch leave the rest pending.
+			last := tag == imap.pendingTag
+			inflate := false
+			var tlsConfig *tls.Config
+			if last {
+				imap.pendingChan = nil
+				inflate = imap.startInflate && resp.status == OK
+				imap.startInflate = false
+				if resp.status == OK {
+					tlsConfig = imap.startTLS
+				}
+				imap.startTLS = nil
+			}
 			imap.pendingLock.Unlock()
 
+			if inflate {
+				// Before anything more is read.
+				imap.r.inflate()
+			}
+			if tlsConfig != nil {
+				if err := imap.handshake(tlsConfig); err != nil {
+					msgChan <- err
+					return err
+				}
+			}
+
 			msgChan <- resp
-			msgChan = nil
+			if last {
+				msgChan = nil
+			}
 		}
 	}
 	panic("not reached")
 }
 
+// shutdown marks the connection dead after the read thread hits err:
+// the connection is closed, and the pending command and any later ones
+// fail with err, or with the error the connection was already closed
+// with.
+func (imap *IMAP) shutdown(err error) {
+	imap.pendingLock.Lock()
+	if imap.err == nil {
+		imap.err = err
+	}
+	err = imap.err
+	ch := imap.pendingChan
+	imap.pendingChan = nil
+	imap.pendingLock.Unlock()
+
+	if c, ok := imap.w.w.(io.Closer); ok {
+		c.Close()
+	}
+	if ch != nil {
+		ch <- err
+	}
+}
+
+// timeout kills the connection if the command tagged tag is still
+// pending.  The read thread then fails it with ErrTimeout.
+func (imap *IMAP) timeout(tag tag) {
+	imap.pendingLock.Lock()
+	if imap.pendingTag != tag || imap.pendingChan == nil || imap.err != nil {
+		imap.pendingLock.Unlock()
+		return
+	}
+	imap.err = ErrTimeout
+	imap.pendingLock.Unlock()
+	imap.close()
+}
+
+// unsolicited passes r on to the Unsolicited channel, a bare flag
+// change as a *FlagUpdate.
+func (imap *IMAP) unsolicited(r interface{}) {
+	r = unilateral(r)
+	if alert, ok := r.(*Alert); ok {
+		if h := imap.alertHandler.Load(); h != nil {
+			(*h)(alert)
+		}
+	}
+	imap.Unsolicited <- r
+}
+
+// SetAlertHandler makes h be called with each Alert too, as it is put
+// on the Unsolicited channel, or stops that if h is nil.  It may be
+// called at any time.  h runs on whichever goroutine is handling the
+// response, and must not use the client.
+func (imap *IMAP) SetAlertHandler(h func(*Alert)) {
+	if h == nil {
+		imap.alertHandler.Store(nil)
+		return
+	}
+	imap.alertHandler.Store(&h)
+}
+
+// updateCapabilities refreshes the cached capabilities from r, if it is
+// a CAPABILITY response or a status with a CAPABILITY code.
+func (imap *IMAP) updateCapabilities(r interface{}) {
+	switch r := r.(type) {
+	case *ResponseCapabilities:
+		imap.applyCapabilities(r.Capabilities)
+	case *ResponseStatus:
+		if caps, ok := r.code.(*ResponseCapabilities); ok {
+			imap.applyCapabilities(caps.Capabilities)
+		}
+	}
+}
+
+// applyCapabilities replaces the cached capabilities.  Every source of
+// them, be it a CAPABILITY response or a code on the greeting or a
+// login, goes through here.
+func (imap *IMAP) applyCapabilities(caps []string) {
+	imap.capabilities = caps
+	imap.appendLimit = -1
+	for _, c := range caps {
+		if len(c) > len("APPENDLIMIT=") && strings.EqualFold(c[:len("APPENDLIMIT=")], "APPENDLIMIT=") {
+			if n, err := strconv.ParseUint(c[len("APPENDLIMIT="):], 10, 32); err == nil {
+				imap.appendLimit = int64(n)
+			}
+		}
+	}
+}
+
+// dead returns the error the connection died with, or nil if it is
+// still up.
+func (imap *IMAP) dead() error {
+	imap.pendingLock.Lock()
+	defer imap.pendingLock.Unlock()
+	return imap.err
+}
+
+// abort kills the connection from the client thread after err left the
+// session in an unknown state.  Later commands fail with err.
+func (imap *IMAP) abort(err error) {
+	imap.pendingLock.Lock()
+	if imap.err == nil {
+		imap.err = err
+	}
+	imap.pendingChan = nil
+	imap.pendingLock.Unlock()
+	imap.close()
+}
+
+// ErrClosed is the error of the command in progress when Close is
+// called, and of every command after it.
+var ErrClosed = errors.New("imap: connection closed")
+
+// Close drops the connection, without logging out.  It may be called
+// from any goroutine, even while a command is waiting on the server,
+// so that, say, an IdleUntil ends at once when a program shuts down:
+// the command fails with ErrClosed.  It can only interrupt a connection
+// whose writer is an io.Closer, as a net.Conn is.
+//
+// A client dropped without Close or Logout has its connection closed,
+// with a warning logged, when it is garbage collected, but that may be
+// long after, or never.
+func (imap *IMAP) Close() error {
+	imap.pendingLock.Lock()
+	if imap.err == ErrClosed {
+		imap.pendingLock.Unlock()
+		return nil
+	}
+	if imap.err == nil {
+		imap.err = ErrClosed
+	}
+	imap.pendingLock.Unlock()
+	runtime.SetFinalizer(imap, nil)
+	if c, ok := imap.w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// close drops the connection without logging out.
+func (imap *IMAP) close() {
+	if c, ok := imap.w.w.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// Address is an address of an ENVELOPE.  An RFC 5322 group, as in
+// "undisclosed-recipients:;", comes as a marker starting it, with the
+// group's name as Name, then its members, then a marker ending it;
+// markers have no Address, and nor does a malformed address with a
+// host but no mailbox.
 type Address struct {
 	Name, Source, Address string
+
+	group int // groupStart or groupEnd for a marker
+}
+
+const (
+	groupStart = 1 + iota
+	groupEnd
+)
+
+// IsGroupStart reports whether a is the marker starting a group.
+func (a Address) IsGroupStart() bool {
+	return a.group == groupStart
+}
+
+// IsGroupEnd reports whether a is the marker ending a group.
+func (a Address) IsGroupEnd() bool {
+	return a.group == groupEnd
 }
 
 func (a *Address) fromSexp(s []sexp) {
 	if name := nilOrString(s[0]); name != nil {
-		a.Name = *name
+		a.Name = decodeHeader(*name)
 	}
 	if source := nilOrString(s[1]); source != nil {
 		a.Source = *source
 	}
 	mbox := nilOrString(s[2])
 	host := nilOrString(s[3])
-	if mbox != nil && host != nil {
-		address := *mbox + "@" + *host
-		a.Address = address
+	switch {
+	case mbox != nil && host != nil:
+		a.Address = *mbox + "@" + *host
+	case mbox != nil:
+		a.group = groupStart
+		a.Name = decodeHeader(*mbox)
+	case host == nil:
+		a.group = groupEnd
+	default:
+		// A host without a mailbox: malformed, so neither an
+		// address nor a marker.
 	}
 }
+
+// addressListFromSexp reads an address list of an ENVELOPE.  Elements
+// that aren't addresses are skipped, and lists nested in the list are
+// flattened into it, rather than failing the whole FETCH.
 func addressListFromSexp(s sexp) []Address {
-	if s == nil {
+	switch s := s.(type) {
+	case nil:
+		return nil
+	case []sexp:
+		return appendAddresses(make([]Address, 0, len(s)), s)
+	}
+	// A few servers send the list as one string, in header syntax.
+	list, err := mail.ParseAddressList(sexpString(s))
+	if err != nil {
 		return nil
 	}
+	addrs := make([]Address, len(list))
+	for i, addr := range list {
+		addrs[i] = Address{Name: addr.Name, Address: addr.Address}
+	}
+	return addrs
+}
 
-	saddrs := s.([]sexp)
-	addrs := make([]Address, len(saddrs))
-	for i, s := range saddrs {
-		addrs[i].fromSexp(s.([]sexp))
+func appendAddresses(addrs []Address, list []sexp) []Address {
+	for _, s := range list {
+		elem, ok := s.([]sexp)
+		if !ok {
+			continue
+		}
+		if isAddress(elem) {
+			var a Address
+			a.fromSexp(elem)
+			addrs = append(addrs, a)
+		} else {
+			addrs = appendAddresses(addrs, elem)
+		}
 	}
 	return addrs
 }
+
+// isAddress reports whether s is an address: four strings or NILs.
+func isAddress(s []sexp) bool {
+	if len(s) != 4 {
+		return false
+	}
+	for _, field := range s {
+		if _, ok := field.([]sexp); ok {
+			return false
+		}
+	}
+	return true
+}
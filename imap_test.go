@@ -0,0 +1,1963 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFake returns a started client talking to a FakeServer that has
+// sent its greeting.
+func startFake(t *testing.T) (*IMAP, *FakeServer) {
+	im, s := DialPipe()
+	t.Cleanup(func() { s.Close() })
+	s.Send("* OK fake server ready")
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	return im, s
+}
+
+func waitFake(t *testing.T, s *FakeServer) {
+	if err := s.Wait(); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+}
+
+func TestFakeServerAuth(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("LOGIN user pass")
+	s.Send("* CAPABILITY IMAP4rev1 IDLE")
+	s.Done("OK LOGIN completed")
+
+	text, caps, err := im.Auth("user", "pass")
+	if err != nil {
+		t.Fatalf("auth: %s", err)
+	}
+	if text != "LOGIN completed" {
+		t.Fatalf("expected text %q, got %q", "LOGIN completed", text)
+	}
+	if !reflect.DeepEqual(caps, []string{"IMAP4rev1", "IDLE"}) {
+		t.Fatalf("unexpected capabilities %q", caps)
+	}
+	waitFake(t, s)
+}
+
+func TestEnableNothing(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ENABLE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("ENABLE FOO")
+	s.Send("* ENABLED")
+	s.Done("OK ENABLE completed")
+	s.Expect("ENABLE BAR")
+	s.Done("OK ENABLE completed")
+
+	// Asking for nothing sends nothing, not even CAPABILITY.
+	if enabled, err := im.Enable(); err != nil || enabled == nil || len(enabled) != 0 {
+		t.Fatalf("expected nothing enabled, got %#v %v", enabled, err)
+	}
+	for _, c := range []string{"FOO", "BAR"} {
+		enabled, err := im.Enable(c)
+		if err != nil {
+			t.Fatalf("enable %s: %s", c, err)
+		}
+		if enabled == nil || len(enabled) != 0 {
+			t.Fatalf("expected nothing enabled for %s, got %#v", c, enabled)
+		}
+		if im.IsEnabled(c) {
+			t.Fatalf("%s reported enabled", c)
+		}
+	}
+	waitFake(t, s)
+}
+
+func TestAutoEnable(t *testing.T) {
+	im, s := startFake(t)
+	im.SetAutoEnable("CONDSTORE", "QRESYNC")
+	s.Expect("LOGIN user pass")
+	s.Done("OK [CAPABILITY IMAP4rev1 ENABLE CONDSTORE] LOGIN completed")
+	s.Expect("ENABLE CONDSTORE")
+	s.Send("* ENABLED CONDSTORE")
+	s.Done("OK ENABLE completed")
+
+	if _, _, err := im.Auth("user", "pass"); err != nil {
+		t.Fatalf("auth: %s", err)
+	}
+	if !im.IsEnabled("condstore") || im.IsEnabled("QRESYNC") {
+		t.Fatalf("unexpected enabled set %q", im.enabled)
+	}
+	waitFake(t, s)
+}
+
+func TestFakeServerMismatch(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+
+	_, err := im.List("", WildcardAny)
+	if e, ok := err.(*IMAPError); !ok || e.Status != BAD {
+		t.Fatalf("expected BAD from server, got %v", err)
+	}
+	if s.Wait() == nil {
+		t.Fatalf("expected server to report the mismatch")
+	}
+}
+
+func TestFakeServerLiteral(t *testing.T) {
+	im, s := DialPipe()
+	defer s.Close()
+	s.Expect("APPEND INBOX {5}\r\nhello")
+	s.Done("OK APPEND completed")
+
+	fmt.Fprintf(im.w, "a0 APPEND INBOX {5}\r\n")
+	line, err := im.r.readToEOL()
+	if err != nil || line[0] != '+' {
+		t.Fatalf("expected continuation, got %q, %v", line, err)
+	}
+	fmt.Fprintf(im.w, "hello\r\n")
+
+	tag, resp, err := im.r.readResponse()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if tag != 0 || resp.(*ResponseStatus).status != OK {
+		t.Fatalf("unexpected completion %v %v", tag, resp)
+	}
+	waitFake(t, s)
+}
+
+func TestKeepRaw(t *testing.T) {
+	im, s := DialPipe()
+	t.Cleanup(func() { s.Close() })
+	im.KeepRaw = true
+	s.Send("* OK fake server ready")
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	line := "* 1 FETCH (UID 7 RFC822 {12}\r\nhello\r\nthere BODY[HEADER] \"x\")"
+	s.Expect("FETCH 1 (UID RFC822)")
+	s.Send(line)
+	s.Done("OK  FETCH completed")
+
+	fetches, err := im.Fetch("1", []string{"UID", "RFC822"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(fetches) != 1 || string(fetches[0].Raw) != line+"\r\n" {
+		t.Fatalf("expected raw %q, got %q", line+"\r\n", fetches[0].Raw)
+	}
+	if raw := string(im.LastStatus().Raw()); raw != "a0 OK  FETCH completed\r\n" {
+		t.Fatalf("unexpected raw completion %q", raw)
+	}
+	waitFake(t, s)
+}
+
+func TestKeepRawOff(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 1 UID")
+	s.Send("* 1 FETCH (UID 7)")
+	s.Done("OK FETCH completed")
+	fetches, err := im.Fetch("1", []string{"UID"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if fetches[0].Raw != nil || im.LastStatus().Raw() != nil {
+		t.Fatalf("raw bytes kept without KeepRaw")
+	}
+	waitFake(t, s)
+}
+
+func TestResyncAfterParseError(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 1 RFC822")
+	s.Send("* 1 FETCH (RFC822 {abc}")
+	s.Send("* 2 FETCH (FLAGS (\\Seen))")
+	s.Done("OK FETCH completed")
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	_, err := im.Fetch("1", []string{"RFC822"})
+	if err == nil {
+		t.Fatalf("expected corrupt FETCH to fail")
+	}
+	if _, ok := err.(*IMAPError); ok {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop after resync: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestProtocolError(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+	s.Expect("FETCH 1 FLAGS")
+	s.Send(`* 1 FETCH (FLAGS (\Seen) UID 4 ENVELOPE ("date" "subject"))`)
+	s.Done("OK FETCH completed")
+
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	_, err := im.Fetch("1", []string{"FLAGS"})
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a ProtocolError, got %#v", err)
+	}
+	if perr.Tag != "a1" {
+		t.Fatalf("expected tag a1, got %q", perr.Tag)
+	}
+	if snippet := `UID 4 ENVELOPE ("date" "subject"))`; !strings.HasSuffix(string(perr.Snippet), snippet) {
+		t.Fatalf("expected snippet ending %q, got %q", snippet, perr.Snippet)
+	}
+	if !strings.Contains(err.Error(), "a1") || !strings.Contains(err.Error(), "envelope needed 10 fields") {
+		t.Fatalf("unhelpful message %q", err)
+	}
+	waitFake(t, s)
+}
+
+func TestResyncCorruptCompletion(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Done("MAYBE NOOP completed")
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	if err := im.Noop(); err == nil {
+		t.Fatalf("expected corrupt completion to fail")
+	}
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop after resync: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestResyncBadTag(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Send("a0x OK NOOP completed")
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	if err := im.Noop(); err == nil {
+		t.Fatalf("expected completion with a bad tag to fail")
+	}
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop after bad tag: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestResyncGivesUp(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 1 RFC822")
+	s.Send("* 1 FETCH (RFC822 {abc}")
+	s.Send(strings.Repeat("* 2 FETCH (FLAGS ())\r\n", maxResync/20))
+
+	if _, err := im.Fetch("1", []string{"RFC822"}); err == nil {
+		t.Fatalf("expected corrupt FETCH to fail")
+	}
+	if err := im.Noop(); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`COPY 2:4 "Archive"`)
+	s.Done("OK [COPYUID 38505 304,319:320 3956:3958] Done")
+
+	r, err := im.Copy("2:4", "Archive")
+	if err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	expected := &CopyResult{38505, "304,319:320", "3956:3958"}
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", r, expected)
+	}
+	waitFake(t, s)
+}
+
+func TestCopyOrCreate(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`COPY 1 "New"`)
+	s.Done("NO [TRYCREATE] Mailbox doesn't exist")
+	s.Expect(`CREATE "New"`)
+	s.Done("OK CREATE completed")
+	s.Expect(`COPY 1 "New"`)
+	s.Done("OK COPY completed")
+
+	r, err := im.CopyOrCreate("1", "New")
+	if err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if r.UIDValidity != 0 {
+		t.Fatalf("expected no UIDs without COPYUID, got %#v", r)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendOrCreate(t *testing.T) {
+	im, s := startFake(t)
+	// Refused before the message is sent...
+	s.ExpectHead(`APPEND "Sent" (\Seen) {5}`)
+	s.Done("NO [TRYCREATE] Mailbox doesn't exist")
+	s.Expect(`CREATE "Sent"`)
+	s.Done("OK CREATE completed")
+	s.Expect("APPEND \"Sent\" (\\Seen) {5}\r\nhello")
+	s.Done("OK APPEND completed")
+	// ...or after it, which sends it all again.
+	s.Expect("APPEND \"Drafts\" {5}\r\nhello")
+	s.Done("NO [TRYCREATE] Mailbox doesn't exist")
+	s.Expect(`CREATE "Drafts"`)
+	s.Done("OK CREATE completed")
+	s.Expect("APPEND \"Drafts\" {5}\r\nhello")
+	s.Done("OK APPEND completed")
+
+	if err := im.AppendOrCreate("Sent", []string{`\Seen`}, []byte("hello")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	if err := im.AppendOrCreate("Drafts", nil, []byte("hello")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendAndFindUID(t *testing.T) {
+	im, s := startFake(t)
+	msg := "Message-ID: <1@example.com>\r\n\r\nhi\r\n"
+	// Without UIDPLUS, the UID is searched for, once Sent is selected.
+	s.Expect("APPEND \"Sent\" {35}\r\n" + msg)
+	s.Done("OK APPEND completed")
+	s.Expect(`SELECT "Sent"`)
+	s.Send("* 12 EXISTS")
+	s.Send("* OK [UIDVALIDITY 77] UIDs valid")
+	s.Done("OK [READ-WRITE] SELECT completed")
+	s.Expect("APPEND \"Sent\" {35}\r\n" + msg)
+	s.Done("OK APPEND completed")
+	s.Expect(`UID SEARCH HEADER Message-ID <1@example.com>`)
+	// An older copy of the message matches too.
+	s.Send("* SEARCH 9 31")
+	s.Done("OK SEARCH completed")
+	// With it, the server says; Sent is still selected.
+	s.Expect("APPEND \"Sent\" {35}\r\n" + msg)
+	s.Done("OK [APPENDUID 77 32] APPEND completed")
+	// A UID of 0 is no UID, so it is searched for after all.
+	s.Expect("APPEND \"Sent\" {35}\r\n" + msg)
+	s.Done("OK [APPENDUID 77 0] APPEND completed")
+	s.Expect(`UID SEARCH HEADER Message-ID <1@example.com>`)
+	s.Send("* SEARCH 33")
+	s.Done("OK SEARCH completed")
+	s.Expect("APPEND \"Sent\" {35}\r\n" + msg)
+	s.Done("OK APPEND completed")
+	s.Expect(`UID SEARCH HEADER Message-ID <1@example.com>`)
+	s.Send("* SEARCH")
+	s.Done("OK SEARCH completed")
+	// The message is in even if the search fails.
+	s.Expect("APPEND \"Sent\" {35}\r\n" + msg)
+	s.Done("OK APPEND completed")
+	s.Expect(`UID SEARCH HEADER Message-ID <1@example.com>`)
+	s.Done("NO Search failed")
+
+	if r, err := im.AppendAndFindUID("Sent", nil, []byte(msg)); err == nil || r == nil || *r != (AppendResult{}) {
+		t.Fatalf("expected an error for an unselected mailbox, got %v %v", r, err)
+	}
+	if _, err := im.Select("Sent"); err != nil {
+		t.Fatalf("select: %s", err)
+	}
+	for _, expected := range []AppendResult{{77, 31}, {77, 32}, {77, 33}, {0, 0}} {
+		r, err := im.AppendAndFindUID("Sent", nil, []byte(msg))
+		if err != nil {
+			t.Fatalf("append: %s", err)
+		}
+		if *r != expected {
+			t.Fatalf("expected %+v, got %+v", expected, *r)
+		}
+	}
+	if r, err := im.AppendAndFindUID("Sent", nil, []byte(msg)); err == nil || r == nil || *r != (AppendResult{}) {
+		t.Fatalf("expected a result and the search's error, got %v %v", r, err)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendOrCreateOtherNo(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("APPEND \"Sent\" {5}\r\nhello")
+	s.Done("NO [OVERQUOTA] Mailbox full")
+
+	err := im.AppendOrCreate("Sent", nil, []byte("hello"))
+	if e, ok := err.(*IMAPError); !ok || e.Code != "OVERQUOTA" {
+		t.Fatalf("expected OVERQUOTA, got %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestListExtended(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 LIST-EXTENDED")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`LIST (SUBSCRIBED RECURSIVEMATCH) "" "%" RETURN (CHILDREN)`)
+	s.Send(`* LIST (\Marked \NoInferiors \Subscribed) "/" "inbox"`)
+	s.Send(`* LIST () "/" "Fruit" ("CHILDINFO" ("SUBSCRIBED"))`)
+	s.Send(`* LIST (\Subscribed \HasNoChildren) "/" "Tofu"`)
+	s.Done("OK LIST completed")
+
+	lists, err := im.ListExtended("", WildcardAny, []string{"SUBSCRIBED", "RECURSIVEMATCH"}, []string{"CHILDREN"})
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(lists) != 3 {
+		t.Fatalf("expected 3 mailboxes, got %d", len(lists))
+	}
+	if l := lists[0]; l.Subscribed == nil || !*l.Subscribed || l.Inferiors == nil || *l.Inferiors {
+		t.Fatalf("bad attributes for %#v", l)
+	}
+	if l := lists[1]; l.Name != "Fruit" || l.Subscribed != nil || !reflect.DeepEqual(l.ChildInfo, []string{"SUBSCRIBED"}) {
+		t.Fatalf("bad recursive match %#v", l)
+	}
+	if l := lists[2]; l.Children == nil || *l.Children || l.ChildInfo != nil {
+		t.Fatalf("bad attributes for %#v", l)
+	}
+	waitFake(t, s)
+}
+
+func TestListExtendedUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	_, err := im.ListExtended("", "*", nil, []string{"CHILDREN"})
+	if e, ok := err.(*CapabilityError); !ok || e.Capability != "LIST-EXTENDED" {
+		t.Fatalf("expected capability error, got %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestStatusSize(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 STATUS=SIZE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`STATUS "Archive" (MESSAGES SIZE)`)
+	s.Send("* STATUS Archive (MESSAGES 231 SIZE 8589934592)")
+	s.Done("OK STATUS completed")
+
+	status, err := im.Status("Archive", []string{"MESSAGES", "SIZE"})
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	expected := &MailboxStatus{Mailbox: "Archive", Messages: 231, Size: 8589934592}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", status, expected)
+	}
+	waitFake(t, s)
+}
+
+func TestStatusSizeUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`STATUS "INBOX" (UNSEEN)`)
+	s.Send(`* STATUS inbox (UNSEEN 3)`)
+	s.Done("OK STATUS completed")
+
+	status, err := im.Status("INBOX", []string{"UNSEEN", "SIZE"})
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	if status.Unseen != 3 || status.Size != 0 {
+		t.Fatalf("unexpected status %#v", status)
+	}
+
+	// With nothing left to ask for, no command is sent.
+	status, err = im.Status("INBOX", []string{"SIZE"})
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	if !reflect.DeepEqual(status, &MailboxStatus{Mailbox: "INBOX"}) {
+		t.Fatalf("unexpected status %#v", status)
+	}
+	waitFake(t, s)
+}
+
+func TestHighestModSeq(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 CONDSTORE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`STATUS "INBOX" (HIGHESTMODSEQ)`)
+	// Past 32 bits.
+	s.Send("* STATUS INBOX (HIGHESTMODSEQ 90060115205545359)")
+	s.Done("OK STATUS completed")
+	s.Expect(`STATUS "Virtual" (HIGHESTMODSEQ)`)
+	s.Send("* STATUS Virtual (HIGHESTMODSEQ 0)")
+	s.Done("OK STATUS completed")
+	s.Expect(`STATUS "Other" (HIGHESTMODSEQ)`)
+	s.Send("* OK [NOMODSEQ] Sorry, this mailbox format doesn't support modsequences")
+	s.Send("* STATUS Other (HIGHESTMODSEQ 1)")
+	s.Done("OK STATUS completed")
+
+	modseq, err := im.HighestModSeq("INBOX")
+	if err != nil {
+		t.Fatalf("highestmodseq: %s", err)
+	}
+	if modseq != 90060115205545359 {
+		t.Fatalf("expected 90060115205545359, got %d", modseq)
+	}
+	for _, mailbox := range []string{"Virtual", "Other"} {
+		if _, err := im.HighestModSeq(mailbox); err != ErrNoModSeq {
+			t.Fatalf("%s: expected ErrNoModSeq, got %v", mailbox, err)
+		}
+	}
+	waitFake(t, s)
+}
+
+func TestStatusManyPipelined(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+	// All three are sent before any answer.
+	s.Expect(`STATUS "INBOX" (UNSEEN)`)
+	s.Expect(`STATUS "Lists" (UNSEEN)`)
+	s.Expect(`STATUS "Gone" (UNSEEN)`)
+	s.Send("* STATUS Lists (UNSEEN 7)")
+	s.Send("* STATUS inbox (UNSEEN 2)")
+	s.Send("* 4 EXISTS")
+	s.Send("a1 OK STATUS completed")
+	s.Send("a2 OK STATUS completed")
+	s.Send("a3 NO Mailbox doesn't exist")
+
+	statuses, err := im.StatusMany([]string{"INBOX", "Lists", "Gone"}, []string{"UNSEEN"})
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	expected := map[string]*MailboxStatus{
+		"INBOX": {Mailbox: "INBOX", Unseen: 2},
+		"Lists": {Mailbox: "Lists", Unseen: 7},
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", statuses, expected)
+	}
+	if _, ok := (<-im.Unsolicited).(*ResponseExists); !ok {
+		t.Fatalf("EXISTS not passed on")
+	}
+	waitFake(t, s)
+}
+
+func TestStatusManyLiteral(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+	// A name that can't be quoted goes as a literal, so one at a time.
+	s.Expect("STATUS {8}\r\nsay \"hi\" (UNSEEN)")
+	s.Send("* STATUS {8}\r\nsay \"hi\" (UNSEEN 1)")
+	s.Done("OK STATUS completed")
+	s.Expect(`STATUS "Gone" (UNSEEN)`)
+	s.Done("NO Mailbox doesn't exist")
+
+	statuses, err := im.StatusMany([]string{`say "hi"`, "Gone"}, []string{"UNSEEN"})
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	expected := map[string]*MailboxStatus{`say "hi"`: {Mailbox: `say "hi"`, Unseen: 1}}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", statuses, expected)
+	}
+	waitFake(t, s)
+}
+
+func TestStatusManyListStatus(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 LIST-EXTENDED LIST-STATUS")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`LIST "" ("INBOX" "Lists") RETURN (STATUS (MESSAGES UNSEEN))`)
+	s.Send(`* LIST () "/" INBOX`)
+	s.Send("* STATUS INBOX (MESSAGES 17 UNSEEN 2)")
+	s.Send(`* LIST () "/" Lists`)
+	s.Send("* STATUS Lists (MESSAGES 30 UNSEEN 7)")
+	s.Done("OK LIST completed")
+
+	statuses, err := im.StatusMany([]string{"INBOX", "Lists"}, []string{"MESSAGES", "UNSEEN"})
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	if len(statuses) != 2 || statuses["INBOX"].Messages != 17 || statuses["Lists"].Unseen != 7 {
+		t.Fatalf("unexpected statuses %#v", statuses)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendLimitCapability(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 APPENDLIMIT=10")
+	s.Done("OK CAPABILITY completed")
+
+	limit, ok, err := im.AppendLimit("INBOX")
+	if err != nil {
+		t.Fatalf("append limit: %s", err)
+	}
+	if !ok || limit != 10 {
+		t.Fatalf("expected limit 10, got %d, %v", limit, ok)
+	}
+
+	// Refused without being sent.
+	if err := im.Append("INBOX", nil, []byte("far too long a message")); err != ErrAppendTooBig {
+		t.Fatalf("expected ErrAppendTooBig, got %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendLimitStatus(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 APPENDLIMIT")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`STATUS "INBOX" (APPENDLIMIT)`)
+	s.Send("* STATUS INBOX (APPENDLIMIT 257890)")
+	s.Done("OK STATUS completed")
+	s.Expect(`STATUS "Archive" (APPENDLIMIT)`)
+	s.Send("* STATUS Archive (APPENDLIMIT NIL)")
+	s.Done("OK STATUS completed")
+
+	limit, ok, err := im.AppendLimit("INBOX")
+	if err != nil {
+		t.Fatalf("append limit: %s", err)
+	}
+	if !ok || limit != 257890 {
+		t.Fatalf("expected limit 257890, got %d, %v", limit, ok)
+	}
+	limit, ok, err = im.AppendLimit("Archive")
+	if err != nil {
+		t.Fatalf("append limit: %s", err)
+	}
+	if ok {
+		t.Fatalf("expected no limit, got %d", limit)
+	}
+	waitFake(t, s)
+}
+
+func TestByteCounts(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Send("* 1 FETCH (RFC822 {5}\r\nhello)")
+	s.Done("OK NOOP completed")
+
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	read := len("* OK fake server ready\r\n" +
+		"* 1 FETCH (RFC822 {5}\r\nhello)\r\n" +
+		"a0 OK NOOP completed\r\n")
+	if n := im.BytesRead(); n != int64(read) {
+		t.Fatalf("expected %d bytes read, got %d", read, n)
+	}
+	written := len("a0 NOOP\r\n")
+	if n := im.BytesWritten(); n != int64(written) {
+		t.Fatalf("expected %d bytes written, got %d", written, n)
+	}
+	waitFake(t, s)
+}
+
+func TestWriteLiteralSync(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("APPEND INBOX {5}\r\nhello")
+	s.Done("OK APPEND completed")
+
+	if _, err := im.sendSync("APPEND INBOX ", literal("hello")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestWriteLiteralSyncRejected(t *testing.T) {
+	im, s := startFake(t)
+	s.ExpectHead("APPEND INBOX {5}")
+	s.Send("* OK still here")
+	s.Done("NO APPEND refused")
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	_, err := im.sendSync("APPEND INBOX ", literal("hello"))
+	if e, ok := err.(*IMAPError); !ok || e.Status != NO {
+		t.Fatalf("expected NO, got %v", err)
+	}
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop after rejected literal: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestDelimiter(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`LIST "" ""`)
+	s.Send(`* LIST (\Noselect) "/" ""`)
+	s.Done("OK LIST completed")
+
+	for i := 0; i < 2; i++ {
+		delim, err := im.Delimiter()
+		if err != nil {
+			t.Fatalf("delimiter: %s", err)
+		}
+		if delim != "/" {
+			t.Fatalf("expected delimiter %q, got %q", "/", delim)
+		}
+	}
+	waitFake(t, s)
+}
+
+func TestDelimiterFlat(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`LIST "" ""`)
+	s.Send(`* LIST (\Noselect) NIL ""`)
+	s.Done("OK LIST completed")
+
+	delim, err := im.Delimiter()
+	if err != nil {
+		t.Fatalf("delimiter: %s", err)
+	}
+	if delim != "" {
+		t.Fatalf("expected no delimiter, got %q", delim)
+	}
+	waitFake(t, s)
+}
+
+func TestDelimiterMismatch(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`LIST "" "*"`)
+	s.Send(`* LIST () "/" INBOX`)
+	s.Send(`* LIST () NIL Flat`)
+	s.Send(`* LIST () "." Archive.2024`)
+	s.Send(`* LIST () "/" Work/Reports`)
+	s.Done("OK LIST completed")
+
+	lists, err := im.List("", "*")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(lists) != 4 {
+		t.Fatalf("expected 4 mailboxes, got %d", len(lists))
+	}
+	expected := &DelimiterMismatch{"Archive.2024", ".", "/"}
+	if resp := <-im.Unsolicited; !reflect.DeepEqual(resp, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, resp)
+	}
+	select {
+	case resp := <-im.Unsolicited:
+		t.Fatalf("unexpected %#v", resp)
+	default:
+	}
+	// The first delimiter seen is kept, and saves a LIST.
+	if delim, err := im.Delimiter(); err != nil || delim != "/" {
+		t.Fatalf("expected delimiter %q, got %q %v", "/", delim, err)
+	}
+	waitFake(t, s)
+}
+
+func TestComparator(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 I18NLEVEL=2")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`COMPARATOR "i;basic" "i;unicode-casemap"`)
+	s.Send(`* COMPARATOR "i;unicode-casemap" ("i;unicode-casemap" "i;octet")`)
+	s.Done("OK Will use i;unicode-casemap for collation")
+
+	active, available, err := im.Comparator("i;basic", "i;unicode-casemap")
+	if err != nil {
+		t.Fatalf("comparator: %s", err)
+	}
+	if active != "i;unicode-casemap" {
+		t.Fatalf("unexpected active comparator %q", active)
+	}
+	if !reflect.DeepEqual(available, []string{"i;unicode-casemap", "i;octet"}) {
+		t.Fatalf("unexpected comparators %q", available)
+	}
+	waitFake(t, s)
+}
+
+func TestLastStatus(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`EXAMINE "INBOX"`)
+	s.Send("* 2 EXISTS")
+	s.Done("OK [READ-ONLY] EXAMINE completed")
+	s.Expect("NOOP")
+	s.Done("OK [UIDNEXT 44] NOOP completed")
+
+	if _, err := im.Examine("INBOX"); err != nil {
+		t.Fatalf("examine: %s", err)
+	}
+	status := im.LastStatus()
+	if status.Status() != OK || status.Code() != "READ-ONLY" || status.Text() != "EXAMINE completed" {
+		t.Fatalf("unexpected completion %v", status)
+	}
+
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	if code, ok := im.LastStatus().Code().(*ResponseUIDNext); !ok || code.Value != 44 {
+		t.Fatalf("expected UIDNEXT code, got %#v", im.LastStatus().Code())
+	}
+	waitFake(t, s)
+}
+
+func TestSearchFunc(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("SEARCH UNSEEN")
+	s.Send("* SEARCH 2 84 882")
+	s.Send("* 3 EXPUNGE")
+	s.Done("OK SEARCH completed")
+
+	var nums []int
+	if err := im.SearchFunc("UNSEEN", func(num int) { nums = append(nums, num) }); err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	if !reflect.DeepEqual(nums, []int{2, 84, 882}) {
+		t.Fatalf("unexpected numbers %v", nums)
+	}
+	if e, ok := (<-im.Unsolicited).(*ResponseExpunge); !ok || e.Msg != 3 {
+		t.Fatalf("expected the expunge, got %#v", e)
+	}
+	waitFake(t, s)
+}
+
+func TestSeqToUID(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 1:4 (UID)")
+	s.Send("* 1 FETCH (UID 101)")
+	s.Send("* 2 FETCH (UID 105)")
+	s.Send(`* 2 FETCH (FLAGS (\Seen))`)
+	s.Send("* 3 FETCH (UID 106)")
+	s.Done("OK FETCH completed")
+	s.Expect("UID FETCH 101:106 (UID)")
+	s.Send("* 1 FETCH (UID 101)")
+	s.Send("* 2 FETCH (UID 105)")
+	s.Send("* 3 FETCH (UID 106)")
+	s.Done("OK UID FETCH completed")
+
+	// There is no message 4.
+	seqs, err := im.SeqToUID("1:4")
+	if err != nil {
+		t.Fatalf("seqtouid: %s", err)
+	}
+	if !reflect.DeepEqual(seqs, map[uint32]uint32{1: 101, 2: 105, 3: 106}) {
+		t.Fatalf("unexpected mapping %v", seqs)
+	}
+	if _, ok := (<-im.Unsolicited).(*FlagUpdate); !ok {
+		t.Fatalf("flag change not passed on")
+	}
+
+	uids, err := im.UIDToSeq("101:106")
+	if err != nil {
+		t.Fatalf("uidtoseq: %s", err)
+	}
+	if !reflect.DeepEqual(uids, map[uint32]uint32{101: 1, 105: 2, 106: 3}) {
+		t.Fatalf("unexpected mapping %v", uids)
+	}
+	waitFake(t, s)
+}
+
+func TestFlagUpdate(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Send(`* 3 FETCH (FLAGS (\Seen \Answered))`)
+	s.Send(`* 4 FETCH (FLAGS (\Seen) RFC822.SIZE 44)`)
+	s.Done("OK NOOP completed")
+	s.Expect("FETCH 3 FLAGS")
+	s.Send(`* 3 FETCH (FLAGS (\Seen \Answered))`)
+	s.Done("OK FETCH completed")
+
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	got := <-im.Unsolicited
+	want := &FlagUpdate{SeqNum: 3, Flags: FlagSet{`\Seen`, `\Answered`}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DeepEqual(%#v, %#v)", got, want)
+	}
+	// Anything more is a FETCH result as usual.
+	if fetch, ok := (<-im.Unsolicited).(*ResponseFetch); !ok || fetch.Size != 44 {
+		t.Fatalf("expected a fetch result, got %#v", fetch)
+	}
+
+	// And so are flags that were asked for.
+	fetches, err := im.Fetch("3", []string{"FLAGS"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(fetches) != 1 || fetches[0].Msg != 3 {
+		t.Fatalf("unexpected results %#v", fetches)
+	}
+	waitFake(t, s)
+}
+
+func TestSearchModSeq(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("SEARCH MODSEQ 620162338")
+	s.Send("* SEARCH 2 5 6 7 11 12 18 19 20 23 (MODSEQ 917162500)")
+	s.Done("OK Search complete")
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ESEARCH CONDSTORE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("SEARCH RETURN (COUNT) MODSEQ 620162338")
+	s.Send(`* ESEARCH (TAG "a2") COUNT 10 MODSEQ 917162500`)
+	s.Done("OK Search complete")
+
+	search, err := im.Search("MODSEQ 620162338")
+	if err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	if len(search.Nums) != 10 || search.ModSeq != 917162500 {
+		t.Fatalf("unexpected search result %#v", search)
+	}
+
+	esearch, err := im.ESearch("MODSEQ 620162338", []string{"COUNT"})
+	if err != nil {
+		t.Fatalf("esearch: %s", err)
+	}
+	if esearch.Count != 10 || esearch.ModSeq != 917162500 {
+		t.Fatalf("unexpected esearch result %#v", esearch)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchIterClose(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 1:3 FLAGS")
+	s.Send(`* 1 FETCH (FLAGS (\Seen))`)
+	s.Send(`* 2 FETCH (FLAGS ())`)
+	s.Send(`* 3 FETCH (FLAGS (\Deleted))`)
+	s.Done("OK FETCH completed")
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	it, err := im.FetchIter("1:3", []string{"FLAGS"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if !it.Next() {
+		t.Fatalf("no result: %v", it.Err())
+	}
+	if it.Result().Msg != 1 {
+		t.Fatalf("unexpected result %#v", it.Result())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if it.Next() {
+		t.Fatalf("result after close")
+	}
+
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestAuthLiteral(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("LOGIN \"fred smith\" {11}\r\nse\"cr\\et pw")
+	s.Done("OK LOGIN completed")
+
+	if _, _, err := im.Auth("fred smith", "se\"cr\\et pw"); err != nil {
+		t.Fatalf("auth: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestUnauthenticate(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("LOGIN alice pass")
+	s.Send("* CAPABILITY IMAP4rev1 UNAUTHENTICATE")
+	s.Done("OK LOGIN completed")
+	s.Expect("UNAUTHENTICATE")
+	s.Done("OK [CAPABILITY IMAP4rev1 AUTH=PLAIN] UNAUTHENTICATE completed")
+	s.Expect("FETCH 1 FLAGS")
+	s.Done("BAD Command FETCH not valid in this state")
+	s.Expect("LOGIN bob pass")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK LOGIN completed")
+	s.Expect("FETCH 1 FLAGS")
+	s.Send(`* 1 FETCH (FLAGS (\Seen))`)
+	s.Done("OK FETCH completed")
+
+	if _, _, err := im.Auth("alice", "pass"); err != nil {
+		t.Fatalf("auth: %s", err)
+	}
+	if err := im.Unauthenticate(); err != nil {
+		t.Fatalf("unauthenticate: %s", err)
+	}
+	if !im.HasCapability("AUTH=PLAIN") || im.HasCapability("UNAUTHENTICATE") {
+		t.Fatalf("capabilities not replaced by UNAUTHENTICATE's")
+	}
+	if im.LastStatus() != nil {
+		t.Fatalf("last status kept across sessions")
+	}
+	if _, err := im.Fetch("1", []string{"FLAGS"}); err == nil {
+		t.Fatalf("fetch succeeded after unauthenticate")
+	}
+	if _, _, err := im.Auth("bob", "pass"); err != nil {
+		t.Fatalf("auth: %s", err)
+	}
+	if im.HasCapability("UNAUTHENTICATE") {
+		t.Fatalf("kept the old session's capabilities")
+	}
+	fetch, err := im.Fetch("1", []string{"FLAGS"})
+	if err != nil || len(fetch) != 1 {
+		t.Fatalf("fetch: %v, %v", fetch, err)
+	}
+	waitFake(t, s)
+}
+
+func TestSearchPartial(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ESEARCH PARTIAL")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("SEARCH RETURN (PARTIAL 101:200) UNSEEN")
+	s.Send(`* ESEARCH (TAG "a1") PARTIAL (101:200 2001:2099,3000)`)
+	s.Done("OK Search complete")
+
+	partial, err := im.SearchPartial("UNSEEN", 101, 200)
+	if err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	if partial.From != 101 || partial.To != 200 || partial.Set.String() != "2001:2099,3000" {
+		t.Fatalf("unexpected partial result %#v", partial)
+	}
+	waitFake(t, s)
+}
+
+func TestAlertDuringFetch(t *testing.T) {
+	im, s := startFake(t)
+	var handled []*Alert
+	im.SetAlertHandler(func(a *Alert) { handled = append(handled, a) })
+	s.Expect("FETCH 1 UID")
+	s.Send("* 1 FETCH (UID 4)")
+	s.Send("* OK [ALERT] System shutdown in 10 minutes")
+	s.Send("* OK Still here")
+	s.Done("OK FETCH completed")
+	s.Expect("NOOP")
+	s.Send("* BYE [ALERT] Shutting down now")
+	s.Done("OK NOOP completed")
+
+	fetches, err := im.Fetch("1", []string{"UID"})
+	if err != nil || len(fetches) != 1 {
+		t.Fatalf("fetch: %#v %v", fetches, err)
+	}
+	if alert, ok := (<-im.Unsolicited).(*Alert); !ok || alert.Status != OK || alert.Text != "System shutdown in 10 minutes" {
+		t.Fatalf("expected the alert, got %#v", alert)
+	}
+	// Other status responses pass as they were.
+	if status, ok := (<-im.Unsolicited).(*ResponseStatus); !ok || status.Text() != "Still here" {
+		t.Fatalf("expected the plain OK, got %#v", status)
+	}
+
+	im.SetAlertHandler(nil)
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	if alert, ok := (<-im.Unsolicited).(*Alert); !ok || alert.Status != BYE {
+		t.Fatalf("expected the BYE alert, got %#v", alert)
+	}
+	if len(handled) != 1 || handled[0].Text != "System shutdown in 10 minutes" {
+		t.Fatalf("unexpected alerts handled: %#v", handled)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendTooBig(t *testing.T) {
+	im, s := startFake(t)
+	s.ExpectHead(`APPEND "INBOX" (\Seen) {11}`)
+	s.Send("* NO [ALERT] Mailbox is nearly full")
+	s.Done("NO [TOOBIG] Message too large")
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	err := im.Append("INBOX", []string{`\Seen`}, []byte("hello world"))
+	e, ok := err.(*IMAPError)
+	if !ok || e.Status != NO || e.Code != "TOOBIG" {
+		t.Fatalf("expected NO [TOOBIG], got %v", err)
+	}
+	if msg := err.Error(); msg != "imap: NO [TOOBIG] Message too large" {
+		t.Fatalf("unexpected error text %q", msg)
+	}
+	alert, ok := (<-im.Unsolicited).(*Alert)
+	if !ok || alert.Status != NO || alert.Text != "Mailbox is nearly full" {
+		t.Fatalf("expected the alert, got %#v", alert)
+	}
+
+	// The message wasn't sent, so the next command isn't garbled.
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop after rejected append: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestCapabilityCode(t *testing.T) {
+	im, s := DialPipe()
+	defer s.Close()
+	s.Send("* OK [CAPABILITY IMAP4rev1 LOGINDISABLED] ready")
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	if !im.HasCapability("LOGINDISABLED") {
+		t.Fatalf("greeting capabilities not cached")
+	}
+
+	s.Expect("LOGIN user pass")
+	s.Done("OK [CAPABILITY IMAP4rev1 IDLE UIDPLUS] Logged in")
+	_, caps, err := im.Auth("user", "pass")
+	if err != nil {
+		t.Fatalf("auth: %s", err)
+	}
+	if !reflect.DeepEqual(caps, []string{"IMAP4rev1", "IDLE", "UIDPLUS"}) {
+		t.Fatalf("unexpected capabilities %v", caps)
+	}
+	if !im.HasCapability("UIDPLUS") || im.HasCapability("LOGINDISABLED") {
+		t.Fatalf("LOGIN capabilities not cached")
+	}
+	waitFake(t, s)
+}
+
+func TestRefreshCapabilities(t *testing.T) {
+	im, s := DialPipe()
+	defer s.Close()
+	s.Send("* OK [CAPABILITY IMAP4rev1 LOGINDISABLED APPENDLIMIT=10] ready")
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	// The cache is used...
+	caps, err := im.Capabilities()
+	if err != nil || !reflect.DeepEqual(caps, []string{"IMAP4rev1", "LOGINDISABLED", "APPENDLIMIT=10"}) {
+		t.Fatalf("unexpected capabilities %v %v", caps, err)
+	}
+	// ...until a refresh, which always asks.
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 IDLE APPENDLIMIT=20")
+	s.Done("OK CAPABILITY completed")
+	caps, err = im.RefreshCapabilities()
+	if err != nil || !reflect.DeepEqual(caps, []string{"IMAP4rev1", "IDLE", "APPENDLIMIT=20"}) {
+		t.Fatalf("unexpected capabilities %v %v", caps, err)
+	}
+	if im.HasCapability("LOGINDISABLED") || im.appendLimit != 20 {
+		t.Fatalf("derived state not refreshed: %v %d", im.HasCapability("LOGINDISABLED"), im.appendLimit)
+	}
+	if caps, _ := im.Capabilities(); !reflect.DeepEqual(caps, []string{"IMAP4rev1", "IDLE", "APPENDLIMIT=20"}) {
+		t.Fatalf("refresh not cached: %v", caps)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchChangedSince(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 CONDSTORE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("FETCH 1:3 FLAGS (CHANGEDSINCE 12345)")
+	s.Send(`* 2 FETCH (FLAGS (\Seen) MODSEQ (12346))`)
+	s.Done("OK FETCH completed")
+
+	fetch, err := im.FetchChangedSince("1:3", []string{"FLAGS"}, 12345)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(fetch) != 1 || fetch[0].Msg != 2 || fetch[0].ModSeq != 12346 {
+		t.Fatalf("unexpected results %#v", fetch)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendReader(t *testing.T) {
+	im, s := startFake(t)
+	msg := strings.Repeat("Subject: big\r\n", 10000)
+	date := time.Date(2024, 2, 7, 9, 30, 0, 0, time.FixedZone("", -5*60*60))
+	s.Expect(fmt.Sprintf("APPEND \"INBOX\" \" 7-Feb-2024 09:30:00 -0500\" {%d}\r\n%s", len(msg), msg))
+	s.Done("OK APPEND completed")
+
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 10000; i++ {
+			io.WriteString(pw, "Subject: big\r\n")
+		}
+		pw.Close()
+	}()
+	if err := im.AppendReader("INBOX", nil, date, int64(len(msg)), pr); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendReaderShort(t *testing.T) {
+	im, s := startFake(t)
+	s.ExpectHead(`APPEND "INBOX" {10}`)
+	s.Send("+ Ready for literal data")
+	// Drain the partial literal; the line never ends, as the client
+	// hangs up instead.
+	s.ExpectLine("short")
+
+	err := im.AppendReader("INBOX", nil, time.Time{}, 10, strings.NewReader("short"))
+	if err == nil {
+		t.Fatalf("short literal accepted")
+	}
+	if err := im.Noop(); err == nil {
+		t.Fatalf("connection still used after a short literal")
+	}
+}
+
+// cancellingReader yields data, then cancels the upload it feeds.
+type cancellingReader struct {
+	data   string
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if r.data == "" {
+		r.cancel()
+	}
+	return n, nil
+}
+
+func TestAppendContextCancelled(t *testing.T) {
+	im, s := startFake(t)
+	s.ExpectHead(`APPEND "INBOX" {10}`)
+	s.Send("+ Ready for literal data")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := im.AppendContext(ctx, "INBOX", nil, time.Time{}, 10, &cancellingReader{"half", cancel})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	// The connection is gone rather than out of step.
+	if err := im.Noop(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("connection still used after a cancelled literal: %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestAppendContextCancelledEarly(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := im.AppendContext(ctx, "INBOX", nil, time.Time{}, 5, strings.NewReader("hello"))
+	if err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	// Nothing was sent, so the session carries on.
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestFakeServerClose(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if err := im.Noop(); err == nil {
+		t.Fatalf("noop succeeded on a closed server")
+	}
+	waitFake(t, s)
+}
+
+func TestCompletionWithoutSpace(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Send("a0OK NOOP completed")
+
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestSearchSeqSet(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("SEARCH UNSEEN")
+	s.Send("* SEARCH 1 2 3 4 10")
+	s.Done("OK Search complete")
+
+	set, err := im.SearchSeqSet("UNSEEN")
+	if err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	if set.String() != "1:4,10" {
+		t.Fatalf("expected 1:4,10, got %q", set)
+	}
+	waitFake(t, s)
+}
+
+func TestSearchSeqSetESearch(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ESEARCH")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("SEARCH RETURN (ALL) UNSEEN")
+	s.Send(`* ESEARCH (TAG "a1") ALL 1:4,10`)
+	s.Done("OK Search complete")
+
+	set, err := im.SearchSeqSet("UNSEEN")
+	if err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	if set.String() != "1:4,10" {
+		t.Fatalf("expected 1:4,10, got %q", set)
+	}
+	waitFake(t, s)
+}
+
+func TestSearchSeqSetEmpty(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ESEARCH")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("SEARCH RETURN (ALL) UNSEEN")
+	s.Send(`* ESEARCH (TAG "a1")`)
+	s.Done("OK Search complete")
+
+	set, err := im.SearchSeqSet("UNSEEN")
+	if err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	// Refused without being sent.
+	if _, err := im.Fetch(set.String(), []string{"FLAGS"}); err != ErrEmptySequence {
+		t.Fatalf("expected ErrEmptySequence, got %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestSaveDate(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 SAVEDATE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("FETCH 1:2 (UID SAVEDATE)")
+	s.Send(`* 1 FETCH (UID 7 SAVEDATE "14-Feb-2024 08:15:00 +0100")`)
+	s.Send(`* 2 FETCH (UID 8 SAVEDATE NIL)`)
+	s.Done("OK FETCH completed")
+	s.Expect("SEARCH SAVEDSINCE 1-Feb-2024")
+	s.Send("* SEARCH 1")
+	s.Done("OK SEARCH completed")
+
+	fetch, err := im.Fetch("1:2", []string{"UID", "SAVEDATE"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	want := time.Date(2024, 2, 14, 7, 15, 0, 0, time.UTC)
+	if len(fetch) != 2 || !fetch[0].SaveDate.Equal(want) || !fetch[1].SaveDate.IsZero() {
+		t.Fatalf("unexpected results %#v", fetch)
+	}
+
+	since := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	search, err := im.SearchWith(new(SearchCriteria).SavedSince(since))
+	if err != nil {
+		t.Fatalf("search: %s", err)
+	}
+	if len(search.Nums) != 1 || search.Nums[0] != 1 {
+		t.Fatalf("unexpected search %#v", search)
+	}
+	waitFake(t, s)
+}
+
+func TestSaveDateUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	_, err := im.SearchWith(new(SearchCriteria).SavedBefore(time.Now()))
+	if _, ok := err.(*CapabilityError); !ok {
+		t.Fatalf("search: got %v, want a CapabilityError", err)
+	}
+	if _, err := im.Fetch("1", []string{"SAVEDATE"}); err == nil {
+		t.Fatalf("fetch: expected an error")
+	}
+	waitFake(t, s)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	im, s := startFake(t)
+	im.CommandTimeout = 50 * time.Millisecond
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+	s.Expect("NOOP")
+
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	// The server never answers the second NOOP.
+	start := time.Now()
+	if err := im.Noop(); err != ErrTimeout {
+		t.Fatalf("noop: got %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("noop took %s", d)
+	}
+	waitFake(t, s)
+	if err := im.Noop(); err != ErrTimeout {
+		t.Fatalf("noop after timeout: got %v, want ErrTimeout", err)
+	}
+}
+
+func TestSelectCondstore(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 CONDSTORE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`SELECT "INBOX" (CONDSTORE)`)
+	s.Send(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen)`)
+	s.Send("* 172 EXISTS")
+	s.Send("* OK [UIDVALIDITY 3857529045] UIDs valid")
+	s.Send("* OK [HIGHESTMODSEQ 715194045007] Highest")
+	s.Done("OK [READ-WRITE] SELECT completed, CONDSTORE is now enabled")
+
+	r, err := im.SelectCondstore("INBOX")
+	if err != nil {
+		t.Fatalf("select: %s", err)
+	}
+	if r.Exists != 172 || r.UIDValidity != 3857529045 || r.HighestModSeq != 715194045007 {
+		t.Fatalf("unexpected result %#v", r)
+	}
+	waitFake(t, s)
+}
+
+func TestSelectCondstoreUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	_, err := im.SelectCondstore("INBOX")
+	if e, ok := err.(*CapabilityError); !ok || e.Capability != "CONDSTORE" {
+		t.Fatalf("expected capability error, got %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestSelectUIDNotSticky(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`SELECT "Search Results"`)
+	s.Send(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen)`)
+	s.Send("* 12 EXISTS")
+	s.Send("* OK [UIDVALIDITY 1] Ok")
+	s.Send("* NO [UIDNOTSTICKY] Non-persistent UIDs")
+	s.Done("OK [READ-WRITE] SELECT completed")
+
+	r, err := im.Select("Search Results")
+	if err != nil {
+		t.Fatalf("select: %s", err)
+	}
+	if !r.UIDNotSticky || r.Exists != 12 {
+		t.Fatalf("unexpected result %#v", r)
+	}
+	waitFake(t, s)
+}
+
+func TestSelectReadOnly(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`SELECT "Shared"`)
+	s.Send(`* FLAGS (\Answered \Seen)`)
+	s.Send("* 3 EXISTS")
+	s.Send("* OK [UNSEEN 2] First unseen")
+	s.Send("* OK [PERMANENTFLAGS ()] No permanent flags")
+	s.Send("* OK [UIDVALIDITY 7] Ok")
+	s.Send("* OK [UIDNEXT 40] Ok")
+	s.Send("* OK [HIGHESTMODSEQ 90] Ok")
+	s.Done("OK [READ-ONLY] SELECT completed, but read-only")
+	s.Expect(`EXAMINE "Shared"`)
+	s.Done("OK EXAMINE completed")
+	s.Expect(`SELECT "INBOX"`)
+	s.Done("OK [READ-WRITE] SELECT completed")
+
+	r, err := im.Select("Shared")
+	if err != nil {
+		t.Fatalf("select: %s", err)
+	}
+	expected := &ResponseExamine{
+		Flags:          []string{`\Answered`, `\Seen`},
+		Exists:         3,
+		PermanentFlags: []string{},
+		UIDValidity:    7,
+		UIDNext:        40,
+		Unseen:         2,
+		ReadOnly:       true,
+		HighestModSeq:  90,
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, r)
+	}
+	// Without a code, EXAMINE is taken to be read-only and SELECT not.
+	if r, err := im.Examine("Shared"); err != nil || !r.ReadOnly {
+		t.Fatalf("examine: %#v %v", r, err)
+	}
+	if r, err := im.Select("INBOX"); err != nil || r.ReadOnly {
+		t.Fatalf("select: %#v %v", r, err)
+	}
+	waitFake(t, s)
+}
+
+func TestUnknownResponseHandler(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Send(`* XFOO (1 "two" NIL)`)
+	s.Send("* 4 XBAR {3}\r\nabc SEEN")
+	s.Done("OK NOOP completed")
+	s.Expect("NOOP")
+	s.Send("* XFOO")
+	s.Done("OK NOOP completed")
+
+	type unknown struct {
+		keyword string
+		data    []Sexp
+		raw     string
+	}
+	var got []unknown
+	im.SetUnknownResponseHandler(func(keyword string, data []Sexp, raw string) {
+		got = append(got, unknown{keyword, data, raw})
+	})
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	expected := []unknown{
+		{"XFOO", []Sexp{[]Sexp{"1", "two", nil}}, `* XFOO (1 "two" NIL)`},
+		{"XBAR", []Sexp{[]byte("abc"), "SEEN"}, "* 4 XBAR {3}\r\nabc SEEN"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", got, expected)
+	}
+
+	// By default unknown responses are dropped.
+	im.SetUnknownResponseHandler(nil)
+	if err := im.Noop(); err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("handler called after being unset: %#v", got)
+	}
+	waitFake(t, s)
+}
+
+func TestReplace(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 REPLACE UIDPLUS")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("REPLACE 4 \"Drafts\" (\\Seen \\Draft) {5}\r\nhello")
+	s.Send("* OK [APPENDUID 1 2000] Replacement Message ID")
+	s.Send("* 4 EXPUNGE")
+	s.Send("* 3 EXISTS")
+	s.Done("OK Replace completed")
+
+	r, err := im.Replace(4, "Drafts", []string{`\Seen`, `\Draft`}, time.Time{}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("replace: %s", err)
+	}
+	if !reflect.DeepEqual(r, &AppendResult{1, 2000}) {
+		t.Fatalf("unexpected result %#v", r)
+	}
+	if e, ok := (<-im.Unsolicited).(*ResponseExpunge); !ok || e.Msg != 4 {
+		t.Fatalf("expected the expunge, got %#v", e)
+	}
+	waitFake(t, s)
+}
+
+func TestReplaceFallback(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 UIDPLUS")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("APPEND \"Drafts\" {5}\r\nhello")
+	s.Done("OK [APPENDUID 1 2001] APPEND completed")
+	s.Expect(`UID STORE 2000 +FLAGS.SILENT (\Deleted)`)
+	s.Done("OK STORE completed")
+	s.Expect("UID EXPUNGE 2000")
+	s.Send("* 4 EXPUNGE")
+	s.Done("OK EXPUNGE completed")
+
+	r, err := im.UIDReplace(2000, "Drafts", nil, time.Time{}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("replace: %s", err)
+	}
+	if !reflect.DeepEqual(r, &AppendResult{1, 2001}) {
+		t.Fatalf("unexpected result %#v", r)
+	}
+	waitFake(t, s)
+}
+
+func TestReplaceFallbackNoUIDPlus(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("APPEND \"Drafts\" {5}\r\nhello")
+	s.Done("OK APPEND completed")
+	s.Expect(`STORE 4 +FLAGS.SILENT (\Deleted)`)
+	s.Done("OK STORE completed")
+	s.Expect("EXPUNGE")
+	s.Done("OK EXPUNGE completed")
+
+	r, err := im.Replace(4, "Drafts", nil, time.Time{}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("replace: %s", err)
+	}
+	if r.UIDValidity != 0 {
+		t.Fatalf("expected no UID without UIDPLUS, got %#v", r)
+	}
+	waitFake(t, s)
+}
+
+func TestListStatus(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 LIST-EXTENDED LIST-STATUS")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`LIST "" "*" RETURN (STATUS (MESSAGES UNSEEN))`)
+	s.Send(`* LIST () "." "INBOX"`)
+	s.Send(`* STATUS "inbox" (MESSAGES 17 UNSEEN 16)`)
+	s.Send(`* LIST () "." "foo"`)
+	s.Send(`* STATUS "foo" (MESSAGES 30 UNSEEN 29)`)
+	s.Send(`* LIST (\NoSelect) "." "bar"`)
+	s.Send(`* LIST () "." "zap"`)
+	s.Send(`* STATUS "zap" (MESSAGES 8 UNSEEN 3)`)
+	s.Done("OK List completed")
+
+	infos, err := im.ListStatus("", "*", []string{"MESSAGES", "UNSEEN"})
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	var got []string
+	for _, info := range infos {
+		if info.Status == nil {
+			got = append(got, info.Name)
+		} else {
+			got = append(got, fmt.Sprintf("%s %d/%d", info.Name, info.Status.Unseen, info.Status.Messages))
+		}
+	}
+	expected := []string{"INBOX 16/17", "foo 29/30", "bar", "zap 3/8"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("DeepEqual(%q, %q)", got, expected)
+	}
+	waitFake(t, s)
+}
+
+func TestListStatusNoItems(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 LIST-EXTENDED LIST-STATUS")
+	s.Done("OK CAPABILITY completed")
+	// SIZE is dropped without STATUS=SIZE, leaving nothing to ask for.
+	s.Expect(`LIST "" "*"`)
+	s.Send(`* LIST () "." "INBOX"`)
+	s.Done("OK LIST completed")
+
+	infos, err := im.ListStatus("", "*", []string{"SIZE"})
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(infos) != 1 || infos[0].Name != "INBOX" || infos[0].Status != nil {
+		t.Fatalf("unexpected results %#v", infos)
+	}
+	waitFake(t, s)
+}
+
+func TestListStatusFallback(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`LIST "" "*"`)
+	s.Send(`* LIST () "." "INBOX"`)
+	s.Send(`* LIST (\NoSelect) "." "bar"`)
+	s.Send(`* LIST () "." "gone"`)
+	s.Done("OK LIST completed")
+	s.Expect(`STATUS "INBOX" (UNSEEN)`)
+	s.Send(`* STATUS INBOX (UNSEEN 2)`)
+	s.Done("OK STATUS completed")
+	s.Expect(`STATUS "gone" (UNSEEN)`)
+	s.Done("NO [NONEXISTENT] No such mailbox")
+
+	infos, err := im.ListStatus("", "*", []string{"UNSEEN"})
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(infos) != 3 || infos[0].Status.Unseen != 2 || infos[1].Status != nil || infos[2].Status != nil {
+		t.Fatalf("unexpected results %#v", infos)
+	}
+	waitFake(t, s)
+}
+
+func TestExamineWithoutRecent(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`EXAMINE "INBOX"`)
+	s.Send(`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+	s.Send("* 18 EXISTS")
+	s.Send("* OK [UIDVALIDITY 3857529045] UIDs valid")
+	s.Send("* OK [UIDNEXT 4392] Predicted next UID")
+	s.Done("OK [READ-ONLY] EXAMINE completed")
+
+	r, err := im.Examine("INBOX")
+	if err != nil {
+		t.Fatalf("examine: %s", err)
+	}
+	if r.Exists != 18 || r.Recent != 0 || r.UIDNext != 4392 {
+		t.Fatalf("unexpected result %#v", r)
+	}
+	waitFake(t, s)
+}
+
+func TestUIDExpunge(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 UIDPLUS")
+	s.Done("OK CAPABILITY completed")
+	// Messages 3 and 5 are \Deleted, but only 3 (UID 3000) is in the set.
+	s.Expect("UID EXPUNGE 3000:3002")
+	s.Send("* 3 EXPUNGE")
+	s.Send("* 2 EXISTS")
+	s.Done("OK UID EXPUNGE completed")
+
+	expunged, err := im.UIDExpunge("3000:3002")
+	if err != nil {
+		t.Fatalf("expunge: %s", err)
+	}
+	if !reflect.DeepEqual(expunged, []uint32{3}) {
+		t.Fatalf("unexpected expunged messages %v", expunged)
+	}
+	if e, ok := (<-im.Unsolicited).(*ResponseExists); !ok || e.Count != 2 {
+		t.Fatalf("expected EXISTS, got %#v", e)
+	}
+	waitFake(t, s)
+}
+
+func TestUIDExpungeUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	_, err := im.UIDExpunge("1")
+	if e, ok := err.(*CapabilityError); !ok || e.Capability != "UIDPLUS" {
+		t.Fatalf("expected capability error, got %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestPoll(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("NOOP")
+	s.Send("* 22 EXPUNGE")
+	s.Send("* 23 EXISTS")
+	s.Send(`* 14 FETCH (FLAGS (\Seen \Deleted))`)
+	s.Send("* 24 EXISTS")
+	s.Done("OK NOOP completed")
+
+	updates, err := im.Poll()
+	if err != nil {
+		t.Fatalf("poll: %s", err)
+	}
+	if updates.Exists == nil || *updates.Exists != 24 {
+		t.Fatalf("unexpected exists %v", updates.Exists)
+	}
+	if !reflect.DeepEqual(updates.Expunged, []int{22}) {
+		t.Fatalf("unexpected expunged %v", updates.Expunged)
+	}
+	if len(updates.Fetches) != 1 || updates.Fetches[0].Msg != 14 {
+		t.Fatalf("unexpected fetches %#v", updates.Fetches)
+	}
+	// The updates go to Unsolicited too.
+	if len(im.Unsolicited) != 4 {
+		t.Fatalf("expected 4 unsolicited responses, got %d", len(im.Unsolicited))
+	}
+	waitFake(t, s)
+}
+
+func TestFetchPreview(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 PREVIEW")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("FETCH 1:3 (UID PREVIEW (LAZY))")
+	s.Send(`* 1 FETCH (UID 1 PREVIEW "Lunch on Friday? Let me know")`)
+	s.Send("* 2 FETCH (UID 2 PREVIEW {11}\r\nHello world)")
+	s.Send(`* 3 FETCH (UID 3 PREVIEW NIL)`)
+	s.Done("OK FETCH completed")
+
+	fetch, err := im.Fetch("1:3", []string{"UID", "PREVIEW (LAZY)"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	var got []string
+	for _, f := range fetch {
+		got = append(got, f.Preview)
+	}
+	expected := []string{"Lunch on Friday? Let me know", "Hello world", ""}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("DeepEqual(%q, %q)", got, expected)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchPreviewUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	_, err := im.Fetch("1", []string{"PREVIEW (LAZY)"})
+	if e, ok := err.(*CapabilityError); !ok || e.Capability != "PREVIEW" {
+		t.Fatalf("expected capability error, got %v", err)
+	}
+	waitFake(t, s)
+}
+
+func TestEmptyMailbox(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`EXAMINE "New"`)
+	s.Send(`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+	s.Send("* 0 EXISTS")
+	s.Send("* 0 RECENT")
+	s.Send("* OK [UIDVALIDITY 1700000000] UIDs valid")
+	s.Send("* OK [UIDNEXT 1] Predicted next UID")
+	s.Done("OK [READ-ONLY] EXAMINE completed")
+	s.Expect("FETCH 1:* (UID FLAGS)")
+	s.Done("OK FETCH completed")
+	s.Expect("SEARCH ALL")
+	s.Send("* SEARCH")
+	s.Done("OK SEARCH completed")
+
+	r, err := im.Examine("New")
+	if err != nil {
+		t.Fatalf("examine: %s", err)
+	}
+	if r.Exists != 0 || r.Recent != 0 || r.UIDNext != 1 {
+		t.Fatalf("unexpected result %#v", r)
+	}
+	fetch, err := im.Fetch("1:*", []string{"UID", "FLAGS"})
+	if err != nil || fetch == nil || len(fetch) != 0 {
+		t.Fatalf("fetch: expected no messages, got %#v, %v", fetch, err)
+	}
+	search, err := im.Search("ALL")
+	if err != nil || len(search.Nums) != 0 {
+		t.Fatalf("search: expected no messages, got %#v, %v", search, err)
+	}
+	if len(im.Unsolicited) != 0 {
+		t.Fatalf("unexpected unsolicited responses")
+	}
+	waitFake(t, s)
+}
+
+func TestCapabilitySources(t *testing.T) {
+	expected := []string{"IMAP4rev1", "IDLE", "UIDPLUS"}
+
+	// In the greeting.
+	im, s := DialPipe()
+	t.Cleanup(func() { s.Close() })
+	s.Send("* OK [CAPABILITY IMAP4rev1  IDLE UIDPLUS] ready")
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	if !reflect.DeepEqual(im.capabilities, expected) {
+		t.Fatalf("greeting: got %q, want %q", im.capabilities, expected)
+	}
+
+	// In reply to CAPABILITY.
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 IDLE  UIDPLUS ")
+	s.Done("OK CAPABILITY completed")
+	if _, err := im.Capability(); err != nil {
+		t.Fatalf("capability: %s", err)
+	}
+	if !reflect.DeepEqual(im.capabilities, expected) {
+		t.Fatalf("CAPABILITY: got %q, want %q", im.capabilities, expected)
+	}
+
+	// On the completion of LOGIN.
+	s.Expect("LOGIN user pass")
+	s.Done("OK [CAPABILITY IMAP4rev1 IDLE UIDPLUS ] Logged in")
+	_, caps, err := im.Auth("user", "pass")
+	if err != nil {
+		t.Fatalf("auth: %s", err)
+	}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Fatalf("LOGIN: got %q, want %q", caps, expected)
+	}
+	waitFake(t, s)
+}
+
+func TestFinalizerCloses(t *testing.T) {
+	var logged strings.Builder
+	logger := log.New(&logged, "", 0)
+
+	dropped := func(cleanly bool) <-chan struct{} {
+		client, server := net.Pipe()
+		closed := make(chan struct{})
+		go func() {
+			io.WriteString(server, "* OK fake server ready\r\n")
+			io.Copy(io.Discard, server)
+			close(closed)
+		}()
+		im := New(client, client)
+		im.Logger = logger
+		if _, err := im.Start(); err != nil {
+			t.Fatalf("start: %s", err)
+		}
+		if cleanly {
+			im.Close()
+		}
+		return closed
+	}
+	collected := func(closed <-chan struct{}) bool {
+		for i := 0; i < 100; i++ {
+			runtime.GC()
+			select {
+			case <-closed:
+				return true
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		return false
+	}
+
+	if !collected(dropped(false)) {
+		t.Fatalf("connection of a dropped client not closed")
+	}
+	if !strings.Contains(logged.String(), "dropped without Close") {
+		t.Fatalf("expected a warning, got %q", logged.String())
+	}
+
+	logged.Reset()
+	if !collected(dropped(true)) {
+		t.Fatalf("connection not closed")
+	}
+	runtime.GC()
+	if logged.Len() != 0 {
+		t.Fatalf("unexpected warning %q after Close", logged.String())
+	}
+}
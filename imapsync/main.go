@@ -112,6 +112,11 @@ func (ui *UI) fetch(im *imap.IMAP, mailbox string) {
 	check(err)
 	mbox := newMbox(f)
 
+	if examine.Exists == 0 {
+		// "1:0" isn't a valid set, so leave the mbox empty.
+		ui.log("mailbox is empty")
+		return
+	}
 	query := fmt.Sprintf("1:%d", examine.Exists)
 	ui.log("requesting messages %s", query)
 
@@ -122,7 +127,7 @@ func (ui *UI) fetch(im *imap.IMAP, mailbox string) {
 
 	i := 0
 	total := examine.Exists
-	ui.progress(i, total, "fetching messages", i, total)
+	ui.progress(i, total, "fetching messages")
 L:
 	for {
 		r := <-ch
@@ -134,6 +139,8 @@ L:
 		case *imap.ResponseStatus:
 			ui.log("complete %v\n", r)
 			break L
+		case error:
+			check(r)
 		}
 	}
 	readExtra(im)
@@ -0,0 +1,32 @@
+package imap
+
+import "strings"
+
+// MatchMailbox reports whether the mailbox name matches a LIST pattern,
+// as the server would match it.  WildcardAnyRecursive ("*") matches
+// any run of characters, while WildcardAny ("%") matches any run not
+// including the hierarchy delimiter, so it stays within one level.  An
+// empty delimiter means the hierarchy is flat.
+func MatchMailbox(pattern, name, delimiter string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*', '%':
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if MatchMailbox(rest, name[i:], delimiter) {
+					return true
+				}
+				if pattern[0] == '%' && delimiter != "" && strings.HasPrefix(name[i:], delimiter) {
+					return false
+				}
+			}
+			return false
+		default:
+			if name == "" || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return name == ""
+}
@@ -0,0 +1,39 @@
+package imap
+
+import "testing"
+
+type matchTest struct {
+	pattern, name, delim string
+	match                bool
+}
+
+func (m matchTest) Run(t *testing.T) {
+	if got := MatchMailbox(m.pattern, m.name, m.delim); got != m.match {
+		t.Fatalf("MatchMailbox(%q, %q, %q) = %v, want %v", m.pattern, m.name, m.delim, got, m.match)
+	}
+}
+
+func TestMatchMailbox(t *testing.T) {
+	tests := []matchTest{
+		{"INBOX", "INBOX", "/", true},
+		{"INBOX", "INBOX/Sent", "/", false},
+		{"%", "INBOX", "/", true},
+		{"%", "INBOX/Sent", "/", false},
+		{"INBOX/%", "INBOX/Sent", "/", true},
+		{"INBOX/%", "INBOX/Sent/2024", "/", false},
+		{"INBOX/%/2024", "INBOX/Sent/2024", "/", true},
+		{"*", "INBOX/Sent/2024", "/", true},
+		{"INBOX/*", "INBOX/Sent/2024", "/", true},
+		{"INBOX/*", "INBOX", "/", false},
+		{"*/2024", "INBOX/Sent/2024", "/", true},
+		{"S%t", "Sent", ".", true},
+		{"S%t", "Some.Draft", ".", false},
+		{"S*t", "Some.Draft", ".", true},
+		{"%", "a/b", "", true},
+		{"a::%", "a::b::c", "::", false},
+		{"a::*", "a::b::c", "::", true},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+}
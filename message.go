@@ -0,0 +1,324 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// FlagSet is the flags of a message, e.g. "\Seen" or "$Forwarded".
+type FlagSet []string
+
+// Has reports whether flag is in the set.  Flags are case-insensitive.
+func (f FlagSet) Has(flag string) bool {
+	for _, g := range f {
+		if strings.EqualFold(g, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagSet returns the flags in the FLAGS item of a FETCH.
+func flagSet(s sexp) FlagSet {
+	set := FlagSet{}
+	if flags, ok := s.([]sexp); ok {
+		for _, flag := range flags {
+			set = append(set, sexpString(flag))
+		}
+	}
+	return set
+}
+
+// Message is a message's data from FETCH, as returned by
+// FetchMessages.  Fields for items that weren't requested are zero.
+type Message struct {
+	SeqNum        int
+	UID           int
+	Flags         FlagSet
+	Envelope      *ResponseFetchEnvelope
+	InternalDate  time.Time
+	Size          int
+	BodyStructure *BodyStructure
+	Preview       string
+}
+
+// FetchMessages fetches items (e.g. "UID", "FLAGS", "ENVELOPE") of the
+// messages in sequence, for building a message list.  The FETCH macros
+// ALL, FAST and FULL may be used too.
+//
+// Servers may send several FETCH responses for a message, such as a
+// separate flags update, and in any order; they are merged into one
+// Message, matched by UID if it was requested and by message number
+// otherwise.  The messages are in the order first seen.
+func (imap *IMAP) FetchMessages(sequence string, items []string) ([]*Message, error) {
+	fetches, err := imap.Fetch(sequence, items)
+	if err != nil {
+		return nil, err
+	}
+	requested := fetchItems(items)
+	var msgs []*Message
+	bySeqNum := make(map[int]*Message)
+	byUID := make(map[int]*Message)
+	for _, fetch := range fetches {
+		m := bySeqNum[fetch.Msg]
+		if requested["UID"] && fetch.UID != 0 {
+			if byUID[fetch.UID] != nil {
+				m = byUID[fetch.UID]
+			} else if m != nil && m.UID != 0 {
+				// Another message has since taken the number.
+				m = nil
+			}
+		}
+		if m == nil {
+			m = &Message{SeqNum: fetch.Msg}
+			msgs = append(msgs, m)
+			if err := m.fill(fetch, requested); err != nil {
+				return nil, err
+			}
+		} else if err := m.merge(fetch, requested); err != nil {
+			return nil, err
+		}
+		bySeqNum[m.SeqNum] = m
+		if m.UID != 0 {
+			byUID[m.UID] = m
+		}
+	}
+	return msgs, nil
+}
+
+// merge adds to m the requested items of a later FETCH response for the
+// same message, which may carry only some of them.
+func (m *Message) merge(fetch *ResponseFetch, requested map[string]bool) error {
+	present := make(map[string]bool)
+	for item := range requested {
+		switch item {
+		case "UID":
+			present[item] = fetch.UID != 0
+		case "FLAGS":
+			present[item] = fetch.Flags != nil
+		case "ENVELOPE":
+			e := fetch.Envelope
+			present[item] = e.Date != nil || e.Subject != nil || e.From != nil || e.MessageId != nil
+		case "INTERNALDATE":
+			present[item] = fetch.InternalDate != ""
+		case "RFC822.SIZE":
+			present[item] = fetch.Size != 0
+		case "BODYSTRUCTURE", "BODY":
+			present[item] = fetch.BodyStructure != nil
+		case "PREVIEW":
+			present[item] = fetch.Preview != ""
+		}
+	}
+	m.SeqNum = fetch.Msg
+	return m.fill(fetch, present)
+}
+
+// fill sets the fields of m for the requested items in fetch.
+func (m *Message) fill(fetch *ResponseFetch, requested map[string]bool) error {
+	if requested["UID"] {
+		m.UID = fetch.UID
+	}
+	if requested["FLAGS"] {
+		m.Flags = flagSet(fetch.Flags)
+	}
+	if requested["ENVELOPE"] {
+		env := fetch.Envelope
+		m.Envelope = &env
+	}
+	if requested["INTERNALDATE"] && fetch.InternalDate != "" {
+		date, err := time.Parse(DateTimeLayout, fetch.InternalDate)
+		if err != nil {
+			return err
+		}
+		m.InternalDate = date
+	}
+	if requested["RFC822.SIZE"] {
+		m.Size = fetch.Size
+	}
+	if requested["BODYSTRUCTURE"] || requested["BODY"] {
+		m.BodyStructure = fetch.BodyStructure
+	}
+	if requested["PREVIEW"] {
+		m.Preview = fetch.Preview
+	}
+	return nil
+}
+
+// fetchItems returns the set of items requested by items, with the
+// macros expanded.
+func fetchItems(items []string) map[string]bool {
+	macros := map[string][]string{
+		"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+		"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+		"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+	}
+	requested := make(map[string]bool)
+	for _, item := range items {
+		item, _, _ = strings.Cut(strings.ToUpper(item), " ")
+		if expansion, ok := macros[item]; ok {
+			for _, item := range expansion {
+				requested[item] = true
+			}
+		} else {
+			requested[item] = true
+		}
+	}
+	return requested
+}
+
+// HeaderFields returns the section of a message's header lines for
+// fields, as in "BODY.PEEK[" + HeaderFields("From", "Subject") + "]",
+// and as ResponseFetch.Body holds them: "HEADER.FIELDS (FROM SUBJECT)".
+func HeaderFields(fields ...string) string {
+	return "HEADER.FIELDS " + fieldList(fields)
+}
+
+// HeaderFieldsNot is like HeaderFields, but for all header lines but
+// those for fields, such as large Received and DKIM-Signature ones.
+func HeaderFieldsNot(fields ...string) string {
+	return "HEADER.FIELDS.NOT " + fieldList(fields)
+}
+
+func fieldList(fields []string) string {
+	upper := make([]string, len(fields))
+	for i, field := range fields {
+		upper[i] = strings.ToUpper(field)
+	}
+	return "(" + strings.Join(upper, " ") + ")"
+}
+
+// FetchTextBody returns the text of the message with uid, for showing
+// it: its first text/plain part that isn't an attachment, or failing
+// that its first text/html part.  The part is decoded with DecodeText,
+// from its content transfer encoding and its charset; for a charset
+// that isn't known an error is returned.
+func (imap *IMAP) FetchTextBody(uid uint32) (string, error) {
+	fetch, err := imap.uidFetchOne(uid, "BODYSTRUCTURE")
+	if err != nil {
+		return "", err
+	}
+	if fetch.BodyStructure == nil {
+		return "", fmt.Errorf("imap: no BODYSTRUCTURE for UID %d", uid)
+	}
+	part := textPart(fetch.BodyStructure, "PLAIN")
+	if part == nil {
+		part = textPart(fetch.BodyStructure, "HTML")
+	}
+	if part == nil {
+		return "", fmt.Errorf("imap: message with UID %d has no text part", uid)
+	}
+
+	section := part.Section()
+	fetch, err = imap.uidFetchOne(uid, "BODY.PEEK["+section+"]")
+	if err != nil {
+		return "", err
+	}
+	data, ok := fetch.Body[section]
+	if !ok {
+		return "", fmt.Errorf("imap: no BODY[%s] for UID %d", section, uid)
+	}
+	if !KnownEncoding(part.Encoding) {
+		imap.logf("imap: unknown content transfer encoding %q, not decoding", part.Encoding)
+	}
+	r, err := DecodeText(bytes.NewReader(data), part)
+	if err != nil {
+		return "", err
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// uidFetchOne fetches item of the message with uid.
+func (imap *IMAP) uidFetchOne(uid uint32, item string) (*ResponseFetch, error) {
+	fetches, err := imap.fetch(fmt.Sprintf("UID FETCH %d (UID %s)", uid, item))
+	if err != nil {
+		return nil, err
+	}
+	var found *ResponseFetch
+	for _, fetch := range fetches {
+		if fetch.UID == int(uid) && found == nil {
+			found = fetch
+		} else {
+			// Unsolicited flag changes, say.
+			imap.unsolicited(fetch)
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("imap: no message with UID %d", uid)
+	}
+	return found, nil
+}
+
+// textPart returns the first text/subtype part of b that isn't an
+// attachment, not looking inside attached messages.
+func textPart(b *BodyStructure, subtype string) *BodyStructure {
+	if b.Parts != nil {
+		for _, part := range b.Parts {
+			if found := textPart(part, subtype); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	if strings.EqualFold(b.Type, "TEXT") && strings.EqualFold(b.Subtype, subtype) &&
+		!strings.EqualFold(b.Disposition, "attachment") {
+		return b
+	}
+	return nil
+}
+
+// MailAddress returns a as a net/mail address, or nil if it has no
+// address, as with the group markers of RFC 5322 group syntax.
+func (a Address) MailAddress() *mail.Address {
+	if a.Address == "" {
+		return nil
+	}
+	return &mail.Address{Name: a.Name, Address: a.Address}
+}
+
+// MailHeader returns the header lines e was made from, for code built
+// around net/mail or net/textproto: From, To, Cc, Subject, Date,
+// Message-ID and In-Reply-To, those that are present.  Addresses are
+// formatted by net/mail, encoding names as needed, and the date is
+// reformatted to RFC 5322 if it can be parsed and kept as sent if not.
+func (e *ResponseFetchEnvelope) MailHeader() textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	addresses := func(key string, list []Address) {
+		var formatted []string
+		for _, a := range list {
+			if addr := a.MailAddress(); addr != nil {
+				formatted = append(formatted, addr.String())
+			}
+		}
+		if formatted != nil {
+			h.Set(key, strings.Join(formatted, ", "))
+		}
+	}
+	text := func(key string, value *string) {
+		if value != nil && *value != "" {
+			h.Set(key, *value)
+		}
+	}
+	addresses("From", e.From)
+	addresses("To", e.To)
+	addresses("Cc", e.Cc)
+	text("Subject", e.Subject)
+	if e.Date != nil {
+		date := *e.Date
+		if t, err := mail.ParseDate(date); err == nil {
+			date = t.Format(time.RFC1123Z)
+		}
+		text("Date", &date)
+	}
+	text("Message-ID", e.MessageId)
+	text("In-Reply-To", e.InReplyTo)
+	return h
+}
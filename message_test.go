@@ -0,0 +1,216 @@
+package imap
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchMessages(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 1:2 (FLAGS ENVELOPE UID)")
+	s.Send(`* 1 FETCH (FLAGS (\Seen $Forwarded) UID 101 ENVELOPE ("Wed, 7 Feb 2024 09:30:00 -0500" "Hi" (("Ann" NIL "ann" "example.com")) NIL NIL NIL NIL NIL NIL "<1@example.com>"))`)
+	s.Send(`* 2 FETCH (FLAGS () UID 102 ENVELOPE (NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL))`)
+	s.Done("OK FETCH completed")
+
+	msgs, err := im.FetchMessages("1:2", []string{"FLAGS", "ENVELOPE", "UID"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	m := msgs[0]
+	if m.SeqNum != 1 || m.UID != 101 || !reflect.DeepEqual(m.Flags, FlagSet{`\Seen`, "$Forwarded"}) {
+		t.Fatalf("unexpected message %#v", m)
+	}
+	if m.Envelope == nil || *m.Envelope.Subject != "Hi" || m.Envelope.From[0].Address != "ann@example.com" {
+		t.Fatalf("unexpected envelope %#v", m.Envelope)
+	}
+	if !m.InternalDate.IsZero() || m.Size != 0 || m.BodyStructure != nil {
+		t.Fatalf("unrequested fields set in %#v", m)
+	}
+	if m := msgs[1]; m.UID != 102 || m.Flags == nil || len(m.Flags) != 0 || m.Flags.Has(`\Seen`) {
+		t.Fatalf("unexpected message %#v", m)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchMessagesMacro(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 3 FAST")
+	s.Send(`* 3 FETCH (FLAGS (\Flagged) INTERNALDATE " 7-Feb-2024 09:30:00 -0500" RFC822.SIZE 4286)`)
+	s.Done("OK FETCH completed")
+
+	msgs, err := im.FetchMessages("3", []string{"FAST"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	date := time.Date(2024, 2, 7, 14, 30, 0, 0, time.UTC)
+	if m := msgs[0]; !m.Flags.Has(`\flagged`) || !m.InternalDate.Equal(date) || m.Size != 4286 || m.Envelope != nil {
+		t.Fatalf("unexpected message %#v", m)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchMessagesMerge(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("FETCH 1:3 (UID FLAGS RFC822.SIZE)")
+	s.Send(`* 2 FETCH (UID 12 FLAGS () RFC822.SIZE 200)`)
+	s.Send(`* 1 FETCH (UID 11 FLAGS (\Seen) RFC822.SIZE 100)`)
+	// A flags update for message 2, without its UID, then one with it.
+	s.Send(`* 2 FETCH (FLAGS (\Flagged))`)
+	s.Send(`* 3 FETCH (UID 13 FLAGS () RFC822.SIZE 300)`)
+	s.Send(`* 1 FETCH (FLAGS (\Seen \Answered) UID 11)`)
+	s.Done("OK FETCH completed")
+
+	msgs, err := im.FetchMessages("1:3", []string{"UID", "FLAGS", "RFC822.SIZE"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	expected := []*Message{
+		{SeqNum: 2, UID: 12, Flags: FlagSet{`\Flagged`}, Size: 200},
+		{SeqNum: 1, UID: 11, Flags: FlagSet{`\Seen`, `\Answered`}, Size: 100},
+		{SeqNum: 3, UID: 13, Flags: FlagSet{}, Size: 300},
+	}
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", msgs, expected)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchTextBody(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("UID FETCH 42 (UID BODYSTRUCTURE)")
+	s.Send(`* 3 FETCH (UID 42 BODYSTRUCTURE ((("TEXT" "PLAIN" ("CHARSET" "ISO-8859-1") NIL NIL "QUOTED-PRINTABLE" 27 1 NIL NIL NIL) ("TEXT" "HTML" ("CHARSET" "UTF-8") NIL NIL "7BIT" 40 1 NIL NIL NIL) "ALTERNATIVE" ("BOUNDARY" "b2") NIL NIL) ("TEXT" "PLAIN" ("NAME" "notes.txt") NIL NIL "BASE64" 8 1 NIL ("attachment" ("filename" "notes.txt")) NIL) "MIXED" ("BOUNDARY" "b1") NIL NIL))`)
+	s.Done("OK FETCH completed")
+	s.Expect("UID FETCH 42 (UID BODY.PEEK[1.1])")
+	s.Send("* 3 FETCH (UID 42 BODY[1.1] {23}\r\nCaf=E9 at noon?=\r\nSure.)")
+	s.Done("OK FETCH completed")
+
+	text, err := im.FetchTextBody(42)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if text != "Café at noon?Sure." {
+		t.Fatalf("unexpected text %q", text)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchTextBodySinglePart(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("UID FETCH 7 (UID BODYSTRUCTURE)")
+	s.Send(`* 1 FETCH (UID 7 BODYSTRUCTURE ("TEXT" "PLAIN" ("CHARSET" "UTF-8") NIL NIL "BASE64" 12 1))`)
+	s.Done("OK FETCH completed")
+	s.Expect("UID FETCH 7 (UID BODY.PEEK[1])")
+	s.Send("* 1 FETCH (UID 7 BODY[1] \"aMOpbGxv\")")
+	s.Done("OK FETCH completed")
+
+	text, err := im.FetchTextBody(7)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if text != "héllo" {
+		t.Fatalf("unexpected text %q", text)
+	}
+	waitFake(t, s)
+}
+
+func TestFetchTextBodyUnknownEncoding(t *testing.T) {
+	im, s := startFake(t)
+	var logged strings.Builder
+	im.Logger = log.New(&logged, "", 0)
+	s.Expect("UID FETCH 7 (UID BODYSTRUCTURE)")
+	s.Send(`* 1 FETCH (UID 7 BODYSTRUCTURE ("TEXT" "PLAIN" ("CHARSET" "UTF-8") NIL NIL "X-UUENCODE" 5 1))`)
+	s.Done("OK FETCH completed")
+	s.Expect("UID FETCH 7 (UID BODY.PEEK[1])")
+	s.Send("* 1 FETCH (UID 7 BODY[1] \"as is\")")
+	s.Done("OK FETCH completed")
+
+	text, err := im.FetchTextBody(7)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if text != "as is" || !strings.Contains(logged.String(), `"X-UUENCODE"`) {
+		t.Fatalf("unexpected text %q, warning %q", text, logged.String())
+	}
+	waitFake(t, s)
+}
+
+func TestEnvelopeMailHeader(t *testing.T) {
+	r := &reader{parser: newParser(strings.NewReader(`* 1 FETCH (ENVELOPE ("Wed, 7 Feb 2024 09:30:00 -0500 (EST)" "=?utf-8?q?caf=C3=A9?=" (("=?utf-8?q?Ren=C3=A9e?=" NIL "renee" "example.com")) NIL NIL (("Bob" NIL "bob" "example.org") ("Team" NIL NIL NIL) (NIL NIL "carol" "example.org") (NIL NIL NIL NIL)) NIL NIL "<0@example.com>" "<1@example.com>"))` + "\r\n"))}
+	_, resp, err := r.readResponse()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	env := resp.(*ResponseFetch).Envelope
+	h := env.MailHeader()
+
+	expected := textproto.MIMEHeader{
+		"From":        {"=?utf-8?q?Ren=C3=A9e?= <renee@example.com>"},
+		"To":          {`"Bob" <bob@example.org>, <carol@example.org>`},
+		"Subject":     {"=?utf-8?q?caf=C3=A9?="},
+		"Date":        {"Wed, 07 Feb 2024 09:30:00 -0500"},
+		"Message-Id":  {"<1@example.com>"},
+		"In-Reply-To": {"<0@example.com>"},
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Fatalf("expected %q, got %q", expected, h)
+	}
+	from, err := mail.ParseAddress(h.Get("From"))
+	if err != nil || from.Name != "Renée" {
+		t.Fatalf("From %q doesn't parse back: %v %v", h.Get("From"), from, err)
+	}
+	if to, err := mail.ParseAddressList(h.Get("To")); err != nil || len(to) != 2 {
+		t.Fatalf("To %q doesn't parse back: %v %v", h.Get("To"), to, err)
+	}
+	if _, err := mail.ParseDate(h.Get("Date")); err != nil {
+		t.Fatalf("Date: %s", err)
+	}
+
+	// A date the server mangled is passed on as is.
+	bad := "sometime"
+	env = ResponseFetchEnvelope{Date: &bad}
+	if h := env.MailHeader(); !reflect.DeepEqual(h, textproto.MIMEHeader{"Date": {"sometime"}}) {
+		t.Fatalf("unexpected header %q", h)
+	}
+}
+
+func TestFetchHeaderFieldsNot(t *testing.T) {
+	im, s := startFake(t)
+	header := "From: ann@example.com\r\nSubject: Hi\r\n\r\n"
+	s.Expect("FETCH 1 (UID BODY.PEEK[HEADER.FIELDS.NOT (RECEIVED DKIM-SIGNATURE)])")
+	s.Send(fmt.Sprintf("* 1 FETCH (UID 4 BODY[HEADER.FIELDS.NOT (Received DKIM-Signature)] {%d}\r\n%s)", len(header), header))
+	s.Done("OK FETCH completed")
+	s.Expect("FETCH 1 BODY.PEEK[HEADER.FIELDS (FROM)]")
+	s.Send("* 1 FETCH (BODY[HEADER.FIELDS (FROM)]<0> {23}\r\nFrom: ann@example.com\r\n FLAGS ())")
+	s.Done("OK FETCH completed")
+
+	section := HeaderFieldsNot("Received", "dkim-signature")
+	if section != "HEADER.FIELDS.NOT (RECEIVED DKIM-SIGNATURE)" {
+		t.Fatalf("unexpected section %q", section)
+	}
+	fetches, err := im.Fetch("1", []string{"UID", "BODY.PEEK[" + section + "]"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(fetches) != 1 || fetches[0].UID != 4 || string(fetches[0].Body[section]) != header {
+		t.Fatalf("unexpected fetch %#v", fetches)
+	}
+
+	// A partial origin after the section, and items after that.
+	fetches, err = im.Fetch("1", []string{"BODY.PEEK[" + HeaderFields("From") + "]"})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if string(fetches[0].Body["HEADER.FIELDS (FROM)"]) != "From: ann@example.com\r\n" || fetches[0].Flags == nil {
+		t.Fatalf("unexpected fetch %#v", fetches[0])
+	}
+	waitFake(t, s)
+}
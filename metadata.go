@@ -0,0 +1,167 @@
+package imap
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ResponseMetadata contains annotations of a mailbox, or of the server
+// if Mailbox is "", from METADATA (RFC 5464).  Entries maps entry
+// names (e.g. "/shared/comment") to their values, leaving out entries
+// without one.  A METADATA sent unasked only names the entries that
+// Changed, without their values.
+type ResponseMetadata struct {
+	Mailbox string
+	Entries map[string]string
+	Changed []string
+}
+
+func (r *reader) readMETADATA() *ResponseMetadata {
+	/*
+		metadata-resp   = "METADATA" SP mailbox SP
+		                  (entry-values / entry-list)
+		entry-values    = "(" entry-value *(SP entry-value) ")"
+		entry-value     = entry SP value
+		entry-list      = entry *(SP entry)
+		value           = nstring / literal8
+	*/
+	mailbox, err := r.readAstring()
+	check(err)
+	check(r.expect(" "))
+	resp := &ResponseMetadata{Mailbox: r.mailboxName(mailbox)}
+
+	c, err := r.ReadByte()
+	check(err)
+	check(r.UnreadByte())
+	if c != '(' {
+		for {
+			entry, err := r.readAstring()
+			check(err)
+			resp.Changed = append(resp.Changed, entry)
+			if !r.moreOnLine() {
+				return resp
+			}
+		}
+	}
+
+	values, err := r.readSexp()
+	check(err)
+	check(r.expectEOL())
+	if len(values)%2 != 0 {
+		panic(fmt.Errorf("bad METADATA entries %#v", values))
+	}
+	resp.Entries = make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		if values[i+1] != nil {
+			resp.Entries[sexpString(values[i])] = sexpString(values[i+1])
+		}
+	}
+	return resp
+}
+
+// GetMetadata returns the values of entries (e.g. "/private/comment")
+// on mailbox, keyed by entry name; entries without a value are left
+// out.  It needs the METADATA capability.
+func (imap *IMAP) GetMetadata(mailbox string, entries []string) (map[string]string, error) {
+	if err := imap.requireMetadata(false); err != nil {
+		return nil, err
+	}
+	return imap.getMetadata(imap.mailbox(mailbox), mailbox, entries)
+}
+
+// GetServerMetadata is GetMetadata for the server's own entries, such
+// as "/shared/admin" or a vendor's under "/shared/vendor/".  It needs
+// the METADATA or METADATA-SERVER capability.
+func (imap *IMAP) GetServerMetadata(entries []string) (map[string]string, error) {
+	if err := imap.requireMetadata(true); err != nil {
+		return nil, err
+	}
+	return imap.getMetadata(`""`, "", entries)
+}
+
+func (imap *IMAP) getMetadata(arg interface{}, mailbox string, entries []string) (map[string]string, error) {
+	parts := []interface{}{"GETMETADATA ", arg, " ("}
+	for i, entry := range entries {
+		if i > 0 {
+			parts = append(parts, " ")
+		}
+		parts = append(parts, astring(entry))
+	}
+	resp, err := imap.sendSync(append(parts, ")")...)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, extra := range resp.extra {
+		if m, ok := extra.(*ResponseMetadata); ok && m.Entries != nil && sameMailbox(m.Mailbox, mailbox) {
+			// The values may come in several responses.
+			for entry, value := range m.Entries {
+				values[entry] = value
+			}
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	return values, nil
+}
+
+// SetMetadata sets entries on mailbox to the values given, an empty
+// value removing the entry.  It needs the METADATA capability.
+func (imap *IMAP) SetMetadata(mailbox string, entries map[string]string) error {
+	if err := imap.requireMetadata(false); err != nil {
+		return err
+	}
+	return imap.setMetadata(imap.mailbox(mailbox), entries)
+}
+
+// SetServerMetadata is SetMetadata for the server's own entries.  It
+// needs the METADATA or METADATA-SERVER capability.
+func (imap *IMAP) SetServerMetadata(entries map[string]string) error {
+	if err := imap.requireMetadata(true); err != nil {
+		return err
+	}
+	return imap.setMetadata(`""`, entries)
+}
+
+func (imap *IMAP) setMetadata(arg interface{}, entries map[string]string) error {
+	names := make([]string, 0, len(entries))
+	for entry := range entries {
+		names = append(names, entry)
+	}
+	sort.Strings(names)
+
+	parts := []interface{}{"SETMETADATA ", arg, " ("}
+	for i, entry := range names {
+		if i > 0 {
+			parts = append(parts, " ")
+		}
+		parts = append(parts, astring(entry), " ")
+		if value := entries[entry]; value != "" {
+			parts = append(parts, astring(value))
+		} else {
+			parts = append(parts, "NIL")
+		}
+	}
+	resp, err := imap.sendSync(append(parts, ")")...)
+	if err != nil {
+		return err
+	}
+	for _, extra := range resp.extra {
+		imap.unsolicited(extra)
+	}
+	return nil
+}
+
+// requireMetadata fails unless the server has METADATA, or for the
+// server's entries, METADATA-SERVER.
+func (imap *IMAP) requireMetadata(server bool) error {
+	ok, err := imap.supports("METADATA")
+	if err != nil || ok {
+		return err
+	}
+	if server {
+		return imap.require("METADATA-SERVER")
+	}
+	return &CapabilityError{"METADATA"}
+}
@@ -0,0 +1,61 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetServerMetadata(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 METADATA-SERVER")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`GETMETADATA "" (/shared/comment /shared/admin /private/vendor/x-acme/quota)`)
+	s.Send(`* METADATA "" (/shared/comment "Shared comment" /private/vendor/x-acme/quota NIL)`)
+	s.Send("* METADATA \"\" (/shared/admin {40}\r\nAdmin: Ann <ann@example.com>\r\nHours: 9-5)")
+	// A change to a mailbox's entries, sent unasked.
+	s.Send(`* METADATA INBOX /shared/comment`)
+	s.Done("OK GETMETADATA complete")
+
+	values, err := im.GetServerMetadata([]string{"/shared/comment", "/shared/admin", "/private/vendor/x-acme/quota"})
+	if err != nil {
+		t.Fatalf("getmetadata: %s", err)
+	}
+	expected := map[string]string{
+		"/shared/comment": "Shared comment",
+		"/shared/admin":   "Admin: Ann <ann@example.com>\r\nHours: 9-5",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, values)
+	}
+	changed := &ResponseMetadata{Mailbox: "INBOX", Changed: []string{"/shared/comment"}}
+	if resp := <-im.Unsolicited; !reflect.DeepEqual(resp, changed) {
+		t.Fatalf("expected %#v, got %#v", changed, resp)
+	}
+
+	// METADATA-SERVER covers the server's entries alone.
+	if _, err := im.GetMetadata("INBOX", []string{"/private/comment"}); err == nil {
+		t.Fatalf("expected an error for a mailbox's entries without METADATA")
+	}
+	waitFake(t, s)
+}
+
+func TestSetServerMetadata(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 METADATA")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`SETMETADATA "" (/shared/comment "Back soon" /shared/vendor/x-acme NIL)`)
+	s.Done("OK SETMETADATA complete")
+	s.Expect(`SETMETADATA "Archive" (/private/comment {4}` + "\r\nn\xc3\xb8t)")
+	s.Done("OK SETMETADATA complete")
+
+	err := im.SetServerMetadata(map[string]string{"/shared/vendor/x-acme": "", "/shared/comment": "Back soon"})
+	if err != nil {
+		t.Fatalf("setmetadata: %s", err)
+	}
+	if err := im.SetMetadata("Archive", map[string]string{"/private/comment": "n\xc3\xb8t"}); err != nil {
+		t.Fatalf("setmetadata: %s", err)
+	}
+	waitFake(t, s)
+}
@@ -0,0 +1,74 @@
+package imap
+
+import "strings"
+
+// NotifySpec describes the events to ask for with Notify (RFC 5465).
+// No groups turns notifications off.
+type NotifySpec struct {
+	// Status asks for a STATUS of each mailbox watched, as a starting
+	// point for the changes that follow.
+	Status bool
+	Groups []NotifyGroup
+}
+
+// NotifyGroup is a set of mailboxes and the events to report on them.
+// Filter is one of "SELECTED", "SELECTED-DELAYED", "INBOXES",
+// "PERSONAL", "SUBSCRIBED", "SUBTREE" or "MAILBOXES"; the last two
+// apply to Mailboxes.  Events are event names, optionally with
+// arguments, such as "MessageNew (UID FLAGS)", "MessageExpunge",
+// "FlagChange" or "MailboxMetadataChange".  No events means NONE.
+type NotifyGroup struct {
+	Filter    string
+	Mailboxes []string
+	Events    []string
+}
+
+// format returns g as command parts for sendSync.
+func (g *NotifyGroup) format(imap *IMAP) []interface{} {
+	parts := []interface{}{"(" + g.Filter}
+	if len(g.Mailboxes) > 0 {
+		parts = append(parts, " (")
+		for i, name := range g.Mailboxes {
+			if i > 0 {
+				parts = append(parts, " ")
+			}
+			parts = append(parts, imap.mailbox(name))
+		}
+		parts = append(parts, ")")
+	}
+	events := "NONE"
+	if len(g.Events) > 0 {
+		events = "(" + strings.Join(g.Events, " ") + ")"
+	}
+	return append(parts, " "+events+")")
+}
+
+// Notify sets the events the server should report, with NOTIFY.  They
+// arrive on the Unsolicited channel as *ResponseExists, *ResponseExpunge,
+// *FlagUpdate and *ResponseFetch for the selected mailbox, and
+// *MailboxStatus or *ResponseList for others.  It needs the NOTIFY capability.
+func (imap *IMAP) Notify(spec NotifySpec) error {
+	if err := imap.require("NOTIFY"); err != nil {
+		return err
+	}
+	parts := []interface{}{"NOTIFY NONE"}
+	if len(spec.Groups) > 0 {
+		parts[0] = "NOTIFY SET"
+		if spec.Status {
+			parts[0] = "NOTIFY SET STATUS"
+		}
+		for _, g := range spec.Groups {
+			parts = append(parts, " ")
+			parts = append(parts, g.format(imap)...)
+		}
+	}
+
+	resp, err := imap.sendSync(parts...)
+	if err != nil {
+		return err
+	}
+	for _, extra := range resp.extra {
+		imap.unsolicited(extra)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNotifyMessageNew(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 NOTIFY")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`NOTIFY SET (SELECTED (MessageNew (UID FLAGS) MessageExpunge)) (MAILBOXES ("Lists") (MessageNew))`)
+	s.Done("OK NOTIFY completed")
+
+	err := im.Notify(NotifySpec{Groups: []NotifyGroup{
+		{Filter: "SELECTED", Events: []string{"MessageNew (UID FLAGS)", "MessageExpunge"}},
+		{Filter: "MAILBOXES", Mailboxes: []string{"Lists"}, Events: []string{"MessageNew"}},
+	}})
+	if err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+	waitFake(t, s)
+
+	s.Send("* 5 EXISTS")
+	s.Send(`* 5 FETCH (UID 120 FLAGS (\Recent))`)
+	s.Send(`* STATUS "Lists" (MESSAGES 8 UIDNEXT 40)`)
+	s.Send("* 2 EXPUNGE")
+
+	expected := []interface{}{
+		&ResponseExists{5},
+		&FlagUpdate{SeqNum: 5, UID: 120, Flags: FlagSet{`\Recent`}},
+		&MailboxStatus{Mailbox: "Lists", Messages: 8, UIDNext: 40},
+		&ResponseExpunge{2},
+	}
+	for _, want := range expected {
+		got := <-im.Unsolicited
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("DeepEqual(%#v, %#v)", got, want)
+		}
+	}
+	waitFake(t, s)
+}
+
+func TestNotifyNone(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 NOTIFY")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("NOTIFY NONE")
+	s.Done("OK NOTIFY completed")
+
+	if err := im.Notify(NotifySpec{}); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+	waitFake(t, s)
+}
@@ -3,11 +3,14 @@ package imap
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"fmt"
 	"io"
 	"log"
 	"errors"
 	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 func init() {
@@ -33,16 +36,134 @@ func nilOrString(s sexp) *string {
 	if s == nil {
 		return nil
 	}
-	str := s.(string)
+	// Literals too, as servers send long or 8-bit strings that way.
+	str := sexpString(s)
 	return &str
 }
 
+// Sexp is a parsed value of a response the package doesn't model, as
+// passed to an UnknownResponseHandler: a string for an atom, number or
+// quoted string, []byte for a literal, []Sexp for a parenthesized list,
+// or nil for NIL.
+type Sexp = sexp
+
 type parser struct {
 	*bufio.Reader
+	src     *errReader
+	lenient atomic.Bool // a bare LF ends a line too
 }
 
 func newParser(r io.Reader) *parser {
-	return &parser{bufio.NewReader(r)}
+	src := &errReader{r: r}
+	return &parser{Reader: bufio.NewReader(src), src: src}
+}
+
+// errReader remembers the first error from the underlying reader, so
+// that transport failures can be told apart from malformed input.
+type errReader struct {
+	r   io.Reader
+	err error
+
+	// keep, when keeping raw responses, holds what has been read from
+	// the start of the current response on, including what the
+	// parser has buffered.
+	keep *bytes.Buffer
+
+	// recent holds the last bytes read, for describing where parsing
+	// went wrong.
+	recent []byte
+}
+
+// maxRecent bounds errReader.recent, which is cut to half as much when
+// it outgrows it: still more than a bufio.Reader reads ahead, so there
+// are bytes before the parser's position to show.
+const maxRecent = 16384
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	if r.keep != nil {
+		r.keep.Write(p[:n])
+	}
+	r.recent = append(r.recent, p[:n]...)
+	if len(r.recent) > maxRecent {
+		r.recent = append(r.recent[:0], r.recent[len(r.recent)-maxRecent/2:]...)
+	}
+	return n, err
+}
+
+// snippetSize is how much of the input before a parse error a
+// ProtocolError shows.
+const snippetSize = 64
+
+// snippet returns the last bytes the parser took in, up to snippetSize.
+func (p *parser) snippet() []byte {
+	recent := p.src.recent
+	if n := len(recent) - p.Buffered(); n >= 0 {
+		recent = recent[:n]
+	}
+	if len(recent) > snippetSize {
+		recent = recent[len(recent)-snippetSize:]
+	}
+	return append([]byte(nil), recent...)
+}
+
+// keepRaw makes the parser keep the bytes of each response, for
+// rawBytes.  It must be called before anything is read.
+func (p *parser) keepRaw() {
+	p.src.keep = new(bytes.Buffer)
+}
+
+// startRaw marks the start of a response, dropping the bytes kept of
+// the one before.
+func (p *parser) startRaw() {
+	if keep := p.src.keep; keep != nil {
+		keep.Next(keep.Len() - p.Buffered())
+	}
+}
+
+// rawBytes returns a copy of the bytes read since startRaw, or nil if
+// they aren't being kept.
+func (p *parser) rawBytes() []byte {
+	keep := p.src.keep
+	if keep == nil {
+		return nil
+	}
+	raw := keep.Bytes()
+	return append([]byte(nil), raw[:len(raw)-p.Buffered()]...)
+}
+
+// inflate makes the parser decompress the rest of the stream, from
+// the bytes it has buffered on, as after COMPRESS DEFLATE.
+func (p *parser) inflate() {
+	buffered, _ := p.Peek(p.Buffered())
+	rest := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), p.src)
+	keep := p.src.keep
+	if keep != nil {
+		// What is kept from here on is decompressed.
+		p.src.keep = nil
+		keep.Reset()
+	}
+	p.src = &errReader{r: flate.NewReader(rest), keep: keep}
+	p.Reader.Reset(p.src)
+}
+
+// restart makes the parser read the rest of the stream from r, as
+// after STARTTLS.  Nothing may be buffered.
+func (p *parser) restart(r io.Reader) {
+	keep := p.src.keep
+	if keep != nil {
+		keep.Reset()
+	}
+	p.src = &errReader{r: r, keep: keep}
+	p.Reader.Reset(p.src)
+}
+
+// ioError returns the transport error that has been hit, if any.
+func (p *parser) ioError() error {
+	return p.src.err
 }
 
 func (p *parser) expect(text string) error {
@@ -61,9 +182,73 @@ func (p *parser) expect(text string) error {
 }
 
 func (p *parser) expectEOL() error {
+	if p.lenient.Load() {
+		c, err := p.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c == '\n' {
+			return nil
+		}
+		if err := p.UnreadByte(); err != nil {
+			return err
+		}
+	}
 	return p.expect("\r\n")
 }
 
+// skipSpaces consumes any spaces before the next token.
+func (p *parser) skipSpaces() error {
+	for {
+		c, err := p.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c != ' ' {
+			return p.UnreadByte()
+		}
+	}
+}
+
+// readWord is readToken for the words starting an untagged response,
+// the message number and the keyword, between which some servers put
+// runs of spaces or tabs: blanks are skipped before the word and after
+// it.
+func (p *parser) readWord() (word string, outErr error) {
+	defer recoverError(&outErr)
+
+	buf := bytes.NewBuffer(make([]byte, 0, 16))
+	for {
+		c, err := p.ReadByte()
+		check(err)
+		switch c {
+		case ' ', '\t':
+			if buf.Len() > 0 {
+				check(p.skipBlanks())
+				return buf.String(), nil
+			}
+			continue
+		case ']', '\r', '\n':
+			check(p.UnreadByte())
+			return buf.String(), nil
+		}
+		buf.WriteByte(c)
+	}
+}
+
+// skipBlanks consumes any spaces or tabs.
+func (p *parser) skipBlanks() error {
+	for {
+		c, err := p.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c != ' ' && c != '\t' {
+			return p.UnreadByte()
+		}
+	}
+}
+
 func (p *parser) readToken() (token string, outErr error) {
 	defer recoverError(&outErr)
 
@@ -74,7 +259,7 @@ func (p *parser) readToken() (token string, outErr error) {
 		switch c {
 		case ' ':
 			return buf.String(), nil
-		case ']', '\r':
+		case ']', '\r', '\n':
 			check(p.UnreadByte())
 			return buf.String(), nil
 		}
@@ -116,16 +301,28 @@ func (p *parser) readAtom() (outStr string, outErr error) {
 		c, err := p.ReadByte()
 		check(err)
 
-		switch c {
-		case '(', ')', '{', ' ',
-			// XXX: CTL
-			'%', '*', // list-wildcards
-			'"': // quoted-specials
+		// CTLs (including the CR of a line's CRLF) end an atom rather
+		// than being swallowed into it.  Bytes above 0x7F are let
+		// through for UTF-8 servers.
+		ctl := c < 0x20 || c == 0x7f
+
+		switch {
+		case c == '*' && atom.Len() == 1 && atom.Bytes()[0] == '\\':
+			// The flag-perm "\*" of PERMANENTFLAGS, which isn't
+			// otherwise an atom.
+			atom.WriteByte(c)
+			return atom.String(), nil
+		case ctl, c == '(', c == ')', c == '{', c == ' ',
+			c == '%', c == '*', // list-wildcards
+			c == '"': // quoted-specials
 			// XXX: note that I dropped '\' from the quoted-specials,
 			// because it conflicts with parsing flags.  Who knows.
 			// XXX: resp-specials
 			err = p.UnreadByte()
 			check(err)
+			if atom.Len() == 0 {
+				return "", fmt.Errorf("expected atom, got %q", c)
+			}
 			return atom.String(), nil
 		}
 
@@ -141,6 +338,11 @@ func (p *parser) readQuoted() (outStr string, outErr error) {
 	err := p.expect("\"")
 	check(err)
 
+	/*
+		quoted          = DQUOTE *QUOTED-CHAR DQUOTE
+		QUOTED-CHAR     = <any TEXT-CHAR except quoted-specials> /
+		                  "\\" quoted-specials
+	*/
 	quoted := bytes.NewBuffer(make([]byte, 0, 16))
 
 	for {
@@ -150,9 +352,19 @@ func (p *parser) readQuoted() (outStr string, outErr error) {
 		case '\\':
 			c, err = p.ReadByte()
 			check(err)
+			if c == '\r' || c == '\n' {
+				// The string ran off the end of the line, perhaps
+				// because its closing quote was escaped.
+				check(p.UnreadByte())
+				return "", fmt.Errorf("unterminated quoted string %q ending in a backslash", quoted.String())
+			}
 			if c != '"' && c != '\\' {
-				return "", fmt.Errorf("backslash-escaped %c", c)
+				return "", fmt.Errorf("invalid escape %q at offset %d of quoted string %q", []byte{'\\', c}, quoted.Len(), quoted.String())
 			}
+		case '\r', '\n':
+			// Left unread, so the line can be discarded.
+			check(p.UnreadByte())
+			return "", fmt.Errorf("unterminated quoted string %q", quoted.String())
 		case '"':
 			return quoted.String(), nil
 		}
@@ -176,7 +388,7 @@ func (p *parser) readLiteral() (literal []byte, outErr error) {
 	length, err := strconv.Atoi(string(lengthBytes[0 : len(lengthBytes)-1]))
 	check(err)
 
-	err = p.expect("\r\n")
+	err = p.expectEOL()
 	check(err)
 
 	literal = make([]byte, length)
@@ -186,6 +398,52 @@ func (p *parser) readLiteral() (literal []byte, outErr error) {
 	return
 }
 
+func (p *parser) readAstring() (str string, outErr error) {
+	/*
+		astring         = 1*ASTRING-CHAR / string
+	*/
+	defer recoverError(&outErr)
+
+	c, err := p.ReadByte()
+	check(err)
+	check(p.UnreadByte())
+
+	switch c {
+	case '"':
+		return p.readQuoted()
+	case '{':
+		literal, err := p.readLiteral()
+		return string(literal), err
+	}
+	return p.readAtom()
+}
+
+// readNstring reads a string, literal or NIL, returning nil for NIL.
+func (p *parser) readNstring() (data []byte, outErr error) {
+	/*
+		nstring         = string / nil
+	*/
+	defer recoverError(&outErr)
+
+	c, err := p.ReadByte()
+	check(err)
+	check(p.UnreadByte())
+
+	switch c {
+	case '"':
+		quoted, err := p.readQuoted()
+		return []byte(quoted), err
+	case '{':
+		return p.readLiteral()
+	}
+	atom, err := p.readAtom()
+	check(err)
+	if atom != "NIL" {
+		return nil, fmt.Errorf("expected string or NIL, got %q", atom)
+	}
+	return nil, nil
+}
+
 func (p *parser) readBracketed() (text string, outErr error) {
 	defer recoverError(&outErr)
 
@@ -224,8 +482,15 @@ func (p *parser) readSexp() (s []sexp, outErr error) {
 		default:
 			// TODO: may need to distinguish atom from string in practice.
 			p.UnreadByte()
-			exp, err = p.readAtom()
-			if exp == "NIL" {
+			var atom string
+			atom, err = p.readAtom()
+			if err == nil && strings.Contains(atom, "[") && !strings.Contains(atom, "]") {
+				// A FETCH key with a section holding a list, as in
+				// "BODY[HEADER.FIELDS (DATE FROM)]".
+				atom, err = p.readSectionRest(atom)
+			}
+			exp = atom
+			if atom == "NIL" {
 				exp = nil
 			}
 		}
@@ -244,6 +509,101 @@ func (p *parser) readSexp() (s []sexp, outErr error) {
 	panic("not reached")
 }
 
+// encodeSexp writes s in the syntax readSexp reads: nil as NIL, a
+// []sexp as a parenthesized list, a []byte as a literal, and a string
+// as an atom if it can be one, else as a quoted string, or as a
+// literal if it holds a byte a quoted string can't: NUL, CR, LF or
+// another control character, or one outside ASCII.  "NIL" and the
+// empty string are quoted, so they don't read back as NIL or nothing.
+func encodeSexp(w io.Writer, s sexp) (outErr error) {
+	defer recoverError(&outErr)
+
+	switch s := s.(type) {
+	case nil:
+		_, err := io.WriteString(w, "NIL")
+		check(err)
+	case []sexp:
+		_, err := io.WriteString(w, "(")
+		check(err)
+		for i, elem := range s {
+			if i > 0 {
+				_, err = io.WriteString(w, " ")
+				check(err)
+			}
+			check(encodeSexp(w, elem))
+		}
+		_, err = io.WriteString(w, ")")
+		check(err)
+	case []byte:
+		_, err := fmt.Fprintf(w, "{%d}\r\n", len(s))
+		check(err)
+		_, err = w.Write(s)
+		check(err)
+	case string:
+		var err error
+		switch {
+		case isAtom(s):
+			_, err = io.WriteString(w, s)
+		case needsLiteral(s):
+			err = encodeSexp(w, []byte(s))
+		default:
+			escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+			_, err = io.WriteString(w, `"`+escaped+`"`)
+		}
+		check(err)
+	default:
+		return fmt.Errorf("can't encode %T", s)
+	}
+	return nil
+}
+
+// needsLiteral reports whether s has a byte that can't go in a quoted
+// string, even escaped.
+func needsLiteral(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c >= 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// isAtom reports whether s reads back as the atom s.
+func isAtom(s string) bool {
+	if s == "" || strings.EqualFold(s, "NIL") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c >= 0x7f || strings.IndexByte(`(){%*"\[]`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readSectionRest reads the rest of a FETCH key after the atom that
+// starts it, up to the "]" closing its section and any partial origin
+// after that, as in "<0>".
+func (p *parser) readSectionRest(atom string) (key string, outErr error) {
+	defer recoverError(&outErr)
+
+	rest, err := p.ReadString(']')
+	check(err)
+	if strings.ContainsAny(rest, "\r\n") {
+		return "", fmt.Errorf("unterminated section in %q", atom+rest)
+	}
+	key = atom + rest
+	c, err := p.ReadByte()
+	check(err)
+	check(p.UnreadByte())
+	if c == '<' {
+		origin, err := p.ReadString('>')
+		check(err)
+		key += origin
+	}
+	return key, nil
+}
+
 func (p *parser) readParenStringList() ([]string, error) {
 	sexp, err := p.readSexp()
 	if err != nil {
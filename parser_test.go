@@ -3,12 +3,12 @@ package imap
 import (
 	"bytes"
 	"fmt"
-	"os"
+	"io"
 	"reflect"
 	"testing"
 )
 
-func testError(t *testing.T, err os.Error, format string, args ...interface{}) {
+func testError(t *testing.T, err error, format string, args ...interface{}) {
 	if err != nil {
 		t.Fatalf("%s: %s", fmt.Sprintf(format, args...), err)
 	}
@@ -16,12 +16,24 @@ func testError(t *testing.T, err os.Error, format string, args ...interface{}) {
 
 type parseTest struct {
 	input    string
-	code     func(p *parser) (interface{}, os.Error)
+	code     func(p *parser) (interface{}, error)
 	expected interface{}
 }
 
 func (test parseTest) Run(t *testing.T) {
-	p := newParser(bytes.NewBufferString(test.input))
+	test.run(t, bytes.NewBufferString(test.input))
+}
+
+// RunDripped runs the test with its input arriving a few bytes at a
+// time, in reads of each size from 1 to max.
+func (test parseTest) RunDripped(t *testing.T, max int) {
+	for n := 1; n <= max; n++ {
+		test.run(t, &dripReader{bytes.NewBufferString(test.input), n})
+	}
+}
+
+func (test parseTest) run(t *testing.T, r io.Reader) {
+	p := newParser(r)
 	ps, err := test.code(p)
 	if err != nil {
 		t.Fatalf("parsing %s: %s", test.input, err)
@@ -29,7 +41,7 @@ func (test parseTest) Run(t *testing.T) {
 
 	_, err = p.ReadByte()
 	if err != nil {
-		if err != os.EOF {
+		if err != io.EOF {
 			t.Fatalf("parsing %s: %s", test.input, err)
 		}
 	} else {
@@ -44,7 +56,7 @@ func (test parseTest) Run(t *testing.T) {
 func TestParseString(t *testing.T) {
 	parseTest{
 		input:    "\"foo bar\"",
-		code:     func(p *parser) (interface{}, os.Error) { return p.readQuoted() },
+		code:     func(p *parser) (interface{}, error) { return p.readQuoted() },
 		expected: "foo bar",
 	}.Run(t)
 }
@@ -53,13 +65,13 @@ func TestParseLiteral(t *testing.T) {
 	tests := []parseTest{
 		{
 			input:    "{5}\r\n01234",
-			code:     func(p *parser) (interface{}, os.Error) { return p.readLiteral() },
+			code:     func(p *parser) (interface{}, error) { return p.readLiteral() },
 			expected: []byte("01234"),
 		},
 
 		{
 			input:    "({2}\r\nAB abc)",
-			code:     func(p *parser) (interface{}, os.Error) { return p.readSexp() },
+			code:     func(p *parser) (interface{}, error) { return p.readSexp() },
 			expected: []sexp{[]byte("AB"), "abc"},
 		},
 	}
@@ -73,7 +85,7 @@ func TestParseSimple(t *testing.T) {
 	tests := []parseTest{
 		{
 			input: "(\\HasNoChildren \\Foo)",
-			code: func(p *parser) (interface{}, os.Error) {
+			code: func(p *parser) (interface{}, error) {
 				return p.readParenStringList()
 			},
 			expected: []string{"\\HasNoChildren", "\\Foo"},
@@ -88,7 +100,7 @@ func TestParseSimple(t *testing.T) {
 func TestParseComplex(t *testing.T) {
 	parseTest{
 		input: `(ENVELOPE ("Fri, 14 Oct 2011 13:51:22 -0700" "Re: [PATCH 1/1] added code to export CAP_LAST_CAP in /proc/sys/kernel modeled after ngroups_max" (("Andrew Morton" NIL "akpm" "linux-foundation.org")) ((NIL NIL "linux-kernel-owner" "vger.kernel.org")) (("Andrew Morton" NIL "akpm" "linux-foundation.org")) (("Dan Ballard" NIL "dan" "mindstab.net")) (("Ingo Molnar" NIL "mingo" "elte.hu") ("Lennart Poettering" NIL "lennart" "poettering.net") ("Kay Sievers" NIL "kay.sievers" "vrfy.org") (NIL NIL "linux-kernel" "vger.kernel.org")) NIL "<1318460194-31983-1-git-send-email-dan@mindstab.net>" "<20111014135122.4bb95565.akpm@linux-foundation.org>") FLAGS () INTERNALDATE "14-Oct-2011 20:51:30 +0000" RFC822.SIZE 4623)`,
-		code:  func(p *parser) (interface{}, os.Error) { return p.readSexp() },
+		code:  func(p *parser) (interface{}, error) { return p.readSexp() },
 
 		expected: []sexp{"ENVELOPE",
 			[]sexp{"Fri, 14 Oct 2011 13:51:22 -0700",
@@ -110,3 +122,293 @@ func TestParseComplex(t *testing.T) {
 		},
 	}.Run(t)
 }
+
+func TestParseAtomCTL(t *testing.T) {
+	p := newParser(bytes.NewBufferString("FOO\r\n"))
+	atom, err := p.readAtom()
+	if err != nil || atom != "FOO" {
+		t.Fatalf("expected atom FOO, got %q, %v", atom, err)
+	}
+	if err := p.expectEOL(); err != nil {
+		t.Fatalf("CRLF after atom not left unread: %s", err)
+	}
+
+	bad := []string{
+		"(FOO\x00BAR)",
+		"(\\Seen\r\n",
+		"(A\x7fB)",
+		"(\x01)",
+	}
+	for _, input := range bad {
+		p := newParser(bytes.NewBufferString(input))
+		if s, err := p.readSexp(); err == nil {
+			t.Fatalf("parsing %q: expected error, got %#v", input, s)
+		}
+	}
+
+	parseTest{
+		input: "(\\Seen \\Answered $Forwarded caf\xc3\xa9)",
+		code: func(p *parser) (interface{}, error) {
+			return p.readParenStringList()
+		},
+		expected: []string{"\\Seen", "\\Answered", "$Forwarded", "caf\xc3\xa9"},
+	}.Run(t)
+}
+
+func TestParseQuotedInvalid(t *testing.T) {
+	parseTest{
+		input:    `"say \"hi\" \\ bye"`,
+		code:     func(p *parser) (interface{}, error) { return p.readQuoted() },
+		expected: `say "hi" \ bye`,
+	}.Run(t)
+
+	tests := []struct {
+		input, err string
+	}{
+		{`"ab\ncd"`, `invalid escape "\\n" at offset 2 of quoted string "ab"`},
+		{"\"ab\r\ncd\"", `unterminated quoted string "ab"`},
+		{"\"ab\ncd\"", `unterminated quoted string "ab"`},
+		{"\"ab\\\r\n", `unterminated quoted string "ab" ending in a backslash`},
+		{"\"ab\\\"\r\n", `unterminated quoted string "ab\""`},
+	}
+	for _, test := range tests {
+		p := newParser(bytes.NewBufferString(test.input))
+		str, err := p.readQuoted()
+		if err == nil {
+			t.Fatalf("parsing %q: expected error, got %q", test.input, str)
+		}
+		if err.Error() != test.err {
+			t.Fatalf("parsing %q: expected error %q, got %q", test.input, test.err, err)
+		}
+	}
+
+	// The end of the line is left for the caller to discard.
+	p := newParser(bytes.NewBufferString("\"ab\r\n"))
+	p.readQuoted()
+	if err := p.expectEOL(); err != nil {
+		t.Fatalf("CRLF after unterminated string not left unread: %s", err)
+	}
+}
+
+func TestParseLiteralMidList(t *testing.T) {
+	header := "Subject: hi\r\nFrom: a@example.com\r\n\r\n"
+	parseTest{
+		input: "(BODY[HEADER] {" + fmt.Sprint(len(header)) + "}\r\n" + header + " FLAGS (\\Seen) UID {1}\r\n7)",
+		code:  func(p *parser) (interface{}, error) { return p.readSexp() },
+		expected: []sexp{
+			"BODY[HEADER]", []byte(header),
+			"FLAGS", []sexp{"\\Seen"},
+			"UID", []byte("7"),
+		},
+	}.Run(t)
+}
+
+// dripReader hands out the bytes of r at most n at a time, as a
+// connection does when a response comes in many small segments.
+type dripReader struct {
+	r io.Reader
+	n int
+}
+
+func (d *dripReader) Read(p []byte) (int, error) {
+	if len(p) > d.n {
+		p = p[:d.n]
+	}
+	return d.r.Read(p)
+}
+
+func TestParseLiteralDripped(t *testing.T) {
+	// Longer than the bufio buffer, so it can't be had in one fill.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 600)
+	tests := []parseTest{
+		{
+			input:    "{5}\r\n01234",
+			code:     func(p *parser) (interface{}, error) { return p.readLiteral() },
+			expected: []byte("01234"),
+		},
+		{
+			input:    "{0}\r\n",
+			code:     func(p *parser) (interface{}, error) { return p.readLiteral() },
+			expected: []byte{},
+		},
+		{
+			input:    "{12}\r\n{3}\r\nabc\r\n\r\n",
+			code:     func(p *parser) (interface{}, error) { return p.readLiteral() },
+			expected: []byte("{3}\r\nabc\r\n\r\n"),
+		},
+		{
+			input:    fmt.Sprintf("{%d}\r\n%s", len(big), big),
+			code:     func(p *parser) (interface{}, error) { return p.readLiteral() },
+			expected: big,
+		},
+		{
+			input:    "{4}\r\nso }",
+			code:     func(p *parser) (interface{}, error) { return p.readAstring() },
+			expected: "so }",
+		},
+		{
+			input:    "{3}\r\nNIL",
+			code:     func(p *parser) (interface{}, error) { return p.readNstring() },
+			expected: []byte("NIL"),
+		},
+		{
+			input:    "({2}\r\nAB abc {1}\r\n) ({0}\r\n))",
+			code:     func(p *parser) (interface{}, error) { return p.readSexp() },
+			expected: []sexp{[]byte("AB"), "abc", []byte(")"), []sexp{[]byte{}}},
+		},
+	}
+	for _, test := range tests {
+		test.RunDripped(t, 5)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	tests := []parseTest{
+		{
+			input:    "{0}\r\n",
+			code:     func(p *parser) (interface{}, error) { return p.readLiteral() },
+			expected: []byte{},
+		},
+		{
+			// The empty literal takes nothing of what follows.
+			input:    "(A {0}\r\n B {0}\r\n{1}\r\nC)",
+			code:     func(p *parser) (interface{}, error) { return p.readSexp() },
+			expected: []sexp{"A", []byte{}, "B", []byte{}, []byte("C")},
+		},
+		{
+			input:    "()",
+			code:     func(p *parser) (interface{}, error) { return p.readSexp() },
+			expected: []sexp{},
+		},
+		{
+			input:    "(() (()) A ())",
+			code:     func(p *parser) (interface{}, error) { return p.readSexp() },
+			expected: []sexp{[]sexp{}, []sexp{[]sexp{}}, "A", []sexp{}},
+		},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	p := newParser(bytes.NewBufferString("({0}\r\n ())"))
+	s, err := p.readSexp()
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if s[0].([]byte) == nil || s[1].([]sexp) == nil {
+		t.Fatalf("empty elements read as nil: %#v", s)
+	}
+
+	// NIL and an empty string stay apart.
+	if nilOrString(nil) != nil {
+		t.Fatalf("NIL read as a string")
+	}
+	for _, empty := range []sexp{"", []byte{}} {
+		if str := nilOrString(empty); str == nil || *str != "" {
+			t.Fatalf("empty string %#v read as %v", empty, str)
+		}
+	}
+}
+
+// sexpFromBytes builds a list from fuzz input, each byte choosing what
+// comes next in it: the end of the list, a nested list, NIL, or a
+// string or literal of the bytes after it.
+func sexpFromBytes(data []byte, depth int) ([]sexp, []byte) {
+	list := []sexp{}
+	for len(data) > 0 {
+		op := data[0]
+		data = data[1:]
+		switch op % 5 {
+		case 0:
+			return list, data
+		case 1:
+			if depth < 10 {
+				var nested []sexp
+				nested, data = sexpFromBytes(data, depth+1)
+				list = append(list, nested)
+			}
+		case 2:
+			list = append(list, nil)
+		case 3, 4:
+			n := int(op/5) % 16
+			if n > len(data) {
+				n = len(data)
+			}
+			if op%5 == 3 {
+				list = append(list, string(data[:n]))
+			} else {
+				list = append(list, append([]byte{}, data[:n]...))
+			}
+			data = data[n:]
+		}
+	}
+	return list, data
+}
+
+// sameSexp reports whether got is what reading want back should give:
+// the same tree, with strings holding a control character or a byte
+// outside ASCII read as literals.
+func sameSexp(want, got sexp) bool {
+	switch want := want.(type) {
+	case nil:
+		return got == nil
+	case []sexp:
+		list, ok := got.([]sexp)
+		if !ok || list == nil || len(list) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !sameSexp(want[i], list[i]) {
+				return false
+			}
+		}
+		return true
+	case []byte:
+		b, ok := got.([]byte)
+		return ok && b != nil && bytes.Equal(b, want)
+	case string:
+		for i := 0; i < len(want); i++ {
+			if c := want[i]; c < ' ' || c >= 0x7f {
+				b, ok := got.([]byte)
+				return ok && string(b) == want
+			}
+		}
+		str, ok := got.(string)
+		return ok && str == want
+	}
+	return false
+}
+
+func FuzzSexpRoundTrip(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"\x03",                        // an empty string
+		"\x04",                        // an empty literal
+		"\x02\x01\x00\x02",            // NIL, (), NIL
+		"\x12NIL",                     // the string "NIL"
+		"\x26a\r\nb\x00",              // a string needing a literal
+		"\x12a\x00b",                  // a NUL
+		"\x12a\tb",                    // another control character
+		"\x1ccaf\xc3\xa9",             // 8-bit
+		"\x2b\"q\\x)\"",               // quotes, backslashes and parens
+		"\x01\x12abc\x01\x02\x00\x00", // nesting
+		"\x1cBODY[",                   // an atom that isn't
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		want, _ := sexpFromBytes(data, 0)
+		var buf bytes.Buffer
+		if err := encodeSexp(&buf, want); err != nil {
+			t.Fatalf("encode %#v: %s", want, err)
+		}
+		encoded := buf.String()
+		got, err := newParser(&buf).readSexp()
+		if err != nil {
+			t.Fatalf("read %q back: %s", encoded, err)
+		}
+		if !sameSexp(want, got) {
+			t.Fatalf("%#v encoded as %q read back as %#v", want, encoded, got)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ConnPool keeps authenticated connections for reuse, keyed by
+// account.  Servers limit how many logins an account may have at once,
+// so the pool opens at most Max connections per account (unlimited if
+// Max is 0), and Get waits for one to be returned once that many are
+// checked out.
+//
+// A connection is checked with NOOP before it is handed out again, and
+// dropped if that fails or it has been idle for longer than
+// IdleTimeout (if set).
+type ConnPool struct {
+	// Dial opens a new connection for account, started and logged in.
+	Dial        func(ctx context.Context, account string) (*IMAP, error)
+	Max         int
+	IdleTimeout time.Duration
+
+	lock     sync.Mutex
+	accounts map[string]*accountPool
+	owners   map[*IMAP]string // account of each checked out connection
+	closed   bool
+}
+
+// ErrPoolClosed is returned by Get once the pool has been closed.
+var ErrPoolClosed = errors.New("imap: connection pool closed")
+
+// accountPool holds one account's connections.
+type accountPool struct {
+	idle  []idleConn // most recently returned last
+	open  int        // connections checked out or idle
+	freed chan struct{}
+}
+
+type idleConn struct {
+	imap  *IMAP
+	since time.Time
+}
+
+// NewConnPool returns a pool opening up to max connections per account
+// with dial.
+func NewConnPool(dial func(ctx context.Context, account string) (*IMAP, error), max int) *ConnPool {
+	return &ConnPool{Dial: dial, Max: max}
+}
+
+// Get returns a live connection for account, reusing an idle one if
+// there is one and otherwise dialing, unless the account has all the
+// connections it may.  The connection must be given back with Put.
+func (p *ConnPool) Get(ctx context.Context, account string) (*IMAP, error) {
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, ErrPoolClosed
+		}
+		a := p.account(account)
+		a.evict(p.IdleTimeout)
+		if n := len(a.idle); n > 0 {
+			imap := a.idle[n-1].imap
+			a.idle = a.idle[:n-1]
+			p.lock.Unlock()
+			if err := noopContext(ctx, imap); err != nil {
+				p.discard(account, imap)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+			p.checkOut(account, imap)
+			return imap, nil
+		}
+
+		if p.Max <= 0 || a.open < p.Max {
+			a.open++
+			p.lock.Unlock()
+			imap, err := p.Dial(ctx, account)
+			if err != nil {
+				p.lock.Lock()
+				a.release()
+				p.lock.Unlock()
+				return nil, err
+			}
+			p.checkOut(account, imap)
+			return imap, nil
+		}
+
+		freed := a.waiter()
+		p.lock.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// noopContext runs a NOOP, giving up and closing the connection if ctx
+// is done first.
+func noopContext(ctx context.Context, imap *IMAP) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- imap.Noop()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// Closing the connection makes the NOOP fail.
+		imap.close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Put returns a connection got from Get to the pool.  Connections that
+// have died are dropped.
+func (p *ConnPool) Put(imap *IMAP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	account, ok := p.owners[imap]
+	if !ok {
+		panic("imap: Put of a connection not from this pool")
+	}
+	delete(p.owners, imap)
+	a := p.accounts[account]
+	if p.closed || imap.dead() != nil {
+		imap.close()
+		a.release()
+		return
+	}
+	a.idle = append(a.idle, idleConn{imap, time.Now()})
+	a.wake()
+	a.evict(p.IdleTimeout)
+}
+
+// Close drops the idle connections, and makes later calls to Get fail,
+// including those waiting for a connection.  Connections still checked
+// out are dropped when they are returned.
+func (p *ConnPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, a := range p.accounts {
+		for _, c := range a.idle {
+			c.imap.close()
+			a.open--
+		}
+		a.idle = nil
+		a.wake()
+	}
+	p.closed = true
+}
+
+// account returns the connections of account.  The lock must be held.
+func (p *ConnPool) account(account string) *accountPool {
+	a := p.accounts[account]
+	if a == nil {
+		if p.accounts == nil {
+			p.accounts = make(map[string]*accountPool)
+		}
+		a = &accountPool{}
+		p.accounts[account] = a
+	}
+	return a
+}
+
+func (p *ConnPool) checkOut(account string, imap *IMAP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.owners == nil {
+		p.owners = make(map[*IMAP]string)
+	}
+	p.owners[imap] = account
+}
+
+// discard closes a connection of account that is no longer counted as
+// idle.
+func (p *ConnPool) discard(account string, imap *IMAP) {
+	imap.close()
+	p.lock.Lock()
+	p.accounts[account].release()
+	p.lock.Unlock()
+}
+
+// evict drops connections idle for longer than timeout, if it is set.
+// The pool's lock must be held, as for the methods below.
+func (a *accountPool) evict(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	// The oldest connections are at the front.
+	n := 0
+	for n < len(a.idle) && time.Since(a.idle[n].since) > timeout {
+		a.idle[n].imap.close()
+		a.release()
+		n++
+	}
+	a.idle = a.idle[n:]
+}
+
+// release gives up a connection's place in the pool.
+func (a *accountPool) release() {
+	a.open--
+	a.wake()
+}
+
+// waiter returns a channel that is closed when a connection is
+// returned or released.
+func (a *accountPool) waiter() chan struct{} {
+	if a.freed == nil {
+		a.freed = make(chan struct{})
+	}
+	return a.freed
+}
+
+// wake wakes the callers blocked in Get.
+func (a *accountPool) wake() {
+	if a.freed != nil {
+		close(a.freed)
+		a.freed = nil
+	}
+}
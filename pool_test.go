@@ -0,0 +1,155 @@
+package imap
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakePool returns a pool whose connections go to FakeServers sent on
+// servers as they are dialed.
+func fakePool(t *testing.T, max int) (*ConnPool, chan *FakeServer) {
+	servers := make(chan *FakeServer, 10)
+	dial := func(ctx context.Context, account string) (*IMAP, error) {
+		im, s := startFake(t)
+		servers <- s
+		return im, nil
+	}
+	return NewConnPool(dial, max), servers
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	p, servers := fakePool(t, 1)
+
+	im, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	s := <-servers
+	s.Expect("NOOP")
+	s.Done("OK NOOP completed")
+
+	// The pool is full until the connection is returned.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx, "alice"); err != context.DeadlineExceeded {
+		t.Fatalf("get from a full pool: %v", err)
+	}
+
+	p.Put(im)
+	again, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if again != im {
+		t.Fatalf("connection not reused")
+	}
+	p.Put(again)
+	waitFake(t, s)
+}
+
+func TestConnPoolEvictClosed(t *testing.T) {
+	p, servers := fakePool(t, 1)
+
+	im, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	(<-servers).Close()
+	p.Put(im)
+
+	again, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if again == im {
+		t.Fatalf("closed connection reused")
+	}
+	<-servers
+}
+
+func TestConnPoolIdleTimeout(t *testing.T) {
+	p, servers := fakePool(t, 0)
+	p.IdleTimeout = time.Millisecond
+
+	im, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	<-servers
+	p.Put(im)
+	time.Sleep(5 * time.Millisecond)
+
+	again, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if again == im {
+		t.Fatalf("expired connection reused")
+	}
+	// The read thread notices the close in its own time.
+	for i := 0; im.dead() == nil; i++ {
+		if i == 100 {
+			t.Fatalf("expired connection left open")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnPoolAccounts(t *testing.T) {
+	p, servers := fakePool(t, 1)
+
+	alice, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	<-servers
+	// Each account has its own limit.
+	bob, err := p.Get(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	<-servers
+	if alice == bob {
+		t.Fatalf("accounts share a connection")
+	}
+}
+
+func TestConnPoolCloseWakes(t *testing.T) {
+	p, servers := fakePool(t, 1)
+	if _, err := p.Get(context.Background(), "alice"); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	<-servers
+
+	errs := make(chan error)
+	go func() {
+		_, err := p.Get(context.Background(), "alice")
+		errs <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	p.Close()
+	if err := <-errs; err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestConnPoolNoopDeadline(t *testing.T) {
+	p, servers := fakePool(t, 1)
+	im, err := p.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	s := <-servers
+	s.Expect("NOOP") // never answered, as on a half-open connection
+	p.Put(im)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx, "alice"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+	if im.dead() == nil {
+		t.Fatalf("unresponsive connection left open")
+	}
+}
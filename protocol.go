@@ -1,9 +1,16 @@
 package imap
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Status represents server status codes which are returned by
@@ -14,6 +21,7 @@ const (
 	OK Status = iota
 	NO
 	BAD
+	BYE // untagged only: the server is closing the connection
 )
 
 func (s Status) String() string {
@@ -21,6 +29,7 @@ func (s Status) String() string {
 		"OK",
 		"NO",
 		"BAD",
+		"BYE",
 	}[s]
 }
 
@@ -32,6 +41,30 @@ type ResponseStatus struct {
 	code   interface{}
 	text   string
 	extra  []interface{}
+	tagged bool   // completes a command, as opposed to "* OK ..."
+	raw    []byte // the line as read, under KeepRaw
+}
+
+// Status returns the response's status: OK, NO or BAD.
+func (r *ResponseStatus) Status() Status {
+	return r.status
+}
+
+// Code returns the response code, e.g. "READ-WRITE" or a
+// *ResponseUIDNext, or nil if there was none.
+func (r *ResponseStatus) Code() interface{} {
+	return r.code
+}
+
+// Raw returns the response exactly as it was read, if the client's
+// KeepRaw was set, and nil otherwise.
+func (r *ResponseStatus) Raw() []byte {
+	return r.raw
+}
+
+// Text returns the human-readable text following the status and code.
+func (r *ResponseStatus) Text() string {
+	return r.text
 }
 
 func (r *ResponseStatus) String() string {
@@ -39,16 +72,47 @@ func (r *ResponseStatus) String() string {
 }
 
 // IMAPError is an error returned for IMAP-level errors, such
-// as "unknown mailbox".
+// as "unknown mailbox".  Code holds the response code, if any (for
+// example "TRYCREATE").
 type IMAPError struct {
 	Status Status
 	Text   string
+	Code   interface{}
 }
 
 func (e *IMAPError) Error() string {
+	if code, ok := e.Code.(string); ok {
+		return fmt.Sprintf("imap: %s [%s] %s", e.Status, code, e.Text)
+	}
 	return fmt.Sprintf("imap: %s %s", e.Status, e.Text)
 }
 
+// ProtocolError is the error of a response that couldn't be parsed:
+// the server and the client are out of step, or the server is broken.
+// It says what was expected and what came instead, with the input the
+// parser last took in, for bug reports.
+type ProtocolError struct {
+	Tag     string // of the command in flight, or "" if none was
+	Snippet []byte // the bytes read up to the failure, at most 64
+	Err     error  // what went wrong, e.g. `expected ")", got "x"`
+}
+
+func (e *ProtocolError) Error() string {
+	where := "unsolicited response"
+	if e.Tag != "" {
+		where = "response to " + e.Tag
+	}
+	return fmt.Sprintf("imap: protocol error in %s: %s, after %q", where, e.Err, e.Snippet)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// DateTimeLayout is the time.Format layout of the date-time of APPEND,
+// INTERNALDATE and SAVEDATE.
+const DateTimeLayout = "_2-Jan-2006 15:04:05 -0700"
+
 const (
 	WildcardAny          = "%"
 	WildcardAnyRecursive = "*"
@@ -56,65 +120,221 @@ const (
 
 type tag int
 
-const untagged = tag(-1)
+const (
+	untagged     = tag(-1)
+	continuation = tag(-2)
+	badTag       = tag(-3) // a line that is neither "*", "+" nor a valid tag
+)
+
+func (t tag) String() string {
+	switch t {
+	case untagged:
+		return "*"
+	case continuation:
+		return "+"
+	case badTag:
+		return "?"
+	}
+	return fmt.Sprintf("a%d", int(t))
+}
+
+// ResponseContinuation is a continuation request ("+ text"), which
+// asks for the rest of the command being sent.  Text is a SASL
+// challenge in base64, or for literals and IDLE just a message.
+type ResponseContinuation struct {
+	Text string
+}
+
+// readContinuation reads the rest of a continuation request after its
+// "+".  The request may be a bare "+", with or without a space.
+func (r *reader) readContinuation() (string, error) {
+	text, err := r.readToEOL()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimLeft(text, " "), nil
+}
 
 type reader struct {
 	*parser
+	utf8    atomic.Bool // UTF8=ACCEPT is enabled, so names aren't encoded
+	unknown atomic.Pointer[UnknownResponseHandler]
+
+	// lenientFlags takes a lone flag without parentheses for a list.
+	lenientFlags atomic.Bool
+
+	// searchNum, if set, is given each number of a SEARCH response
+	// in place of collecting them.
+	searchNum atomic.Pointer[func(num int)]
 }
 
+// An UnknownResponseHandler is given the untagged responses the package
+// doesn't recognize, such as those of extensions it doesn't model.
+// keyword names the response, as "XFOO" for "* XFOO (1 2)" or
+// "* 3 XFOO"; data is what follows the keyword, parsed, or nil if it
+// couldn't be; and raw is the whole response, without its CRLF.
+//
+// The handler runs on the goroutine reading the connection, so it
+// should not block or send commands.
+type UnknownResponseHandler func(keyword string, data []Sexp, raw string)
+
 // Read a full response (e.g. "* OK foobar\r\n").
 func (r *reader) readResponse() (tag, interface{}, error) {
-	tag, err := r.readTag()
+	r.startRaw()
+	tag, resp, err := r.readOne()
+	for err == nil && tag == untagged && resp == nil {
+		// An unknown response, already handled; the caller wants
+		// the next.
+		r.startRaw()
+		tag, resp, err = r.readOne()
+	}
+	switch resp := resp.(type) {
+	case *ResponseFetch:
+		resp.Raw = r.rawBytes()
+	case *ResponseStatus:
+		resp.raw = r.rawBytes()
+	}
+	return tag, resp, err
+}
+
+func (r *reader) readOne() (tag, interface{}, error) {
+	tag, status, err := r.readTag()
 	if err != nil {
-		return untagged, nil, err
+		return tag, nil, err
 	}
 
-	if tag == untagged {
+	// On a parse error the tag is still returned, so that the caller
+	// knows which line it was in the middle of.
+	switch tag {
+	case untagged:
 		resp, err := r.readUntagged()
 		if err != nil {
-			return untagged, nil, err
+			return tag, nil, err
 		}
+		// resp is nil for an unknown response.
 		return tag, resp, nil
-	} else {
-		resp, err := r.readStatus("")
+	case continuation:
+		text, err := r.readContinuation()
 		if err != nil {
-			return untagged, nil, err
+			return tag, nil, err
 		}
+		if status != "" {
+			// Text run into the "+", as in "+Ready".
+			text = strings.TrimSpace(status + " " + text)
+		}
+		return tag, &ResponseContinuation{text}, nil
+	default:
+		// Some servers pad the tag with extra spaces; put up with it.
+		if status == "" {
+			if err := r.skipSpaces(); err != nil {
+				return tag, nil, err
+			}
+		}
+		resp, err := r.readStatus(status)
+		if err != nil {
+			return tag, nil, err
+		}
+		resp.tagged = true
 		return tag, resp, nil
 	}
 
 	panic("not reached")
 }
 
+// maxResync bounds how much input is discarded while looking for the
+// completion of a command whose response failed to parse.
+const maxResync = 1 << 20
+
+// Discard input up to and including the tagged completion of command t,
+// after a parse error left the reader somewhere inside its response.
+func (r *reader) resync(t tag) error {
+	prefix := []byte(t.String() + " ")
+	discarded := 0
+	full := false
+	for discarded < maxResync {
+		line, err := r.ReadSlice('\n')
+		discarded += len(line)
+		if err == bufio.ErrBufferFull {
+			full = true
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !full && bytes.HasPrefix(line, prefix) {
+			return nil
+		}
+		full = false
+	}
+	return fmt.Errorf("no completion for %s within %d bytes of parse error", t, maxResync)
+}
+
+// Discard the rest of the current line.
+func (r *reader) discardLine() error {
+	for {
+		_, err := r.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
 // Read the tag, the first part of the response.
-// Expects either "*" or "a123".
-func (r *reader) readTag() (tag, error) {
+// Expects either "*" or "a123".  A line starting with anything else
+// is reported as badTag, since it may be a mangled completion.
+//
+// Some servers leave out the space after a tag, as in "a5OK"; the
+// status is then returned too, as is any text run into a "+".
+func (r *reader) readTag() (tag, string, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return badTag, "", err
+	}
+	if c == '*' {
+		// The blanks that follow are readUntagged's to skip.
+		return untagged, "", nil
+	}
+	if err := r.UnreadByte(); err != nil {
+		return badTag, "", err
+	}
+
 	str, err := r.readToken()
 	if err != nil {
-		return untagged, err
+		return badTag, "", err
 	}
 	if len(str) == 0 {
-		return untagged, errors.New("read empty tag")
+		return badTag, "", errors.New("read empty tag")
 	}
 
 	switch str[0] {
-	case '*':
-		return untagged, nil
+	case '+':
+		return continuation, str[1:], nil
 	case 'a':
-		tagnum, err := strconv.Atoi(str[1:])
+		digits := 1
+		for digits < len(str) && str[digits] >= '0' && str[digits] <= '9' {
+			digits++
+		}
+		status := str[digits:]
+		switch strings.ToUpper(status) {
+		case "", "OK", "NO", "BAD":
+		default:
+			return badTag, "", fmt.Errorf("bad tag %q", str)
+		}
+		tagnum, err := strconv.Atoi(str[1:digits])
 		if err != nil {
-			return untagged, err
+			return badTag, "", err
 		}
-		return tag(tagnum), nil
+		return tag(tagnum), status, nil
 	}
 
-	return untagged, fmt.Errorf("unexpected response %q", str)
+	return badTag, "", fmt.Errorf("unexpected response %q", str)
 }
 
 // ResponsePermanentFlags contains the flags the client can change
-// permanently.
+// permanently.  AllowCustom reports the special flag "\*", meaning new
+// keywords may be created by storing them; it is not included in Flags.
 type ResponsePermanentFlags struct {
-	Flags []string
+	Flags       []string
+	AllowCustom bool
 }
 
 // ResponseUIDValidity contains the unique identifier validity value.
@@ -129,6 +349,38 @@ type ResponseUIDNext struct {
 	Value int
 }
 
+// ResponseUnseen contains the number of the first unseen message, as
+// SELECT reports it.
+type ResponseUnseen struct {
+	Value int
+}
+
+// ResponseHighestModSeq contains the highest mod-sequence of the
+// selected mailbox, from CONDSTORE (RFC 7162).
+type ResponseHighestModSeq struct {
+	Value uint64
+}
+
+// ResponseUIDNotSticky reports that the selected mailbox doesn't keep
+// its UIDs from one session to the next, from UIDPLUS (RFC 4315).
+type ResponseUIDNotSticky struct{}
+
+// ResponseAppendUID contains the UID assigned to an appended message,
+// from UIDPLUS (RFC 4315).  UIDs is a uid-set if several messages were
+// appended at once.
+type ResponseAppendUID struct {
+	UIDValidity int
+	UIDs        string
+}
+
+// ResponseCopyUID contains the UIDs assigned by a COPY, as uid-set
+// strings.  See RFC 4315 section 3.
+type ResponseCopyUID struct {
+	UIDValidity int
+	Source      string
+	Dest        string
+}
+
 // Read a status response, one starting with OK/NO/BAD.
 func (r *reader) readStatus(statusStr string) (resp *ResponseStatus, outErr error) {
 	defer func() {
@@ -151,9 +403,11 @@ func (r *reader) readStatus(statusStr string) (resp *ResponseStatus, outErr erro
 		"OK":  OK,
 		"NO":  NO,
 		"BAD": BAD,
+		"BYE": BYE,
 	}
 
-	status, known := statusStrs[statusStr]
+	// Matched without regard to case, as a few servers send "ok".
+	status, known := statusStrs[strings.ToUpper(statusStr)]
 	if !known {
 		panic(fmt.Errorf("unexpected status %q", statusStr))
 	}
@@ -166,13 +420,22 @@ func (r *reader) readStatus(statusStr string) (resp *ResponseStatus, outErr erro
 	} else {
 		codeStr, err := r.readToken()
 		check(err)
+		codeStr = codeName(codeStr)
 
 		switch codeStr {
 		case "PERMANENTFLAGS":
 			/* "PERMANENTFLAGS" SP "(" [flag-perm *(SP flag-perm)] ")" */
 			flags, err := r.readParenStringList()
 			check(err)
-			code = &ResponsePermanentFlags{flags}
+			perm := &ResponsePermanentFlags{Flags: make([]string, 0, len(flags))}
+			for _, flag := range flags {
+				if flag == "\\*" {
+					perm.AllowCustom = true
+				} else {
+					perm.Flags = append(perm.Flags, flag)
+				}
+			}
+			code = perm
 			check(r.expect("]"))
 		case "UIDVALIDITY":
 			num, err := r.readNumber()
@@ -184,6 +447,50 @@ func (r *reader) readStatus(statusStr string) (resp *ResponseStatus, outErr erro
 			check(err)
 			code = &ResponseUIDNext{num}
 			check(r.expect("]"))
+		case "UNSEEN":
+			num, err := r.readNumber()
+			check(err)
+			code = &ResponseUnseen{num}
+			check(r.expect("]"))
+		case "HIGHESTMODSEQ":
+			/* "HIGHESTMODSEQ" SP mod-sequence-value */
+			num, err := r.readToken()
+			check(err)
+			modseq, err := strconv.ParseUint(num, 10, 64)
+			check(err)
+			code = &ResponseHighestModSeq{modseq}
+			check(r.expect("]"))
+		case "COPYUID":
+			/* "COPYUID" SP nz-number SP uid-set SP uid-set */
+			num, err := r.readNumber()
+			check(err)
+			check(r.expect(" "))
+			source, err := r.readToken()
+			check(err)
+			dest, err := r.readToken()
+			check(err)
+			code = &ResponseCopyUID{num, source, dest}
+			check(r.expect("]"))
+		case "APPENDUID":
+			/* "APPENDUID" SP nz-number SP append-uid */
+			num, err := r.readNumber()
+			check(err)
+			check(r.expect(" "))
+			uids, err := r.readToken()
+			check(err)
+			code = &ResponseAppendUID{num, uids}
+			check(r.expect("]"))
+		case "REFERRAL":
+			/* "REFERRAL" SP 1*<url> */
+			url, err := r.ReadString(']')
+			check(err)
+			code = &ResponseReferral{url[:len(url)-1]}
+		case "UIDNOTSTICKY":
+			code = &ResponseUIDNotSticky{}
+			check(r.expect("]"))
+		case "CAPABILITY":
+			code = &ResponseCapabilities{r.readCapabilities()}
+			check(r.expect("]"))
 		default:
 			text, err := r.ReadString(']')
 			check(err)
@@ -212,7 +519,33 @@ func (r *reader) readStatus(statusStr string) (resp *ResponseStatus, outErr erro
 	rest, err := r.readToEOL()
 	check(err)
 
-	return &ResponseStatus{status, code, rest, nil}, nil
+	return &ResponseStatus{status, code, rest, nil, false, nil}, nil
+}
+
+// knownCodes is the response codes the package knows, from RFC 3501
+// and the extensions it supports.
+var knownCodes = map[string]bool{
+	"ALERT": true, "BADCHARSET": true, "CAPABILITY": true, "PARSE": true,
+	"PERMANENTFLAGS": true, "READ-ONLY": true, "READ-WRITE": true,
+	"TRYCREATE": true, "UIDNEXT": true, "UIDVALIDITY": true, "UNSEEN": true,
+	"HIGHESTMODSEQ": true, "NOMODSEQ": true, "MODIFIED": true, "CLOSED": true,
+	"APPENDUID": true, "COPYUID": true, "UIDNOTSTICKY": true, "REFERRAL": true,
+	"UNAVAILABLE": true, "AUTHENTICATIONFAILED": true, "AUTHORIZATIONFAILED": true,
+	"EXPIRED": true, "PRIVACYREQUIRED": true, "CONTACTADMIN": true,
+	"NOPERM": true, "INUSE": true, "EXPUNGEISSUED": true, "CORRUPTION": true,
+	"SERVERBUG": true, "CLIENTBUG": true, "CANNOT": true, "LIMIT": true,
+	"OVERQUOTA": true, "ALREADYEXISTS": true, "NONEXISTENT": true,
+	"TOOBIG": true,
+}
+
+// codeName returns the name of a response code as the package matches
+// it: upper-cased if it is a known code, as a few servers send
+// "[Read-Write]", and otherwise as sent.
+func codeName(code string) string {
+	if upper := strings.ToUpper(code); knownCodes[upper] {
+		return upper
+	}
+	return code
 }
 
 // ResponseCapabilities contains the server capability list from a
@@ -222,67 +555,151 @@ type ResponseCapabilities struct {
 }
 
 func (r *reader) readCAPABILITY() *ResponseCapabilities {
+	caps := r.readCapabilities()
+	check(r.expectEOL())
+	return &ResponseCapabilities{caps}
+}
+
+// moreOnLine consumes the space before another item on the line and
+// reports whether there is one; at the end of the line it consumes the
+// CRLF.
+func (r *reader) moreOnLine() bool {
+	c, err := r.ReadByte()
+	check(err)
+	if c == ' ' {
+		return true
+	}
+	check(r.UnreadByte())
+	check(r.expectEOL())
+	return false
+}
+
+// readCapabilities reads a capability list, up to the end of the line
+// or of the response code it is in.  Stray spaces are skipped.
+func (r *reader) readCapabilities() []string {
+	/* capability-data = "CAPABILITY" *(SP capability) */
 	caps := make([]string, 0)
 	for {
+		peek, err := r.ReadByte()
+		check(err)
+		check(r.UnreadByte())
+		if peek == ']' || peek == '\r' || peek == '\n' {
+			return caps
+		}
 		cap, err := r.readToken()
 		check(err)
-		if len(cap) == 0 {
-			break
+		if cap != "" {
+			caps = append(caps, cap)
 		}
-		caps = append(caps, cap)
 	}
-	check(r.expectEOL())
-	return &ResponseCapabilities{caps}
+}
+
+// ResponseEnabled contains the extensions an ENABLE turned on (RFC
+// 5161).
+type ResponseEnabled struct {
+	Capabilities []string
+}
+
+func (r *reader) readENABLED() *ResponseEnabled {
+	// Same syntax as CAPABILITY.
+	return &ResponseEnabled{r.readCAPABILITY().Capabilities}
 }
 
 // ResponseList contains the list metadata from a LIST message.
+// Attributes holds every attribute as sent, including ones without a
+// field here.  ChildInfo holds the selection options matched by
+// children, from the RFC 5258 CHILDINFO extended data.
 type ResponseList struct {
 	Inferiors,
 	Selectable,
 	Marked,
-	Children *bool
-	Delim string
-	Name  string
+	Children,
+	Subscribed *bool
+	Delim      string
+	Name       string
+	Attributes []string
+	ChildInfo  []string
 }
 
 func (r *reader) readLIST() *ResponseList {
 	// "(" [mbx-list-flags] ")" SP (DQUOTE QUOTED-CHAR DQUOTE / nil) SP mailbox
+	//   [SP "(" mbox-list-extended-item *(SP mbox-list-extended-item) ")"]
 	flags, err := r.readParenStringList()
 	check(err)
 	r.expect(" ")
 
-	delim, err := r.readQuoted()
+	var delim string
+	peek, err := r.ReadByte()
 	check(err)
+	check(r.UnreadByte())
+	if peek == '"' {
+		delim, err = r.readQuoted()
+		check(err)
+	} else {
+		// A flat namespace has no delimiter.
+		atom, err := r.readAtom()
+		check(err)
+		if atom != "NIL" {
+			panic(fmt.Errorf("bad list delimiter %q", atom))
+		}
+	}
 	r.expect(" ")
 
-	name, err := r.readQuoted()
+	name, err := r.readAstring()
 	check(err)
 
+	list := &ResponseList{Delim: string(delim), Name: r.mailboxName(name), Attributes: flags}
+
+	c, err := r.ReadByte()
+	check(err)
+	if c == ' ' {
+		extended, err := r.readSexp()
+		check(err)
+		if len(extended)%2 != 0 {
+			panic(errors.New("list extended data must have even number of items"))
+		}
+		for i := 0; i < len(extended); i += 2 {
+			tag, _ := extended[i].(string)
+			if strings.EqualFold(tag, "CHILDINFO") {
+				info, ok := extended[i+1].([]sexp)
+				if !ok {
+					panic(fmt.Errorf("bad CHILDINFO %#v", extended[i+1]))
+				}
+				for _, opt := range info {
+					if opt, ok := opt.(string); ok {
+						list.ChildInfo = append(list.ChildInfo, opt)
+					}
+				}
+			}
+		}
+	} else {
+		check(r.UnreadByte())
+	}
 	check(r.expectEOL())
 
-	list := &ResponseList{Delim: string(delim), Name: string(name)}
 	for _, flag := range flags {
-		switch flag {
-		case "\\Noinferiors":
+		switch strings.ToLower(flag) {
+		case "\\noinferiors":
 			b := false
 			list.Inferiors = &b
-		case "\\Noselect":
+		case "\\noselect", "\\nonexistent":
 			b := false
 			list.Selectable = &b
-		case "\\Marked":
+		case "\\marked":
 			b := true
 			list.Marked = &b
-		case "\\Unmarked":
+		case "\\unmarked":
 			b := false
 			list.Marked = &b
-		case "\\HasChildren":
+		case "\\haschildren":
 			b := true
 			list.Children = &b
-		case "\\HasNoChildren":
+		case "\\hasnochildren":
 			b := false
 			list.Children = &b
-		default:
-			panic(fmt.Sprintf("unknown list flag %q", flag))
+		case "\\subscribed":
+			b := true
+			list.Subscribed = &b
 		}
 	}
 	return list
@@ -294,6 +711,17 @@ type ResponseFlags struct {
 }
 
 func (r *reader) readFLAGS() *ResponseFlags {
+	if r.lenientFlags.Load() {
+		c, err := r.ReadByte()
+		check(err)
+		check(r.UnreadByte())
+		if c != '(' {
+			flag, err := r.readAtom()
+			check(err)
+			check(r.expectEOL())
+			return &ResponseFlags{[]string{flag}}
+		}
+	}
 	flags, err := r.readParenStringList()
 	check(err)
 	check(r.expectEOL())
@@ -307,68 +735,482 @@ type ResponseFetchEnvelope struct {
 	From, Sender, ReplyTo, To, Cc, Bcc  []Address
 }
 
+func envelopeFromSexp(s sexp) ResponseFetchEnvelope {
+	env, ok := s.([]sexp)
+	// This format is insane.
+	if !ok || len(env) != 10 {
+		panic(fmt.Errorf("envelope needed 10 fields, got %#v", s))
+	}
+	var e ResponseFetchEnvelope
+	e.Date = nilOrString(env[0])
+	e.Subject = nilOrString(env[1])
+	e.From = addressListFromSexp(env[2])
+	e.Sender = addressListFromSexp(env[3])
+	e.ReplyTo = addressListFromSexp(env[4])
+	e.To = addressListFromSexp(env[5])
+	e.Cc = addressListFromSexp(env[6])
+	e.Bcc = addressListFromSexp(env[7])
+	e.InReplyTo = nilOrString(env[8])
+	e.MessageId = nilOrString(env[9])
+	return e
+}
+
 // ResponseFetch contains the message data from a FETCH message.
 type ResponseFetch struct {
 	Msg                  int
+	UID                  int
 	Flags                sexp
 	Envelope             ResponseFetchEnvelope
+	BodyStructure        *BodyStructure
 	InternalDate         string
 	Size                 int
 	Rfc822, Rfc822Header []byte
+	Body                 map[string][]byte // BODY[section] by upper-cased section, e.g. "HEADER"
+	ModSeq               uint64            // from CONDSTORE (RFC 7162)
+	SaveDate             time.Time         // from SAVEDATE (RFC 8514); zero if NIL
+	Preview              string            // from PREVIEW (RFC 8970); "" if NIL
+	Raw                  []byte            // the response as read, literals and all, under KeepRaw
+
+	flagsOnly bool // just FLAGS, with UID and MODSEQ at most
 }
 
 func (r *reader) readFETCH(num int) *ResponseFetch {
 	s, err := r.readSexp()
 	check(err)
 	if len(s)%2 != 0 {
-		panic("fetch sexp must have even number of items")
+		panic(errors.New("fetch sexp must have even number of items"))
 	}
 	fetch := &ResponseFetch{Msg: num}
 	for i := 0; i < len(s); i += 2 {
 		key := s[i].(string)
 		switch key {
 		case "ENVELOPE":
-			env := s[i+1].([]sexp)
-			// This format is insane.
-			if len(env) != 10 {
-				panic(fmt.Sprintf("envelope needed 10 fields, had %d", len(env)))
-			}
-			fetch.Envelope.Date = nilOrString(env[0])
-			fetch.Envelope.Subject = nilOrString(env[1])
-			fetch.Envelope.From = addressListFromSexp(env[2])
-			fetch.Envelope.Sender = addressListFromSexp(env[3])
-			fetch.Envelope.ReplyTo = addressListFromSexp(env[4])
-			fetch.Envelope.To = addressListFromSexp(env[5])
-			fetch.Envelope.Cc = addressListFromSexp(env[6])
-			fetch.Envelope.Bcc = addressListFromSexp(env[7])
-			fetch.Envelope.InReplyTo = nilOrString(env[8])
-			fetch.Envelope.MessageId = nilOrString(env[9])
+			fetch.Envelope = envelopeFromSexp(s[i+1])
+		case "BODYSTRUCTURE", "BODY":
+			// BODY is BODYSTRUCTURE without the extension data.
+			fetch.BodyStructure = parseBodyStructure(s[i+1])
 		case "FLAGS":
 			fetch.Flags = s[i+1]
+			if flag, ok := s[i+1].(string); ok && r.lenientFlags.Load() {
+				fetch.Flags = []sexp{flag}
+			} else if _, ok := s[i+1].([]sexp); !ok {
+				panic(fmt.Errorf("bad FETCH FLAGS %#v", s[i+1]))
+			}
 		case "INTERNALDATE":
 			fetch.InternalDate = s[i+1].(string)
+		case "PREVIEW":
+			/* "PREVIEW" SP nstring */
+			fetch.Preview = sexpString(s[i+1])
+		case "SAVEDATE":
+			if s[i+1] != nil {
+				fetch.SaveDate, err = time.Parse(DateTimeLayout, sexpString(s[i+1]))
+				check(err)
+			}
 		case "RFC822":
-			fetch.Rfc822 = s[i+1].([]byte)
+			fetch.Rfc822 = sexpBytes(s[i+1])
 		case "RFC822.HEADER":
-			fetch.Rfc822Header = s[i+1].([]byte)
+			fetch.Rfc822Header = sexpBytes(s[i+1])
 		case "RFC822.SIZE":
 			fetch.Size, err = strconv.Atoi(s[i+1].(string))
 			check(err)
+		case "UID":
+			fetch.UID = sexpNumber(s[i+1])
+		case "MODSEQ":
+			/* "MODSEQ" SP "(" permsg-modsequence ")" */
+			modseq, ok := s[i+1].([]sexp)
+			if !ok || len(modseq) != 1 {
+				panic(fmt.Errorf("bad fetch modseq %#v", s[i+1]))
+			}
+			fetch.ModSeq, err = strconv.ParseUint(sexpString(modseq[0]), 10, 64)
+			check(err)
 		default:
-			panic(fmt.Sprintf("unhandled fetch key %#v", key))
+			if section, ok := bodySection(key); ok {
+				if fetch.Body == nil {
+					fetch.Body = make(map[string][]byte)
+				}
+				fetch.Body[section] = sexpBytes(s[i+1])
+				break
+			}
+			panic(fmt.Errorf("unhandled fetch key %#v", key))
 		}
 	}
 	check(r.expectEOL())
+	fetch.flagsOnly = fetch.Flags != nil
+	for i := 0; i < len(s); i += 2 {
+		switch s[i].(string) {
+		case "FLAGS", "UID", "MODSEQ":
+		default:
+			fetch.flagsOnly = false
+		}
+	}
 	return fetch
 }
 
+// FlagUpdate reports new flags for a message, as servers do unasked
+// when a message's flags change: a FETCH of FLAGS alone, or with the
+// UID (zero if not sent) and mod-sequence.  It stands in for such
+// FETCH responses on the Unsolicited channel.
+type FlagUpdate struct {
+	SeqNum int
+	UID    int
+	Flags  FlagSet
+	ModSeq uint64
+}
+
+// Alert is a message RFC 3501 says must be shown to the user, such as
+// a warning that the mailbox is nearly full: an untagged OK, NO, BAD
+// or BYE with the ALERT code.  It stands in for such responses on the
+// Unsolicited channel, whenever they arrive.
+type Alert struct {
+	Status Status
+	Text   string
+}
+
+// unilateral returns the form r takes as an update the client didn't
+// ask for: a *FlagUpdate for a bare flag change, an *Alert for an
+// [ALERT], or r itself.
+func unilateral(r interface{}) interface{} {
+	switch resp := r.(type) {
+	case *ResponseFetch:
+		if resp.flagsOnly {
+			return &FlagUpdate{resp.Msg, resp.UID, flagSet(resp.Flags), resp.ModSeq}
+		}
+	case *ResponseStatus:
+		if !resp.tagged && resp.code == "ALERT" {
+			return &Alert{resp.status, resp.text}
+		}
+	}
+	return r
+}
+
+// bodySection returns the section of a "BODY[section]" fetch key,
+// which may end in a partial origin such as "<0>".  It is upper-cased,
+// as servers may echo header field names in any case.
+func bodySection(key string) (string, bool) {
+	if !strings.HasPrefix(key, "BODY[") {
+		return "", false
+	}
+	end := strings.LastIndexByte(key, ']')
+	if end < 0 {
+		return "", false
+	}
+	return strings.ToUpper(key[len("BODY["):end]), true
+}
+
+// MailboxStatus contains the mailbox data from a STATUS message.
+// Items that weren't returned are zero.
+type MailboxStatus struct {
+	Mailbox     string
+	Messages    int
+	Recent      int
+	UIDNext     int
+	UIDValidity int
+	Unseen      int
+	Size        uint64  // total size in bytes, from STATUS=SIZE
+	AppendLimit *uint32 // from APPENDLIMIT; nil if unlimited or not returned
+
+	// HighestModSeq is from CONDSTORE; 0 if the mailbox doesn't keep
+	// mod-sequences.
+	HighestModSeq uint64
+}
+
+func (r *reader) readSTATUS() *MailboxStatus {
+	// "STATUS" SP mailbox SP "(" [status-att-list] ")"
+	mailbox, err := r.readAstring()
+	check(err)
+	check(r.expect(" "))
+	items, err := r.readSexp()
+	check(err)
+	check(r.expectEOL())
+	if len(items)%2 != 0 {
+		panic(errors.New("status items must have even number of items"))
+	}
+
+	status := &MailboxStatus{Mailbox: r.mailboxName(mailbox)}
+	for i := 0; i < len(items); i += 2 {
+		key, ok := items[i].(string)
+		if !ok {
+			panic(fmt.Errorf("bad status item %#v", items[i]))
+		}
+		if items[i+1] == nil && strings.EqualFold(key, "APPENDLIMIT") {
+			// No limit.
+			continue
+		}
+		value, ok := items[i+1].(string)
+		if !ok {
+			panic(fmt.Errorf("bad status value %#v", items[i+1]))
+		}
+		num, err := strconv.ParseUint(value, 10, 64)
+		check(err)
+		switch strings.ToUpper(key) {
+		case "MESSAGES":
+			status.Messages = int(num)
+		case "RECENT":
+			status.Recent = int(num)
+		case "UIDNEXT":
+			status.UIDNext = int(num)
+		case "UIDVALIDITY":
+			status.UIDValidity = int(num)
+		case "UNSEEN":
+			status.Unseen = int(num)
+		case "SIZE":
+			status.Size = num
+		case "APPENDLIMIT":
+			if num > math.MaxUint32 {
+				panic(fmt.Errorf("APPENDLIMIT %s out of range", value))
+			}
+			limit := uint32(num)
+			status.AppendLimit = &limit
+		case "HIGHESTMODSEQ":
+			status.HighestModSeq = num
+		}
+	}
+	return status
+}
+
+// ResponseComparator contains the active collation from a COMPARATOR
+// message, plus the comparators matching the command's arguments, if
+// the server listed them.  See RFC 5255 section 4.7.
+type ResponseComparator struct {
+	Active    string
+	Available []string
+}
+
+func (r *reader) readCOMPARATOR() *ResponseComparator {
+	// "COMPARATOR" SP comp-sel-quoted [SP "(" comp-id-quoted
+	//   *(SP comp-id-quoted) ")"]
+	active, err := r.readAstring()
+	check(err)
+	resp := &ResponseComparator{Active: active}
+
+	c, err := r.ReadByte()
+	check(err)
+	if c == ' ' {
+		resp.Available, err = r.readParenStringList()
+		check(err)
+	} else {
+		check(r.UnreadByte())
+	}
+	check(r.expectEOL())
+	return resp
+}
+
+// ResponseSearch contains the message numbers from a SEARCH message.
+// ModSeq is the highest mod-sequence of the matches, sent when the
+// search criteria involve MODSEQ (RFC 7162 section 3.1.5).
+type ResponseSearch struct {
+	Nums   []int
+	ModSeq uint64
+}
+
+func (r *reader) readSEARCH() *ResponseSearch {
+	// "SEARCH" *(SP nz-number) [SP "(" "MODSEQ" SP mod-sequence-value ")"]
+	// The numbers are read one at a time, as the line may run to
+	// megabytes.
+	resp := &ResponseSearch{Nums: make([]int, 0)}
+	fn := r.searchNum.Load()
+	for {
+		c, err := r.ReadByte()
+		check(err)
+		switch {
+		case c == ' ':
+			continue
+		case c >= '0' && c <= '9':
+			check(r.UnreadByte())
+			num, err := r.readNumber()
+			check(err)
+			if fn != nil {
+				(*fn)(num)
+			} else {
+				resp.Nums = append(resp.Nums, num)
+			}
+		case c == '(':
+			// The number list stops here; the modseq follows.
+			check(r.UnreadByte())
+			s, err := r.readSexp()
+			check(err)
+			if len(s) != 2 || !strings.EqualFold(sexpString(s[0]), "MODSEQ") {
+				panic(fmt.Errorf("bad search modseq %#v", s))
+			}
+			resp.ModSeq, err = strconv.ParseUint(sexpString(s[1]), 10, 64)
+			check(err)
+		default:
+			check(r.UnreadByte())
+			check(r.expectEOL())
+			return resp
+		}
+	}
+}
+
+// ResponseESearch contains the data from an ESEARCH message
+// (RFC 4731).  Tag is the tag of the command it answers, and All is a
+// sequence set such as "1:3,5".
+type ResponseESearch struct {
+	Tag    string
+	UID    bool
+	Min    int
+	Max    int
+	Count  int
+	All    string
+	ModSeq uint64
+
+	Partial *ESearchPartial
+
+	// Updates are the ADDTO and REMOVEFROM changes to the results of
+	// a search or sort with the UPDATE return option (RFC 5267), in
+	// the order sent.
+	Updates []ESearchUpdate
+}
+
+// ESearchUpdate is an ADDTO or REMOVEFROM update: Nums joined or left
+// the results, starting at Position (from 1, or 0 if not known).  For
+// a sort, Nums are in sort order and their positions consecutive.
+type ESearchUpdate struct {
+	Removed  bool
+	Position int
+	Nums     []uint32
+}
+
+func (r *reader) readESEARCH() *ResponseESearch {
+	// "ESEARCH" [search-correlator] [SP "UID"]
+	//   *(SP search-return-data)
+	resp := &ResponseESearch{}
+	for {
+		c, err := r.ReadByte()
+		check(err)
+		if c == ' ' {
+			continue
+		}
+		check(r.UnreadByte())
+		if c == '\r' || c == '\n' {
+			break
+		}
+
+		if c == '(' {
+			// search-correlator = SP "(" "TAG" SP tag-string ")"
+			s, err := r.readSexp()
+			check(err)
+			if len(s) != 2 || !strings.EqualFold(sexpString(s[0]), "TAG") {
+				panic(fmt.Errorf("bad search correlator %#v", s))
+			}
+			resp.Tag = sexpString(s[1])
+			continue
+		}
+
+		key, err := r.readAtom()
+		check(err)
+		key = strings.ToUpper(key)
+		if key == "UID" {
+			resp.UID = true
+			continue
+		}
+		check(r.expect(" "))
+		c, err = r.ReadByte()
+		check(err)
+		check(r.UnreadByte())
+		if c == '(' {
+			switch key {
+			case "PARTIAL":
+				resp.Partial = r.readPartial()
+			case "ADDTO", "REMOVEFROM":
+				resp.Updates = append(resp.Updates, r.readUpdates(key == "REMOVEFROM")...)
+			default:
+				// Some extension's return data; skip it.
+				_, err := r.readSexp()
+				check(err)
+			}
+			continue
+		}
+		value, err := r.readAtom()
+		check(err)
+
+		switch key {
+		case "MIN":
+			resp.Min, err = strconv.Atoi(value)
+		case "MAX":
+			resp.Max, err = strconv.Atoi(value)
+		case "COUNT":
+			resp.Count, err = strconv.Atoi(value)
+		case "ALL":
+			resp.All = value
+		case "MODSEQ":
+			resp.ModSeq, err = strconv.ParseUint(value, 10, 64)
+		}
+		check(err)
+	}
+	check(r.expectEOL())
+	return resp
+}
+
+// ESearchPartial is the PARTIAL result of an ESEARCH (RFC 9394): the
+// matches numbered From to To in the full result, where negative
+// positions count from its end.  Set is nil if there were none.
+type ESearchPartial struct {
+	From, To int
+	Set      *SeqSet
+}
+
+func (r *reader) readPartial() *ESearchPartial {
+	// "PARTIAL" SP "(" partial-range SP (sequence-set / "NIL") ")"
+	s, err := r.readSexp()
+	check(err)
+	if len(s) != 2 {
+		panic(fmt.Errorf("bad partial result %#v", s))
+	}
+	var partial ESearchPartial
+	from, to, ok := strings.Cut(sexpString(s[0]), ":")
+	if !ok {
+		panic(fmt.Errorf("bad partial range %#v", s[0]))
+	}
+	partial.From, err = strconv.Atoi(from)
+	check(err)
+	partial.To, err = strconv.Atoi(to)
+	check(err)
+	if s[1] != nil {
+		partial.Set, err = ParseSeqSet(sexpString(s[1]))
+		check(err)
+	}
+	return &partial
+}
+
+func (r *reader) readUpdates(removed bool) []ESearchUpdate {
+	/*
+		ret-data-addto  = "ADDTO" SP "(" context-position SP sequence-set
+		                  *(SP context-position SP sequence-set) ")"
+		(and likewise for "REMOVEFROM")
+	*/
+	s, err := r.readSexp()
+	check(err)
+	if len(s) == 0 || len(s)%2 != 0 {
+		panic(fmt.Errorf("bad context update %#v", s))
+	}
+	var updates []ESearchUpdate
+	for i := 0; i < len(s); i += 2 {
+		pos, err := strconv.Atoi(sexpString(s[i]))
+		check(err)
+		set, err := ParseSeqSet(sexpString(s[i+1]))
+		check(err)
+		nums, err := sortedNums(set)
+		check(err)
+		updates = append(updates, ESearchUpdate{removed, pos, nums})
+	}
+	return updates
+}
+
+// ResponseExpunge reports that a message has been removed; the numbers
+// of the messages after it each go down by one.
+type ResponseExpunge struct {
+	Msg int
+}
+
 // ResponseExists contains the message count of a mailbox.
 type ResponseExists struct {
 	Count int
 }
 
 // ResponseRecent contains the number of messages with the recent
-// flag set.
+// flag set.  The count is advisory: IMAP4rev2 (RFC 9051) drops \Recent,
+// so servers may never send it, or always send 0.
 type ResponseRecent struct {
 	Count int
 }
@@ -384,17 +1226,50 @@ func (r *reader) readUntagged() (resp interface{}, outErr error) {
 		}
 	}()
 
-	command, err := r.readToken()
+	// Responses are routed on their whole keyword, which like all of
+	// IMAP's is case-insensitive; a message number comes first for
+	// those below.
+	command, err := r.readWord()
 	check(err)
 
-	switch command {
+	switch strings.ToUpper(command) {
 	case "CAPABILITY":
 		return r.readCAPABILITY(), nil
 	case "LIST":
 		return r.readLIST(), nil
 	case "FLAGS":
 		return r.readFLAGS(), nil
-	case "OK", "NO", "BAD":
+	case "STATUS":
+		return r.readSTATUS(), nil
+	case "COMPARATOR":
+		return r.readCOMPARATOR(), nil
+	case "ENABLED":
+		return r.readENABLED(), nil
+	case "SEARCH":
+		return r.readSEARCH(), nil
+	case "ESEARCH":
+		return r.readESEARCH(), nil
+	case "THREAD":
+		return r.readTHREAD(), nil
+	case "LISTRIGHTS":
+		return r.readLISTRIGHTS(), nil
+	case "MYRIGHTS":
+		return r.readMYRIGHTS(), nil
+	case "QUOTA":
+		return r.readQUOTA(), nil
+	case "QUOTAROOT":
+		return r.readQUOTAROOT(), nil
+	case "VANISHED":
+		return r.readVANISHED(), nil
+	case "METADATA":
+		return r.readMETADATA(), nil
+	case "XAPPLEPUSHSERVICE":
+		return r.readXAPPLEPUSHSERVICE(), nil
+	case "GENURLAUTH":
+		return r.readGENURLAUTH(), nil
+	case "URLFETCH":
+		return r.readURLFETCH(), nil
+	case "OK", "NO", "BAD", "BYE":
 		resp, err := r.readStatus(command)
 		check(err)
 		if resp.code == nil {
@@ -404,27 +1279,70 @@ func (r *reader) readUntagged() (resp interface{}, outErr error) {
 		case string:
 			// XXX write a parser for this code type.
 			return resp, nil
+		case *ResponseCapabilities:
+			// Typically on the greeting, whose text is wanted too.
+			return resp, nil
 		default:
 			return resp.code, nil
 		}
 	}
 
+	keyword, raw := command, "* "+command
 	num, err := strconv.Atoi(command)
 	if err == nil {
-		command, err := r.readToken()
+		command, err := r.readWord()
 		check(err)
+		keyword, raw = command, raw+" "+command
 
-		switch command {
+		switch strings.ToUpper(command) {
 		case "EXISTS":
 			check(r.expectEOL())
 			return &ResponseExists{num}, nil
 		case "RECENT":
 			check(r.expectEOL())
 			return &ResponseRecent{num}, nil
+		case "EXPUNGE":
+			check(r.expectEOL())
+			return &ResponseExpunge{num}, nil
 		case "FETCH":
 			return r.readFETCH(num), nil
 		}
 	}
 
-	return nil, fmt.Errorf("unhandled untagged response %s", command)
+	r.readUnknown(keyword, raw)
+	return nil, nil
+}
+
+// readUnknown reads the rest of an untagged response the package doesn't
+// recognize, which starts with raw, and gives it to the unknown response
+// handler, if any.
+func (r *reader) readUnknown(keyword, raw string) {
+	rest, err := r.readToEOL()
+	check(err)
+	// The response may go on after literals.
+	for tail := rest; ; {
+		n, ok := literalLength(tail)
+		if !ok {
+			break
+		}
+		data := make([]byte, n)
+		_, err = io.ReadFull(r, data)
+		check(err)
+		tail, err = r.readToEOL()
+		check(err)
+		rest += "\r\n" + string(data) + tail
+	}
+
+	handler := r.unknown.Load()
+	if handler == nil {
+		return
+	}
+	if rest != "" {
+		raw += " " + rest
+	}
+	data, err := newParser(strings.NewReader("(" + rest + ")")).readSexp()
+	if err != nil {
+		data = nil
+	}
+	(*handler)(keyword, data, raw)
 }
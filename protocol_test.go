@@ -2,8 +2,14 @@ package imap
 
 import (
 	"bytes"
-	"testing"
+	"fmt"
+	"io"
+	"math"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
 )
 
 type readerTest struct {
@@ -13,7 +19,7 @@ type readerTest struct {
 }
 
 func (rt readerTest) Run(t *testing.T) {
-	r := &reader{newParser(bytes.NewBufferString(rt.input))}
+	r := &reader{parser: newParser(bytes.NewBufferString(rt.input))}
 	tag, resp, err := r.readResponse()
 	check(err)
 	if tag != rt.expectedTag {
@@ -38,7 +44,17 @@ func TestProtocol(t *testing.T) {
 		readerTest{
 			"* OK [PERMANENTFLAGS ()] Flags permitted.\r\n",
 			untagged,
-			&ResponsePermanentFlags{[]string{}},
+			&ResponsePermanentFlags{Flags: []string{}},
+		},
+		readerTest{
+			"* OK [PERMANENTFLAGS (\\Deleted \\Seen)] Limited\r\n",
+			untagged,
+			&ResponsePermanentFlags{Flags: []string{"\\Deleted", "\\Seen"}},
+		},
+		readerTest{
+			"* OK [PERMANENTFLAGS (\\Deleted \\Seen \\*)] Limited\r\n",
+			untagged,
+			&ResponsePermanentFlags{[]string{"\\Deleted", "\\Seen"}, true},
 		},
 		readerTest{
 			"* OK [UIDVALIDITY 2] UIDs valid.\r\n",
@@ -57,11 +73,511 @@ func TestProtocol(t *testing.T) {
 				status: OK,
 				code:"READ-ONLY",
 				text:"INBOX selected. (Success)",
+				tagged: true,
+			},
+		},
+		readerTest{
+			// Known codes are matched whatever their case.
+			"a2 OK [Read-Write] INBOX selected.\r\n",
+			tag(2),
+			&ResponseStatus{
+				status: OK,
+				code:   "READ-WRITE",
+				text:   "INBOX selected.",
+				tagged: true,
+			},
+		},
+		readerTest{
+			"* OK [uidvalidity 3] UIDs valid.\r\n",
+			untagged,
+			&ResponseUIDValidity{3},
+		},
+		readerTest{
+			// Unknown ones and arguments are kept as sent.
+			"a3 NO [XProprietary Some Args] Nope\r\n",
+			tag(3),
+			&ResponseStatus{
+				status: NO,
+				code:   "XProprietary Some Args",
+				text:   "Nope",
+				tagged: true,
+			},
+		},
+		readerTest{
+			"a8 OK [CAPABILITY IMAP4rev1 IDLE] Logged in\r\n",
+			tag(8),
+			&ResponseStatus{
+				status: OK,
+				code:   &ResponseCapabilities{[]string{"IMAP4rev1", "IDLE"}},
+				text:   "Logged in",
+				tagged: true,
+			},
+		},
+		readerTest{
+			"* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n",
+			untagged,
+			&ResponseStatus{
+				status: OK,
+				code:   &ResponseCapabilities{[]string{"IMAP4rev1", "STARTTLS"}},
+				text:   "ready",
+			},
+		},
+		readerTest{
+			"a10OK Done\r\n",
+			tag(10),
+			&ResponseStatus{status: OK, text: "Done", tagged: true},
+		},
+		readerTest{
+			"a11no [TRYCREATE] No such mailbox\r\n",
+			tag(11),
+			&ResponseStatus{status: NO, code: "TRYCREATE", text: "No such mailbox", tagged: true},
+		},
+		readerTest{
+			"a5 ok Done\r\n",
+			tag(5),
+			&ResponseStatus{status: OK, text: "Done", tagged: true},
+		},
+		readerTest{
+			"a6   No [TRYCREATE] No such mailbox\r\n",
+			tag(6),
+			&ResponseStatus{status: NO, code: "TRYCREATE", text: "No such mailbox", tagged: true},
+		},
+		readerTest{
+			"a3 NO [TRYCREATE] No such mailbox\r\n",
+			tag(3),
+			&ResponseStatus{
+				status: NO,
+				code:"TRYCREATE",
+				text:"No such mailbox",
+				tagged: true,
+			},
+		},
+		readerTest{
+			"a4 OK [COPYUID 38505 304,319:320 3956:3958] Done\r\n",
+			tag(4),
+			&ResponseStatus{
+				status: OK,
+				code:&ResponseCopyUID{38505, "304,319:320", "3956:3958"},
+				text:"Done",
+				tagged: true,
 			},
 		},
+		readerTest{
+			"* 12 FETCH (BODY[HEADER] {13}\r\nSubject: hi\r\n FLAGS (\\Seen))\r\n",
+			untagged,
+			&ResponseFetch{
+				Msg:   12,
+				Body:  map[string][]byte{"HEADER": []byte("Subject: hi\r\n")},
+				Flags: []sexp{"\\Seen"},
+			},
+		},
+		readerTest{
+			"* SEARCH\r\n",
+			untagged,
+			&ResponseSearch{Nums: []int{}},
+		},
+		readerTest{
+			"* SEARCH 2 5 6 (MODSEQ 917162500)\r\n",
+			untagged,
+			&ResponseSearch{[]int{2, 5, 6}, 917162500},
+		},
+		readerTest{
+			"* ESEARCH (TAG \"a5\") UID MIN 4 COUNT 3 ALL 4:5,9 MODSEQ 124\r\n",
+			untagged,
+			&ResponseESearch{Tag: "a5", UID: true, Min: 4, Count: 3, All: "4:5,9", ModSeq: 124},
+		},
+		readerTest{
+			"* ESEARCH (TAG \"a7\") UID PARTIAL (-1:-100 NIL)\r\n",
+			untagged,
+			&ResponseESearch{Tag: "a7", UID: true, Partial: &ESearchPartial{From: -1, To: -100}},
+		},
+		readerTest{
+			"* ESEARCH (TAG \"a9\") ALL 1:3 RELEVANCY (4 5 6) COUNT 3\r\n",
+			untagged,
+			&ResponseESearch{Tag: "a9", All: "1:3", Count: 3},
+		},
+		readerTest{
+			"* ESEARCH (TAG \"a6\")\r\n",
+			untagged,
+			&ResponseESearch{Tag: "a6"},
+		},
+		readerTest{
+			"+ Ready for literal data\r\n",
+			continuation,
+			&ResponseContinuation{"Ready for literal data"},
+		},
+		readerTest{
+			"+\r\n",
+			continuation,
+			&ResponseContinuation{""},
+		},
+		readerTest{
+			"+ \r\n",
+			continuation,
+			&ResponseContinuation{""},
+		},
+		readerTest{
+			"+ PDE4OTYuNjk3MTcwOTUyQHBvc3RvZmZpY2UuZXhhbXBsZS5uZXQ+\r\n",
+			continuation,
+			&ResponseContinuation{"PDE4OTYuNjk3MTcwOTUyQHBvc3RvZmZpY2UuZXhhbXBsZS5uZXQ+"},
+		},
+		readerTest{
+			"+idling\r\n",
+			continuation,
+			&ResponseContinuation{"idling"},
+		},
 	}
 
 	for _, test := range tests {
 		test.Run(t)
 	}
 }
+
+func TestUntaggedKeywords(t *testing.T) {
+	input := "* 10 EXPUNGE\r\n* 10 EXISTS\r\n* 10 expunge\r\n* 10 Exists\r\n" +
+		"* 10 EXPUNGED\r\n* 10 EXIST\r\n* 10 FETCHES (UID 1)\r\n* FLAGSHIP (\\Seen)\r\n" +
+		"* flags (\\Seen)\r\n"
+	expected := []interface{}{
+		&ResponseExpunge{10}, &ResponseExists{10},
+		&ResponseExpunge{10}, &ResponseExists{10},
+		// The near misses in between are skipped.
+		&ResponseFlags{[]string{`\Seen`}},
+	}
+
+	r := &reader{parser: newParser(strings.NewReader(input))}
+	var unknown []string
+	h := UnknownResponseHandler(func(keyword string, data []Sexp, raw string) {
+		unknown = append(unknown, keyword)
+	})
+	r.unknown.Store(&h)
+	for i, e := range expected {
+		_, resp, err := r.readResponse()
+		if err != nil {
+			t.Fatalf("response %d: %s", i, err)
+		}
+		if !reflect.DeepEqual(resp, e) {
+			t.Errorf("response %d: expected %#v, got %#v", i, e, resp)
+		}
+	}
+	// They go to the handler, whole.
+	if want := []string{"EXPUNGED", "EXIST", "FETCHES", "FLAGSHIP"}; !reflect.DeepEqual(unknown, want) {
+		t.Fatalf("expected unknown %q, got %q", want, unknown)
+	}
+}
+
+func TestUntaggedSpacing(t *testing.T) {
+	read := func(input string) (tag, interface{}) {
+		r := &reader{parser: newParser(strings.NewReader(input))}
+		tag, resp, err := r.readResponse()
+		if err != nil {
+			t.Fatalf("%q: %s", input, err)
+		}
+		return tag, resp
+	}
+	for _, lines := range [][]string{
+		{
+			"* 12 FETCH (UID 7 FLAGS (\\Seen))\r\n",
+			"*  12  FETCH  (UID 7 FLAGS (\\Seen))\r\n",
+			"*\t12\tFETCH \t(UID 7 FLAGS (\\Seen))\r\n",
+		},
+		{"* 3 EXISTS\r\n", "*   3 EXISTS  \r\n"},
+		{"* OK [UIDNEXT 4] Predicted\r\n", "*\tOK  [UIDNEXT 4] Predicted\r\n"},
+	} {
+		tag, expected := read(lines[0])
+		for _, line := range lines[1:] {
+			if gotTag, got := read(line); gotTag != tag || !reflect.DeepEqual(got, expected) {
+				t.Errorf("%q: expected %#v, got %#v", line, expected, got)
+			}
+		}
+	}
+	// Within the parentheses spacing is left alone.
+	r := &reader{parser: newParser(strings.NewReader("* 12 FETCH (UID  7)\r\n"))}
+	if _, _, err := r.readResponse(); err == nil {
+		t.Errorf("expected an error for a doubled space within FETCH")
+	}
+}
+
+func TestLenientFlags(t *testing.T) {
+	type flagsTest struct {
+		input string
+		bare  bool
+	}
+	tests := []flagsTest{
+		{"* 1 FETCH (FLAGS (\\Seen) UID 4)\r\n", false},
+		{"* 1 FETCH (FLAGS \\Seen UID 4)\r\n", true},
+		{"* FLAGS (\\Seen)\r\n", false},
+		{"* FLAGS \\Seen\r\n", true},
+	}
+	for _, lenient := range []bool{false, true} {
+		for _, test := range tests {
+			r := &reader{parser: newParser(strings.NewReader(test.input))}
+			r.lenientFlags.Store(lenient)
+			_, resp, err := r.readResponse()
+			if test.bare && !lenient {
+				if err == nil {
+					t.Errorf("%q: expected an error when strict, got %#v", test.input, resp)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%q (lenient %v): %s", test.input, lenient, err)
+				continue
+			}
+			var flags FlagSet
+			switch resp := resp.(type) {
+			case *ResponseFetch:
+				flags = flagSet(resp.Flags)
+				if resp.UID != 4 {
+					t.Errorf("%q: expected UID 4, got %d", test.input, resp.UID)
+				}
+			case *ResponseFlags:
+				flags = resp.Flags
+			}
+			if !reflect.DeepEqual(flags, FlagSet{`\Seen`}) {
+				t.Errorf("%q (lenient %v): expected [\\Seen], got %#v", test.input, lenient, resp)
+			}
+		}
+	}
+}
+
+func TestEnvelopeLiteralAddress(t *testing.T) {
+	input := "* 1 FETCH (ENVELOPE (NIL {11}\r\nSubject \"x\" " +
+		"(({15}\r\n\"Doe, Jane\" (x) NIL {4}\r\njane \"example.com\")) " +
+		"((\"=?UTF-8?Q?Andr=C3=A9?=\" NIL \"andre\" \"example.com\")) " +
+		"NIL NIL NIL NIL NIL NIL))\r\n"
+	r := &reader{parser: newParser(bytes.NewBufferString(input))}
+	_, resp, err := r.readResponse()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	env := resp.(*ResponseFetch).Envelope
+	if env.Subject == nil || *env.Subject != `Subject "x"` {
+		t.Fatalf("unexpected subject %v", env.Subject)
+	}
+	from := []Address{{Name: `"Doe, Jane" (x)`, Address: "jane@example.com"}}
+	if !reflect.DeepEqual(env.From, from) {
+		t.Fatalf("DeepEqual(%#v, %#v)", env.From, from)
+	}
+	sender := []Address{{Name: "André", Address: "andre@example.com"}}
+	if !reflect.DeepEqual(env.Sender, sender) {
+		t.Fatalf("DeepEqual(%#v, %#v)", env.Sender, sender)
+	}
+}
+
+func TestEnvelopeAddressLists(t *testing.T) {
+	ann := Address{Name: "Ann", Address: "ann@example.com"}
+	bob := Address{Address: "bob@example.org"}
+	tests := []struct {
+		name, from string
+		expected   []Address
+	}{
+		{"nil", `NIL`, nil},
+		{"empty", `()`, []Address{}},
+		{"single", `(("Ann" NIL "ann" "example.com"))`, []Address{ann}},
+		{"multiple", `(("Ann" NIL "ann" "example.com") (NIL NIL "bob" "example.org"))`, []Address{ann, bob}},
+		{
+			"group",
+			`((NIL NIL "team" NIL) ("Ann" NIL "ann" "example.com") (NIL NIL NIL NIL) (NIL NIL "bob" "example.org"))`,
+			[]Address{{Name: "team", group: groupStart}, ann, {group: groupEnd}, bob},
+		},
+		{"empty group", `((NIL NIL "undisclosed-recipients" NIL) (NIL NIL NIL NIL))`,
+			[]Address{{Name: "undisclosed-recipients", group: groupStart}, {group: groupEnd}}},
+		{"nested", `(((("Ann" NIL "ann" "example.com"))) ((NIL NIL "bob" "example.org")))`, []Address{ann, bob}},
+		{"literals", "(({3}\r\nAnn NIL {3}\r\nann {11}\r\nexample.com))", []Address{ann}},
+		{"whole literal", "{38}\r\nAnn <ann@example.com>, bob@example.org", []Address{ann, bob}},
+		{"junk", `(JUNK ("short") ("Ann" NIL "ann" "example.com"))`, []Address{ann}},
+		{"no mailbox", `(("Ann" NIL NIL "example.com") (NIL NIL "bob" "example.org"))`, []Address{{Name: "Ann"}, bob}},
+	}
+	for _, test := range tests {
+		input := "* 1 FETCH (ENVELOPE (NIL NIL " + test.from + " NIL NIL NIL NIL NIL NIL NIL))\r\n"
+		r := &reader{parser: newParser(strings.NewReader(input))}
+		_, resp, err := r.readResponse()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		from := resp.(*ResponseFetch).Envelope.From
+		if !reflect.DeepEqual(from, test.expected) {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.expected, from)
+		}
+	}
+
+	start, end := Address{group: groupStart}, Address{group: groupEnd}
+	if !start.IsGroupStart() || start.IsGroupEnd() || !end.IsGroupEnd() || end.IsGroupStart() || ann.IsGroupStart() || ann.IsGroupEnd() {
+		t.Fatalf("group markers misreported")
+	}
+}
+
+func TestLenientLineEndings(t *testing.T) {
+	input := "* OK [CAPABILITY IMAP4rev1 IDLE] ready\n" +
+		"* CAPABILITY IMAP4rev1 IDLE\n" +
+		"* 1 FETCH (RFC822 {7}\nab\r\ncd\n UID 4)\n" +
+		"* ESEARCH COUNT 2\n" +
+		"+ go ahead\n" +
+		"a1 OK done\r\n"
+	r := &reader{parser: newParser(bytes.NewBufferString(input))}
+	r.lenient.Store(true)
+	var got []interface{}
+	for i := 0; i < 6; i++ {
+		_, resp, err := r.readResponse()
+		if err != nil {
+			t.Fatalf("response %d: %s", i, err)
+		}
+		got = append(got, resp)
+	}
+	if fetch := got[2].(*ResponseFetch); string(fetch.Rfc822) != "ab\r\ncd\n" || fetch.UID != 4 {
+		t.Fatalf("unexpected fetch %#v", fetch)
+	}
+	if c := got[4].(*ResponseContinuation); c.Text != "go ahead" {
+		t.Fatalf("unexpected continuation %#v", c)
+	}
+	if s := got[5].(*ResponseStatus); s.status != OK || s.text != "done" {
+		t.Fatalf("unexpected completion %#v", s)
+	}
+
+	// Strict by default.
+	r = &reader{parser: newParser(bytes.NewBufferString("* CAPABILITY IMAP4rev1\n"))}
+	if _, _, err := r.readResponse(); err == nil {
+		t.Fatalf("expected a bare LF to be rejected")
+	}
+}
+
+// numbersReader yields " 1 2 ... n" without ever holding it whole.
+type numbersReader struct {
+	next, n int
+	buf     []byte
+}
+
+func (r *numbersReader) Read(p []byte) (int, error) {
+	for len(r.buf) < len(p) && r.next < r.n {
+		r.next++
+		r.buf = append(r.buf, ' ')
+		r.buf = strconv.AppendInt(r.buf, int64(r.next), 10)
+	}
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[:copy(r.buf, r.buf[n:])]
+	return n, nil
+}
+
+func TestReadLargeSearch(t *testing.T) {
+	const n = 1000000
+	r := &reader{parser: newParser(io.MultiReader(
+		strings.NewReader("* SEARCH"),
+		&numbersReader{n: n, buf: make([]byte, 0, 8192)},
+		strings.NewReader("\r\n* 3 EXISTS\r\n"),
+	))}
+	count, sum := 0, 0
+	fn := func(num int) {
+		count++
+		sum += num
+	}
+	r.searchNum.Store(&fn)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, resp, err := r.readResponse()
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if count != n || sum != n*(n+1)/2 {
+		t.Fatalf("got %d numbers summing to %d", count, sum)
+	}
+	if len(resp.(*ResponseSearch).Nums) != 0 {
+		t.Fatalf("numbers collected despite the callback")
+	}
+	// The line is nearly 7MB; reading it takes a small fraction of that.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Fatalf("reading the search allocated %d bytes", alloc)
+	}
+
+	// The CRLF ended the response, and the next one follows.
+	_, resp, err = r.readResponse()
+	if err != nil || !reflect.DeepEqual(resp, &ResponseExists{3}) {
+		t.Fatalf("expected EXISTS after the search, got %#v, %v", resp, err)
+	}
+}
+
+func TestReadLiteralsDripped(t *testing.T) {
+	body := strings.Repeat("Some text of a long message body.\r\n", 200)
+	input := fmt.Sprintf("* 12 FETCH (UID 7 BODY[] {%d}\r\n%s FLAGS (\\Seen))\r\n", len(body), body) +
+		"* XDATA {5}\r\nab\r\nc more {0}\r\n\r\n" +
+		"* LIST () \"/\" {3}\r\nA/B\r\n"
+
+	read := func(src io.Reader, lenient bool) []interface{} {
+		r := &reader{parser: newParser(src)}
+		r.lenient.Store(lenient)
+		// The unknown response is skipped, its text going here.
+		var unknown string
+		h := UnknownResponseHandler(func(keyword string, data []Sexp, raw string) {
+			unknown = raw
+		})
+		r.unknown.Store(&h)
+		var resps []interface{}
+		for len(resps) < 2 {
+			_, resp, err := r.readResponse()
+			if err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			resps = append(resps, resp)
+		}
+		return append(resps, unknown)
+	}
+
+	expected := read(strings.NewReader(input), false)
+	if fetch := expected[0].(*ResponseFetch); string(fetch.Body[""]) != body {
+		t.Fatalf("body not read whole: %q", fetch.Body[""])
+	}
+	if list := expected[1].(*ResponseList); list.Name != "A/B" {
+		t.Fatalf("unexpected list name %q", list.Name)
+	}
+	if expected[2] != "* XDATA {5}\r\nab\r\nc more {0}\r\n" {
+		t.Fatalf("unexpected unknown response %q", expected[2])
+	}
+	for n := 1; n <= 5; n++ {
+		for _, lenient := range []bool{false, true} {
+			got := read(&dripReader{strings.NewReader(input), n}, lenient)
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("in reads of %d bytes, got %#v, expected %#v", n, got, expected)
+			}
+		}
+	}
+}
+
+func TestReadFetchEmptyLiterals(t *testing.T) {
+	r := &reader{parser: newParser(strings.NewReader(
+		"* 1 FETCH (BODY[TEXT] {0}\r\n BODY[HEADER] NIL RFC822 {0}\r\n UID 5 FLAGS ())\r\n"))}
+	_, resp, err := r.readResponse()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	fetch := resp.(*ResponseFetch)
+	if text, ok := fetch.Body["TEXT"]; !ok || text == nil || len(text) != 0 {
+		t.Fatalf("empty BODY[TEXT] read as %#v", text)
+	}
+	if header, ok := fetch.Body["HEADER"]; !ok || header != nil {
+		t.Fatalf("NIL BODY[HEADER] read as %#v", header)
+	}
+	if fetch.Rfc822 == nil || len(fetch.Rfc822) != 0 {
+		t.Fatalf("empty RFC822 read as %#v", fetch.Rfc822)
+	}
+	if fetch.UID != 5 || !reflect.DeepEqual(fetch.Flags, []sexp{}) {
+		t.Fatalf("items after the empty literals misread: %#v", fetch)
+	}
+}
+
+func TestStatusAppendLimitRange(t *testing.T) {
+	r := &reader{parser: newParser(strings.NewReader("* STATUS INBOX (APPENDLIMIT 4294967295)\r\n"))}
+	_, resp, err := r.readResponse()
+	if s, ok := resp.(*MailboxStatus); err != nil || !ok || s.AppendLimit == nil || *s.AppendLimit != math.MaxUint32 {
+		t.Fatalf("unexpected response %#v, %v", resp, err)
+	}
+	// One more doesn't fit, rather than wrapping around to zero.
+	r = &reader{parser: newParser(strings.NewReader("* STATUS INBOX (APPENDLIMIT 4294967296)\r\n"))}
+	if _, _, err := r.readResponse(); err == nil {
+		t.Fatalf("expected an out-of-range APPENDLIMIT to fail")
+	}
+}
@@ -0,0 +1,86 @@
+package imap
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ResponseApplePush contains the key/value pairs of an
+// XAPPLEPUSHSERVICE response, such as "aps-version" and "aps-topic".
+type ResponseApplePush struct {
+	Params map[string]string
+}
+
+// ApplePushRegister registers a device for Apple push notifications
+// with XAPPLEPUSHSERVICE, a vendor extension, sending params (such as
+// "aps-version", "aps-account-id", "aps-device-token" and
+// "aps-subtopic") and returning the server's, such as "aps-topic".  It
+// needs the XAPPLEPUSHSERVICE capability.
+func (imap *IMAP) ApplePushRegister(params map[string]string) (map[string]string, error) {
+	if err := imap.require("XAPPLEPUSHSERVICE"); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []interface{}{"XAPPLEPUSHSERVICE"}
+	for _, key := range keys {
+		parts = append(parts, " ", astring(key), " ", astring(params[key]))
+	}
+	resp, err := imap.sendSync(parts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var push *ResponseApplePush
+	for _, extra := range resp.extra {
+		if r, ok := extra.(*ResponseApplePush); ok && push == nil {
+			push = r
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	if push == nil {
+		return nil, errors.New("imap: no XAPPLEPUSHSERVICE response")
+	}
+	return push.Params, nil
+}
+
+func (r *reader) readXAPPLEPUSHSERVICE() *ResponseApplePush {
+	/* "XAPPLEPUSHSERVICE" *(SP key SP value) */
+	push := &ResponseApplePush{Params: make(map[string]string)}
+	c, err := r.ReadByte()
+	check(err)
+	check(r.UnreadByte())
+	if c == '\r' || c == '\n' {
+		check(r.expectEOL())
+		return push
+	}
+	for more := true; more; more = r.moreOnLine() {
+		key, err := r.readAstring()
+		check(err)
+		check(r.expect(" "))
+		c, err := r.ReadByte()
+		check(err)
+		check(r.UnreadByte())
+		var value string
+		if c == '(' {
+			// A list, such as of mailboxes.
+			list, err := r.readSexp()
+			check(err)
+			values := make([]string, len(list))
+			for i, s := range list {
+				values[i] = sexpString(s)
+			}
+			value = strings.Join(values, " ")
+		} else {
+			value, err = r.readAstring()
+			check(err)
+		}
+		push.Params[key] = value
+	}
+	return push
+}
@@ -0,0 +1,47 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplePushRegister(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 XAPPLEPUSHSERVICE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`XAPPLEPUSHSERVICE aps-account-id 0715A26B-CA09 aps-device-token 2918390218931890821 aps-subtopic com.apple.mobilemail aps-version 2`)
+	s.Send(`* XAPPLEPUSHSERVICE aps-version "2" aps-topic "com.apple.mail.XServer.8c1e5f" mailboxes (INBOX "Sent Messages")`)
+	s.Done("OK XAPPLEPUSHSERVICE completed")
+
+	params, err := im.ApplePushRegister(map[string]string{
+		"aps-version":      "2",
+		"aps-account-id":   "0715A26B-CA09",
+		"aps-device-token": "2918390218931890821",
+		"aps-subtopic":     "com.apple.mobilemail",
+	})
+	if err != nil {
+		t.Fatalf("register: %s", err)
+	}
+	expected := map[string]string{
+		"aps-version": "2",
+		"aps-topic":   "com.apple.mail.XServer.8c1e5f",
+		"mailboxes":   "INBOX Sent Messages",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Fatalf("expected %q, got %q", expected, params)
+	}
+	waitFake(t, s)
+}
+
+func TestApplePushUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	if _, err := im.ApplePushRegister(map[string]string{"aps-version": "2"}); err == nil {
+		t.Fatalf("expected an error without XAPPLEPUSHSERVICE")
+	}
+	waitFake(t, s)
+}
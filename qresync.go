@@ -0,0 +1,82 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResponseVanished reports UIDs expunged from the selected mailbox,
+// from a VANISHED response (RFC 7162), which a server with QRESYNC
+// enabled sends in place of EXPUNGE.  Earlier is set when the UIDs
+// were expunged before the command that asked for them, as in answer
+// to a FETCH with the VANISHED modifier; the messages are already gone
+// and message numbers don't change.
+type ResponseVanished struct {
+	Earlier bool
+	UIDs    *SeqSet
+}
+
+func (r *reader) readVANISHED() *ResponseVanished {
+	/*
+		expunged-resp   = "VANISHED" [SP "(EARLIER)"] SP known-uids
+	*/
+	resp := &ResponseVanished{}
+	c, err := r.ReadByte()
+	check(err)
+	check(r.UnreadByte())
+	if c == '(' {
+		s, err := r.readSexp()
+		check(err)
+		if len(s) != 1 || !strings.EqualFold(sexpString(s[0]), "EARLIER") {
+			panic(fmt.Errorf("bad VANISHED tag %#v", s))
+		}
+		resp.Earlier = true
+		check(r.expect(" "))
+	}
+	set, err := r.readToken()
+	check(err)
+	resp.UIDs, err = ParseSeqSet(set)
+	check(err)
+	check(r.expectEOL())
+	return resp
+}
+
+// UIDFetchChangedVanished is like FetchChangedSince on the UIDs in
+// uidset, but also returns the UIDs among them that were expunged
+// since modseq, from the server's VANISHED (EARLIER) responses.  Some
+// of those may never have existed; RFC 7162 lets the server say so.
+// It needs QRESYNC to have been enabled, with Enable or SetAutoEnable.
+func (imap *IMAP) UIDFetchChangedVanished(uidset string, fields []string, modseq uint64) ([]*ResponseFetch, *SeqSet, error) {
+	if err := imap.require("QRESYNC"); err != nil {
+		return nil, nil, err
+	}
+	if !imap.IsEnabled("QRESYNC") {
+		return nil, nil, errors.New("imap: QRESYNC hasn't been enabled")
+	}
+	cmd, err := formatFetch(uidset, fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := imap.SendSync("UID %s (CHANGEDSINCE %d VANISHED)", cmd, modseq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fetches := make([]*ResponseFetch, 0)
+	vanished := &SeqSet{}
+	for _, extra := range resp.extra {
+		switch r := extra.(type) {
+		case *ResponseFetch:
+			fetches = append(fetches, r)
+			continue
+		case *ResponseVanished:
+			if r.Earlier {
+				vanished.Ranges = append(vanished.Ranges, r.UIDs.Ranges...)
+				continue
+			}
+		}
+		imap.unsolicited(extra)
+	}
+	return fetches, vanished, nil
+}
@@ -0,0 +1,55 @@
+package imap
+
+import (
+	"testing"
+)
+
+func TestUIDFetchChangedVanished(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ENABLE CONDSTORE QRESYNC")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("ENABLE QRESYNC")
+	s.Send("* ENABLED QRESYNC")
+	s.Done("OK ENABLE completed")
+	s.Expect("UID FETCH 1:* FLAGS (CHANGEDSINCE 12345 VANISHED)")
+	s.Send("* VANISHED (EARLIER) 41,43:116")
+	s.Send(`* 1 FETCH (UID 4 MODSEQ (12346) FLAGS (\Seen))`)
+	s.Send("* VANISHED (EARLIER) 200")
+	s.Send("* 2 FETCH (UID 117 MODSEQ (12350) FLAGS ())")
+	s.Send("* VANISHED 405")
+	s.Done("OK FETCH completed")
+
+	if _, err := im.Enable("QRESYNC"); err != nil {
+		t.Fatalf("enable: %s", err)
+	}
+	fetches, vanished, err := im.UIDFetchChangedVanished("1:*", []string{"FLAGS"}, 12345)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(fetches) != 2 || fetches[0].UID != 4 || fetches[1].UID != 117 ||
+		fetches[0].ModSeq != 12346 {
+		t.Fatalf("unexpected fetches %#v", fetches)
+	}
+	if got := vanished.String(); got != "41,43:116,200" {
+		t.Fatalf("expected vanished 41,43:116,200, got %s", got)
+	}
+	// The VANISHED without EARLIER is a fresh expunge.
+	resp := <-im.Unsolicited
+	if v, ok := resp.(*ResponseVanished); !ok || v.Earlier || v.UIDs.String() != "405" {
+		t.Fatalf("expected an unsolicited VANISHED 405, got %#v", resp)
+	}
+	waitFake(t, s)
+}
+
+func TestUIDFetchChangedVanishedNotEnabled(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ENABLE CONDSTORE QRESYNC")
+	s.Done("OK CAPABILITY completed")
+
+	if _, _, err := im.UIDFetchChangedVanished("1:*", []string{"FLAGS"}, 1); err == nil {
+		t.Fatalf("expected an error without QRESYNC enabled")
+	}
+	waitFake(t, s)
+}
@@ -0,0 +1,132 @@
+package imap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// QuotaResource is the usage and limit of a quota resource, such as
+// STORAGE (in units of 1024 octets) or MESSAGE.
+type QuotaResource struct {
+	Usage, Limit uint64
+}
+
+// ResponseQuota contains the resources of a quota root, from QUOTA.
+// Resource names are upper-cased; names the package doesn't know, as
+// RFC 9208 lets servers add, are kept too.
+type ResponseQuota struct {
+	Root      string
+	Resources map[string]QuotaResource
+}
+
+// ResponseQuotaRoot contains the quota roots of a mailbox, from
+// QUOTAROOT.
+type ResponseQuotaRoot struct {
+	Mailbox string
+	Roots   []string
+}
+
+// GetQuota returns the resources of quota root.  It needs the QUOTA
+// capability (RFC 9208).
+func (imap *IMAP) GetQuota(root string) (*ResponseQuota, error) {
+	if err := imap.require("QUOTA"); err != nil {
+		return nil, err
+	}
+	resp, err := imap.sendSync("GETQUOTA ", astring(root))
+	if err != nil {
+		return nil, err
+	}
+
+	var quota *ResponseQuota
+	for _, extra := range resp.extra {
+		if q, ok := extra.(*ResponseQuota); ok && q.Root == root && quota == nil {
+			quota = q
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	if quota == nil {
+		return nil, fmt.Errorf("imap: no QUOTA response for %q", root)
+	}
+	return quota, nil
+}
+
+// GetQuotaRoot returns the quotas mailbox is subject to, in the order
+// the server lists their roots; a mailbox without quotas has none.
+// It needs the QUOTA capability.
+func (imap *IMAP) GetQuotaRoot(mailbox string) ([]*ResponseQuota, error) {
+	if err := imap.require("QUOTA"); err != nil {
+		return nil, err
+	}
+	resp, err := imap.sendSync("GETQUOTAROOT ", imap.mailbox(mailbox))
+	if err != nil {
+		return nil, err
+	}
+
+	var roots *ResponseQuotaRoot
+	byRoot := make(map[string]*ResponseQuota)
+	for _, extra := range resp.extra {
+		switch r := extra.(type) {
+		case *ResponseQuotaRoot:
+			if sameMailbox(r.Mailbox, mailbox) && roots == nil {
+				roots = r
+				continue
+			}
+		case *ResponseQuota:
+			byRoot[r.Root] = r
+			continue
+		}
+		imap.unsolicited(extra)
+	}
+	if roots == nil {
+		return nil, fmt.Errorf("imap: no QUOTAROOT response for %q", mailbox)
+	}
+	quotas := make([]*ResponseQuota, 0, len(roots.Roots))
+	for _, root := range roots.Roots {
+		if q := byRoot[root]; q != nil {
+			quotas = append(quotas, q)
+		}
+	}
+	return quotas, nil
+}
+
+func (r *reader) readQUOTA() *ResponseQuota {
+	/*
+		quota-response  = "QUOTA" SP quota-root-name SP quota-list
+		quota-list      = "(" quota-resource *(SP quota-resource) ")"
+		quota-resource  = resource-name SP resource-usage SP resource-limit
+	*/
+	root, err := r.readAstring()
+	check(err)
+	check(r.expect(" "))
+	list, err := r.readSexp()
+	check(err)
+	check(r.expectEOL())
+	if len(list)%3 != 0 {
+		panic(fmt.Errorf("quota list needs triples, got %d items", len(list)))
+	}
+
+	quota := &ResponseQuota{Root: root, Resources: make(map[string]QuotaResource)}
+	for i := 0; i < len(list); i += 3 {
+		usage, err := strconv.ParseUint(sexpString(list[i+1]), 10, 64)
+		check(err)
+		limit, err := strconv.ParseUint(sexpString(list[i+2]), 10, 64)
+		check(err)
+		quota.Resources[strings.ToUpper(sexpString(list[i]))] = QuotaResource{usage, limit}
+	}
+	return quota
+}
+
+func (r *reader) readQUOTAROOT() *ResponseQuotaRoot {
+	/* quotaroot-response = "QUOTAROOT" SP mailbox *(SP quota-root-name) */
+	mailbox, err := r.readAstring()
+	check(err)
+	roots := &ResponseQuotaRoot{Mailbox: r.mailboxName(mailbox)}
+	for r.moreOnLine() {
+		root, err := r.readAstring()
+		check(err)
+		roots.Roots = append(roots.Roots, root)
+	}
+	return roots
+}
@@ -0,0 +1,72 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetQuota(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 QUOTA QUOTA=RES-STORAGE")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`GETQUOTA ""`)
+	// 6 TiB of storage, in KiB, and a resource from beyond RFC 9208.
+	s.Send(`* QUOTA "" (STORAGE 5368709120 6442450944 message 12 1000 X-ATTACHMENTS 3 4294967296)`)
+	s.Done("OK GETQUOTA completed")
+
+	quota, err := im.GetQuota("")
+	if err != nil {
+		t.Fatalf("getquota: %s", err)
+	}
+	expected := &ResponseQuota{Root: "", Resources: map[string]QuotaResource{
+		"STORAGE":       {5368709120, 6442450944},
+		"MESSAGE":       {12, 1000},
+		"X-ATTACHMENTS": {3, 4294967296},
+	}}
+	if !reflect.DeepEqual(quota, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, quota)
+	}
+	waitFake(t, s)
+}
+
+func TestGetQuotaRoot(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 QUOTA")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`GETQUOTAROOT "INBOX"`)
+	s.Send(`* QUOTAROOT INBOX "" user.ann`)
+	s.Send(`* QUOTA user.ann (MESSAGE 3 10)`)
+	s.Send(`* QUOTA "" (STORAGE 10 512)`)
+	s.Done("OK GETQUOTAROOT completed")
+	s.Expect(`GETQUOTAROOT "Archive"`)
+	s.Send(`* QUOTAROOT Archive`)
+	s.Done("OK GETQUOTAROOT completed")
+
+	quotas, err := im.GetQuotaRoot("INBOX")
+	if err != nil {
+		t.Fatalf("getquotaroot: %s", err)
+	}
+	if len(quotas) != 2 || quotas[0].Root != "" || quotas[1].Root != "user.ann" ||
+		quotas[0].Resources["STORAGE"] != (QuotaResource{10, 512}) {
+		t.Fatalf("unexpected quotas %#v", quotas)
+	}
+	quotas, err = im.GetQuotaRoot("Archive")
+	if err != nil || len(quotas) != 0 {
+		t.Fatalf("expected no quotas, got %#v %v", quotas, err)
+	}
+	waitFake(t, s)
+}
+
+func TestGetQuotaUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	if _, err := im.GetQuota(""); err == nil {
+		t.Fatalf("expected an error without QUOTA")
+	}
+	waitFake(t, s)
+}
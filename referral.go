@@ -0,0 +1,157 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ResponseReferral contains the URL of a REFERRAL response code: the
+// server to log in to instead (LOGIN-REFERRALS, RFC 2221), or the one
+// holding a mailbox (MAILBOX-REFERRALS, RFC 2193), such as
+// "imap://fred;AUTH=*@server2/SHARED/FOO".
+type ResponseReferral struct {
+	URL string
+}
+
+// Referral returns the URL err refers the client to, if it is the
+// refusal of a command with a REFERRAL code.
+func Referral(err error) (string, bool) {
+	e, ok := err.(*IMAPError)
+	if !ok {
+		return "", false
+	}
+	r, ok := e.Code.(*ResponseReferral)
+	if !ok {
+		return "", false
+	}
+	return r.URL, true
+}
+
+// maxReferrals is the most referrals followed for one command, so that
+// servers referring to each other can't keep the client going round.
+const maxReferrals = 3
+
+// LoginReferred logs in like Auth.  If the server refers the client
+// elsewhere and FollowReferrals is set, it connects to the server
+// referred to, the same way as imap's connection was made by Dial, and
+// logs in there.  It returns the client that is logged in, which is
+// imap unless a referral was followed; imap is left open either way.
+func (imap *IMAP) LoginReferred(ctx context.Context, user, pass string) (*IMAP, error) {
+	return imap.referred(ctx, "", nil, func(c *IMAP, _ string) error {
+		_, _, err := c.Auth(user, pass)
+		return err
+	})
+}
+
+// SelectReferred selects mailbox like Select.  If the server refers the
+// client to another server holding it and FollowReferrals is set, it
+// connects there as LoginReferred does, logs in as user, and selects
+// the mailbox named by the referral.  It returns the client that has
+// the mailbox selected.
+func (imap *IMAP) SelectReferred(ctx context.Context, mailbox, user, pass string) (*IMAP, *ResponseExamine, error) {
+	var r *ResponseExamine
+	login := func(c *IMAP) error {
+		_, _, err := c.Auth(user, pass)
+		return err
+	}
+	c, err := imap.referred(ctx, mailbox, login, func(c *IMAP, mailbox string) error {
+		var err error
+		r, err = c.Select(mailbox)
+		return err
+	})
+	if err != nil {
+		return c, nil, err
+	}
+	return c, r, nil
+}
+
+// referred runs op on imap, and on each server it is referred to from
+// there, logging in to each with login if set.  op is given mailbox,
+// or the mailbox the latest referral names.
+func (imap *IMAP) referred(ctx context.Context, mailbox string, login func(c *IMAP) error, op func(c *IMAP, mailbox string) error) (*IMAP, error) {
+	c := imap
+	for hops := 0; ; hops++ {
+		err := op(c, mailbox)
+		ref, ok := Referral(err)
+		if !ok || !imap.FollowReferrals {
+			return c, err
+		}
+		if hops == maxReferrals {
+			return c, fmt.Errorf("imap: gave up after %d referrals: %w", hops, err)
+		}
+
+		next, name, err := c.dialReferral(ctx, ref)
+		if c != imap {
+			c.close()
+		}
+		if err != nil {
+			return imap, err
+		}
+		c = next
+		if name != "" {
+			mailbox = name
+		}
+		if login != nil {
+			if err := login(c); err != nil {
+				c.close()
+				return imap, err
+			}
+		}
+	}
+}
+
+// dialReferral connects to the server the IMAP URL ref refers to,
+// returning the new client, started and with imap's settings, and the
+// mailbox the URL names, if any.  If imap's connection is TLS, so must
+// the new one be, by STARTTLS if that is how imap got it.
+func (imap *IMAP) dialReferral(ctx context.Context, ref string) (*IMAP, string, error) {
+	u, err := url.Parse(ref)
+	if err != nil || !strings.EqualFold(u.Scheme, "imap") || u.Host == "" {
+		return nil, "", fmt.Errorf("imap: bad referral %q", ref)
+	}
+	if imap.redial == nil {
+		return nil, "", fmt.Errorf("imap: can't follow referral to %s from a connection not made by Dial", ref)
+	}
+	// A session that upgraded with STARTTLS does so again on port 143;
+	// one that was TLS from the start stays on 993.
+	_, secure := imap.ConnectionState()
+	addr := u.Host
+	if u.Port() == "" {
+		port := "143"
+		if secure && imap.upgradedTLS == nil {
+			port = "993"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	// Any ";UIDVALIDITY=" and the like is of no use to SELECT.
+	mailbox, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), ";")
+
+	next, err := imap.redial(ctx, addr)
+	if err != nil {
+		return nil, "", err
+	}
+	next.Unsolicited = imap.Unsolicited
+	next.CommandTimeout = imap.CommandTimeout
+	next.CheckRights = imap.CheckRights
+	next.FollowReferrals = imap.FollowReferrals
+	next.Logger = imap.Logger
+	if _, err := next.Start(); err != nil {
+		next.close()
+		return nil, "", err
+	}
+	if imap.upgradedTLS != nil {
+		if err := next.StartTLS(imap.upgradedTLS); err != nil {
+			next.close()
+			return nil, "", fmt.Errorf("imap: referral to %s: %w", ref, err)
+		}
+	}
+	if _, ok := next.ConnectionState(); secure && !ok {
+		// The password would go in the clear.
+		next.close()
+		return nil, "", fmt.Errorf("imap: won't follow referral to %s without TLS", ref)
+	}
+	return next, mailbox, nil
+}
@@ -0,0 +1,191 @@
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// fakeDialer connects to a new FakeServer per dial, scripted by the
+// function for the address.
+type fakeDialer struct {
+	t       *testing.T
+	scripts map[string]func(s *FakeServer)
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	script, ok := d.scripts[addr]
+	if !ok {
+		return nil, fmt.Errorf("no server at %s", addr)
+	}
+	client, conn := net.Pipe()
+	s := newFakeServer(conn)
+	d.t.Cleanup(func() {
+		s.Close()
+	})
+	script(s)
+	return client, nil
+}
+
+func dialFake(t *testing.T, d *fakeDialer, addr string) *IMAP {
+	im, err := DialWithDialer(context.Background(), d, addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	im.Unsolicited = make(chan interface{}, 100)
+	if _, err := im.Start(); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	return im
+}
+
+func TestLoginReferred(t *testing.T) {
+	var first, second *FakeServer
+	d := &fakeDialer{t: t, scripts: map[string]func(s *FakeServer){
+		"server1:143": func(s *FakeServer) {
+			first = s
+			s.Send("* OK server1 ready")
+			s.Expect("LOGIN fred pass")
+			s.Done("NO [REFERRAL imap://fred;AUTH=*@server2/] Try server2")
+			s.Expect("LOGIN fred pass")
+			s.Done("NO [REFERRAL imap://fred;AUTH=*@server2/] Try server2")
+		},
+		"server2:143": func(s *FakeServer) {
+			second = s
+			s.Send("* OK server2 ready")
+			s.Expect("LOGIN fred pass")
+			s.Done("OK LOGIN completed")
+		},
+	}}
+	im := dialFake(t, d, "server1:143")
+
+	// By default the referral is only reported.
+	c, err := im.LoginReferred(context.Background(), "fred", "pass")
+	if ref, ok := Referral(err); !ok || ref != "imap://fred;AUTH=*@server2/" || c != im {
+		t.Fatalf("expected the referral, got %v", err)
+	}
+
+	im.FollowReferrals = true
+	c, err = im.LoginReferred(context.Background(), "fred", "pass")
+	if err != nil {
+		t.Fatalf("login: %s", err)
+	}
+	if c == im || c.Unsolicited != im.Unsolicited {
+		t.Fatalf("expected a new client for server2")
+	}
+	waitFake(t, first)
+	waitFake(t, second)
+}
+
+func TestSelectReferred(t *testing.T) {
+	var first, second *FakeServer
+	d := &fakeDialer{t: t, scripts: map[string]func(s *FakeServer){
+		"server1:143": func(s *FakeServer) {
+			first = s
+			s.Send("* OK server1 ready")
+			s.Expect(`SELECT "Shared/Sales"`)
+			s.Done("NO [REFERRAL imap://;AUTH=*@server2:1143/SHARED/SALES;UIDVALIDITY=7] Remote mailbox")
+		},
+		"server2:1143": func(s *FakeServer) {
+			second = s
+			s.Send("* OK server2 ready")
+			s.Expect("LOGIN fred pass")
+			s.Done("OK LOGIN completed")
+			s.Expect(`SELECT "SHARED/SALES"`)
+			s.Send("* 9 EXISTS")
+			s.Done("OK [READ-WRITE] SELECT completed")
+		},
+	}}
+	im := dialFake(t, d, "server1:143")
+	im.FollowReferrals = true
+
+	c, r, err := im.SelectReferred(context.Background(), "Shared/Sales", "fred", "pass")
+	if err != nil {
+		t.Fatalf("select: %s", err)
+	}
+	if c == im || r.Exists != 9 {
+		t.Fatalf("unexpected result %#v", r)
+	}
+	waitFake(t, first)
+	waitFake(t, second)
+}
+
+func TestReferralLoop(t *testing.T) {
+	dials := 0
+	refer := func(to string) func(s *FakeServer) {
+		return func(s *FakeServer) {
+			dials++
+			s.Send("* OK ready")
+			s.Expect("LOGIN fred pass")
+			s.Done("NO [REFERRAL imap://fred;AUTH=*@" + to + "/] Try " + to)
+		}
+	}
+	d := &fakeDialer{t: t, scripts: map[string]func(s *FakeServer){
+		"server1:143": refer("server2"),
+		"server2:143": refer("server1"),
+	}}
+	im := dialFake(t, d, "server1:143")
+	im.FollowReferrals = true
+
+	_, err := im.LoginReferred(context.Background(), "fred", "pass")
+	if _, ok := Referral(errors.Unwrap(err)); !ok {
+		t.Fatalf("expected to give up on the referrals, got %v", err)
+	}
+	if dials != 1+maxReferrals {
+		t.Fatalf("expected %d connections, got %d", 1+maxReferrals, dials)
+	}
+}
+
+func TestLoginReferredStartTLS(t *testing.T) {
+	cert, pool := testCertificate(t, "server1", "server2")
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	upgrade := func(s *FakeServer, caps string) {
+		s.Send("* OK [CAPABILITY IMAP4rev1 " + caps + "] ready")
+		s.Expect("STARTTLS")
+		s.Done("OK Begin TLS negotiation now")
+		s.StartTLS(serverConfig)
+	}
+	var first, second *FakeServer
+	d := &fakeDialer{t: t, scripts: map[string]func(s *FakeServer){
+		"server1:143": func(s *FakeServer) {
+			first = s
+			upgrade(s, "STARTTLS")
+			s.Expect("LOGIN fred pass")
+			s.Done("NO [REFERRAL imap://fred;AUTH=*@server2/] Try server2")
+			s.Expect("LOGIN fred pass")
+			s.Done("NO [REFERRAL imap://fred;AUTH=*@server3/] Try server3")
+		},
+		"server2:143": func(s *FakeServer) {
+			second = s
+			upgrade(s, "STARTTLS")
+			s.Expect("LOGIN fred pass")
+			s.Done("OK LOGIN completed")
+		},
+		// No STARTTLS here, so no LOGIN either.
+		"server3:143": func(s *FakeServer) {
+			s.Send("* OK [CAPABILITY IMAP4rev1] ready")
+		},
+	}}
+	im := dialFake(t, d, "server1:143")
+	if err := im.StartTLS(&tls.Config{RootCAs: pool}); err != nil {
+		t.Fatalf("starttls: %s", err)
+	}
+	im.FollowReferrals = true
+
+	c, err := im.LoginReferred(context.Background(), "fred", "pass")
+	if err != nil {
+		t.Fatalf("login: %s", err)
+	}
+	if state, ok := c.ConnectionState(); c == im || !ok || state.ServerName != "server2" {
+		t.Fatalf("expected a TLS client for server2, got %v %#v", ok, state)
+	}
+	waitFake(t, second)
+
+	if c, err = im.LoginReferred(context.Background(), "fred", "pass"); err == nil || c != im {
+		t.Fatalf("expected a referral without STARTTLS refused, got %v", err)
+	}
+	waitFake(t, first)
+}
@@ -0,0 +1,126 @@
+package imap
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how a Retrier retries failed commands.
+type RetryPolicy struct {
+	MaxAttempts int           // including the first; 3 if 0
+	Backoff     time.Duration // before the first retry, doubling after each
+	MaxBackoff  time.Duration // the most to wait between attempts, if set
+
+	// AllowUnsafe lets commands that aren't idempotent, such as STORE
+	// and APPEND, be retried too.  A STORE +FLAGS is harmless to
+	// repeat, but an APPEND whose completion was lost may already have
+	// added the message.
+	AllowUnsafe bool
+}
+
+// Retrier runs commands on a connection it keeps, retrying those that
+// fail for transient reasons: the connection dying, in which case it
+// dials a new one, or a NO with an INUSE, SERVERBUG or UNAVAILABLE code.
+// Only idempotent commands (FETCH, SEARCH, NOOP and the like) are
+// retried unless the policy says otherwise.
+type Retrier struct {
+	// Dial opens a new connection, started and logged in, and with
+	// the mailbox the commands expect selected.
+	Dial   func(ctx context.Context) (*IMAP, error)
+	Policy RetryPolicy
+
+	imap *IMAP
+}
+
+// idempotentCommands are retried by default.
+var idempotentCommands = map[string]bool{
+	"CAPABILITY": true,
+	"NOOP":       true,
+	"SELECT":     true,
+	"EXAMINE":    true,
+	"LIST":       true,
+	"LSUB":       true,
+	"STATUS":     true,
+	"FETCH":      true,
+	"SEARCH":     true,
+	"SORT":       true,
+	"THREAD":     true,
+}
+
+// Do runs fn with the Retrier's connection, dialing one if need be.
+// command names what fn sends, e.g. "FETCH" or "UID STORE", for
+// deciding whether it may be retried.  It returns fn's error once
+// retries run out or the error isn't transient, or ctx's if ctx is done
+// while waiting to retry.
+func (r *Retrier) Do(ctx context.Context, command string, fn func(imap *IMAP) error) error {
+	attempts := r.Policy.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	name := strings.TrimPrefix(strings.ToUpper(command), "UID ")
+	retryable := r.Policy.AllowUnsafe || idempotentCommands[name]
+
+	backoff := r.Policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = r.try(ctx, fn)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt == attempts || !transient(err, r.imap) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if r.Policy.MaxBackoff > 0 && backoff > r.Policy.MaxBackoff {
+			backoff = r.Policy.MaxBackoff
+		}
+	}
+}
+
+// try runs fn once, on a new connection if the last one died.
+func (r *Retrier) try(ctx context.Context, fn func(imap *IMAP) error) error {
+	if r.imap != nil && r.imap.dead() != nil {
+		r.imap.close()
+		r.imap = nil
+	}
+	if r.imap == nil {
+		imap, err := r.Dial(ctx)
+		if err != nil {
+			return err
+		}
+		r.imap = imap
+	}
+	return fn(r.imap)
+}
+
+// transient reports whether err, from a command on imap, may go away
+// if the command is tried again.
+func transient(err error, imap *IMAP) bool {
+	if e, ok := err.(*IMAPError); ok {
+		switch e.Code {
+		case "INUSE", "SERVERBUG", "UNAVAILABLE":
+			return e.Status == NO
+		}
+		return false
+	}
+	if _, ok := err.(*CapabilityError); ok {
+		return false
+	}
+	// A failed dial, or a dead connection.  Anything else is a bad
+	// response, which would likely come back the same.
+	return imap == nil || imap.dead() != nil
+}
+
+// Close drops the Retrier's connection, if it has one.
+func (r *Retrier) Close() {
+	if r.imap != nil {
+		r.imap.close()
+		r.imap = nil
+	}
+}
@@ -0,0 +1,109 @@
+package imap
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeRetrier returns a Retrier whose connections go to FakeServers
+// sent on servers as they are dialed.
+func fakeRetrier(t *testing.T, policy RetryPolicy) (*Retrier, chan *FakeServer) {
+	servers := make(chan *FakeServer, 10)
+	dial := func(ctx context.Context) (*IMAP, error) {
+		im, s := startFake(t)
+		servers <- s
+		return im, nil
+	}
+	return &Retrier{Dial: dial, Policy: policy}, servers
+}
+
+func TestRetryAfterDrop(t *testing.T) {
+	r, servers := fakeRetrier(t, RetryPolicy{Backoff: time.Millisecond})
+	defer r.Close()
+
+	attempts := 0
+	err := r.Do(context.Background(), "NOOP", func(im *IMAP) error {
+		attempts++
+		s := <-servers
+		if attempts == 1 {
+			// The connection drops before the NOOP is answered.
+			s.Expect("NOOP")
+			s.Close()
+		} else {
+			s.Expect("NOOP")
+			s.Done("OK NOOP completed")
+		}
+		return im.Noop()
+	})
+	if err != nil {
+		t.Fatalf("noop: %s", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryInUse(t *testing.T) {
+	r, servers := fakeRetrier(t, RetryPolicy{MaxAttempts: 2})
+	defer r.Close()
+
+	var s *FakeServer
+	attempts := 0
+	err := r.Do(context.Background(), "UID FETCH", func(im *IMAP) error {
+		attempts++
+		if s == nil {
+			// The same connection is kept for the retry.
+			s = <-servers
+		}
+		s.Expect("FETCH 1 FLAGS")
+		s.Done("NO [INUSE] Mailbox in use")
+		_, err := im.Fetch("1", []string{"FLAGS"})
+		return err
+	})
+	if e, ok := err.(*IMAPError); !ok || e.Code != "INUSE" {
+		t.Fatalf("expected INUSE after the last attempt, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+	waitFake(t, s)
+}
+
+func TestRetryUnsafe(t *testing.T) {
+	r, servers := fakeRetrier(t, RetryPolicy{})
+	defer r.Close()
+
+	attempts := 0
+	err := r.Do(context.Background(), "APPEND", func(im *IMAP) error {
+		attempts++
+		s := <-servers
+		s.Expect("NOOP")
+		s.Close()
+		return im.Noop()
+	})
+	if err == nil {
+		t.Fatalf("expected the dropped connection's error")
+	}
+	if attempts != 1 {
+		t.Fatalf("APPEND retried without AllowUnsafe")
+	}
+}
+
+func TestRetryNotTransient(t *testing.T) {
+	r, servers := fakeRetrier(t, RetryPolicy{})
+	defer r.Close()
+
+	attempts := 0
+	err := r.Do(context.Background(), "SEARCH", func(im *IMAP) error {
+		attempts++
+		s := <-servers
+		s.Expect("SEARCH FOO")
+		s.Done("BAD Unknown search key")
+		_, err := im.Search("FOO")
+		return err
+	})
+	if _, ok := err.(*IMAPError); !ok || attempts != 1 {
+		t.Fatalf("expected one attempt failing with BAD, got %d and %v", attempts, err)
+	}
+}
@@ -0,0 +1,150 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// dateLayout is the time.Format layout of the dates in search keys such
+// as SINCE.
+const dateLayout = "2-Jan-2006"
+
+// SearchCriteria builds the search keys of a SEARCH command, which must
+// all match.  The zero value matches every message.  Criteria combine
+// with And, Or and Not, as in
+//
+//	new(SearchCriteria).Key("UNSEEN").Or(from, to)
+//
+// A malformed combination is reported by Err, and by SearchWith.
+type SearchCriteria struct {
+	keys  []string
+	needs []string // capabilities the keys need
+	err   error
+}
+
+// Key adds search keys as they are written in a SEARCH command, e.g.
+// "UNSEEN" or "LARGER 10000".
+func (c *SearchCriteria) Key(keys ...string) *SearchCriteria {
+	for _, key := range keys {
+		c.add(key)
+	}
+	return c
+}
+
+// And adds the keys of each of others, which must all match too.
+func (c *SearchCriteria) And(others ...*SearchCriteria) *SearchCriteria {
+	for _, other := range others {
+		c.merge(other)
+		c.keys = append(c.keys, other.keys...)
+	}
+	return c
+}
+
+// Or matches messages matching any of alternatives, of which there
+// must be at least two.
+func (c *SearchCriteria) Or(alternatives ...*SearchCriteria) *SearchCriteria {
+	if len(alternatives) < 2 {
+		c.fail(errors.New("imap: OR needs at least two operands"))
+		return c
+	}
+	for _, a := range alternatives {
+		c.merge(a)
+	}
+	// OR takes two keys, so more alternatives nest to the right:
+	// "OR a OR b c".
+	key := alternatives[len(alternatives)-1].group()
+	for i := len(alternatives) - 2; i >= 0; i-- {
+		key = "OR " + alternatives[i].group() + " " + key
+	}
+	c.keys = append(c.keys, key)
+	return c
+}
+
+// Not matches messages that don't match all of not.
+func (c *SearchCriteria) Not(not *SearchCriteria) *SearchCriteria {
+	c.merge(not)
+	c.keys = append(c.keys, "NOT "+not.group())
+	return c
+}
+
+// group returns the criteria as a single search key, parenthesizing
+// several keys.
+func (c *SearchCriteria) group() string {
+	switch len(c.keys) {
+	case 0:
+		return "ALL"
+	case 1:
+		return c.keys[0]
+	}
+	return "(" + strings.Join(c.keys, " ") + ")"
+}
+
+// merge takes on the capabilities and error of an operand.
+func (c *SearchCriteria) merge(operand *SearchCriteria) {
+	c.needs = append(c.needs, operand.needs...)
+	c.fail(operand.err)
+}
+
+func (c *SearchCriteria) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Err returns the first error in building c, if any.
+func (c *SearchCriteria) Err() error {
+	return c.err
+}
+
+// Since matches messages whose internal date is on or after the day of t.
+func (c *SearchCriteria) Since(t time.Time) *SearchCriteria {
+	return c.add("SINCE " + t.Format(dateLayout))
+}
+
+// Before matches messages whose internal date is before the day of t.
+func (c *SearchCriteria) Before(t time.Time) *SearchCriteria {
+	return c.add("BEFORE " + t.Format(dateLayout))
+}
+
+// SavedSince matches messages saved on or after the day of t.  It needs
+// the SAVEDATE capability (RFC 8514).
+func (c *SearchCriteria) SavedSince(t time.Time) *SearchCriteria {
+	return c.add("SAVEDSINCE "+t.Format(dateLayout), "SAVEDATE")
+}
+
+// SavedBefore matches messages saved before the day of t.  It needs the
+// SAVEDATE capability (RFC 8514).
+func (c *SearchCriteria) SavedBefore(t time.Time) *SearchCriteria {
+	return c.add("SAVEDBEFORE "+t.Format(dateLayout), "SAVEDATE")
+}
+
+func (c *SearchCriteria) add(key string, needs ...string) *SearchCriteria {
+	c.keys = append(c.keys, key)
+	c.needs = append(c.needs, needs...)
+	return c
+}
+
+// String returns the criteria as passed to Search, e.g.
+// "SINCE 1-Feb-2024 SAVEDBEFORE 1-Mar-2024".
+func (c *SearchCriteria) String() string {
+	if len(c.keys) == 0 {
+		return "ALL"
+	}
+	return strings.Join(c.keys, " ")
+}
+
+// SearchWith is like Search, but with criteria built with
+// SearchCriteria.  It fails without sending anything if the criteria
+// are malformed or the server lacks a capability they need.
+func (imap *IMAP) SearchWith(c *SearchCriteria) (*ResponseSearch, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	for _, capability := range c.needs {
+		if err := imap.require(capability); err != nil {
+			return nil, err
+		}
+	}
+	return imap.Search(c.String())
+}
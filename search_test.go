@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchCriteriaString(t *testing.T) {
+	feb := time.Date(2024, 2, 1, 23, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		c    *SearchCriteria
+		want string
+	}{
+		{&SearchCriteria{}, "ALL"},
+		{new(SearchCriteria).Since(feb).Before(mar), "SINCE 1-Feb-2024 BEFORE 10-Mar-2024"},
+		{new(SearchCriteria).SavedSince(feb).SavedBefore(mar), "SAVEDSINCE 1-Feb-2024 SAVEDBEFORE 10-Mar-2024"},
+	}
+	for _, test := range tests {
+		if got := test.c.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestSearchCriteriaPrecedence(t *testing.T) {
+	key := func(keys ...string) *SearchCriteria {
+		return new(SearchCriteria).Key(keys...)
+	}
+	tests := []struct {
+		c    *SearchCriteria
+		want string
+	}{
+		{new(SearchCriteria).Or(key("SEEN"), key("FLAGGED")), "OR SEEN FLAGGED"},
+		{new(SearchCriteria).Or(key("A"), new(SearchCriteria).Or(key("B"), key("C"))), "OR A OR B C"},
+		{new(SearchCriteria).Or(new(SearchCriteria).Or(key("A"), key("B")), key("C")), "OR OR A B C"},
+		{new(SearchCriteria).Or(key("A"), key("B"), key("C")), "OR A OR B C"},
+		{new(SearchCriteria).Not(key("X").And(key("Y"))), "NOT (X Y)"},
+		{new(SearchCriteria).Not(new(SearchCriteria).Not(key("X"))), "NOT NOT X"},
+		{key("UNSEEN").Or(key("FROM a", "TO b"), key("CC c")), "UNSEEN OR (FROM a TO b) CC c"},
+		{new(SearchCriteria).Or(key("A"), new(SearchCriteria).Not(key("B", "C"))), "OR A NOT (B C)"},
+		{new(SearchCriteria).Not(new(SearchCriteria).Or(key("A"), key("B"))), "NOT OR A B"},
+		{new(SearchCriteria).Not(&SearchCriteria{}), "NOT ALL"},
+	}
+	for _, test := range tests {
+		if err := test.c.Err(); err != nil {
+			t.Errorf("%q: %s", test.want, err)
+		}
+		if got := test.c.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestSearchCriteriaMalformed(t *testing.T) {
+	one := new(SearchCriteria).Key("SEEN")
+	for _, c := range []*SearchCriteria{
+		new(SearchCriteria).Or(),
+		new(SearchCriteria).Or(one),
+		new(SearchCriteria).Not(new(SearchCriteria).Or(one)),
+		new(SearchCriteria).And(new(SearchCriteria).Or(one)),
+	} {
+		if c.Err() == nil {
+			t.Errorf("%q: expected an error", c)
+		}
+	}
+}
+
+func TestSearchWithMalformed(t *testing.T) {
+	im, s := startFake(t)
+	if _, err := im.SearchWith(new(SearchCriteria).Or()); err == nil {
+		t.Fatalf("expected an error")
+	}
+	waitFake(t, s)
+}
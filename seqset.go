@@ -0,0 +1,102 @@
+package imap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SeqRange is a range of message numbers or UIDs.  A Stop of 0 stands
+// for "*", the largest number in use; Start and Stop are equal for a
+// single number.
+type SeqRange struct {
+	Start, Stop uint32
+}
+
+// SeqSet is a set of message numbers or UIDs in the sequence-set syntax
+// of RFC 3501, e.g. "1:4,10,20:*".
+type SeqSet struct {
+	Ranges []SeqRange
+}
+
+// NewSeqSet returns the set of nums, with runs of consecutive numbers
+// coalesced into ranges.
+func NewSeqSet(nums ...uint32) *SeqSet {
+	sorted := append([]uint32(nil), nums...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	set := &SeqSet{}
+	for _, n := range sorted {
+		last := len(set.Ranges) - 1
+		switch {
+		case last >= 0 && n <= set.Ranges[last].Stop:
+			// A duplicate.
+		case last >= 0 && n == set.Ranges[last].Stop+1:
+			set.Ranges[last].Stop = n
+		default:
+			set.Ranges = append(set.Ranges, SeqRange{n, n})
+		}
+	}
+	return set
+}
+
+// ParseSeqSet parses a sequence set.
+func ParseSeqSet(s string) (*SeqSet, error) {
+	set := &SeqSet{}
+	for _, part := range strings.Split(s, ",") {
+		var r SeqRange
+		var err error
+		start, stop, isRange := strings.Cut(part, ":")
+		if r.Start, err = parseSeqNumber(start); err != nil {
+			return nil, err
+		}
+		r.Stop = r.Start
+		if isRange {
+			if r.Stop, err = parseSeqNumber(stop); err != nil {
+				return nil, err
+			}
+		}
+		set.Ranges = append(set.Ranges, r)
+	}
+	return set, nil
+}
+
+func parseSeqNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, ok := parseNzNumber(s)
+	if !ok {
+		return 0, fmt.Errorf("imap: bad sequence number %q", s)
+	}
+	return n, nil
+}
+
+// parseNzNumber parses an nz-number: a message number or UID, which is
+// non-zero and fits in 32 bits.
+func parseNzNumber(s string) (uint32, bool) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// String returns the set in sequence-set syntax.
+func (s *SeqSet) String() string {
+	parts := make([]string, len(s.Ranges))
+	for i, r := range s.Ranges {
+		parts[i] = formatSeqNumber(r.Start)
+		if r.Stop != r.Start {
+			parts[i] += ":" + formatSeqNumber(r.Stop)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatSeqNumber(n uint32) string {
+	if n == 0 {
+		return "*"
+	}
+	return strconv.FormatUint(uint64(n), 10)
+}
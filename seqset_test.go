@@ -0,0 +1,54 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+type seqSetTest struct {
+	input  string
+	ranges []SeqRange
+}
+
+func (s seqSetTest) Run(t *testing.T) {
+	set, err := ParseSeqSet(s.input)
+	if err != nil {
+		t.Fatalf("parse %q: %s", s.input, err)
+	}
+	if !reflect.DeepEqual(set.Ranges, s.ranges) {
+		t.Fatalf("parse %q: got %v, want %v", s.input, set.Ranges, s.ranges)
+	}
+	if str := set.String(); str != s.input {
+		t.Fatalf("format %v: got %q, want %q", s.ranges, str, s.input)
+	}
+}
+
+func TestSeqSet(t *testing.T) {
+	tests := []seqSetTest{
+		{"1", []SeqRange{{1, 1}}},
+		{"1:4,10", []SeqRange{{1, 4}, {10, 10}}},
+		{"20:*", []SeqRange{{20, 0}}},
+		{"*", []SeqRange{{0, 0}}},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	for _, bad := range []string{"", "0", "1:", "a", "1,,2"} {
+		if _, err := ParseSeqSet(bad); err == nil {
+			t.Fatalf("parsed bad set %q", bad)
+		}
+	}
+}
+
+func TestNewSeqSet(t *testing.T) {
+	if s := NewSeqSet(10, 1, 2, 3, 4).String(); s != "1:4,10" {
+		t.Fatalf("expected 1:4,10, got %q", s)
+	}
+	if s := NewSeqSet(5, 5, 6, 8).String(); s != "5:6,8" {
+		t.Fatalf("expected 5:6,8, got %q", s)
+	}
+	if s := NewSeqSet().String(); s != "" {
+		t.Fatalf("expected an empty set, got %q", s)
+	}
+}
@@ -0,0 +1,152 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortContext is a window onto the results of a UID SORT, kept current
+// with the server's updates as the mailbox changes (RFC 5267), for a
+// message list that shows one page of a sorted mailbox.
+//
+// Updates arrive on the Unsolicited channel as *ResponseESearch; each
+// should be passed to Apply.  Messages added within the window push
+// its last one out, and ones removed from it leave it short, since
+// the message that would take their place isn't known.
+type SortContext struct {
+	Tag    string   // of the SORT, which its updates carry
+	Start  int      // the position of Window[0] in the results, from 1
+	Window []uint32 // UIDs, in sort order
+	Size   int      // the most messages the window holds
+
+	// Stale is set once an update couldn't be placed, as when the
+	// server didn't give its position; the window should then be
+	// sorted again.
+	Stale bool
+}
+
+// UIDSortWindow sorts the messages matching criteria by keys (e.g.
+// "REVERSE", "DATE"), comparing strings in charset, and returns the
+// UIDs at positions from to to of the results, asking the server to
+// report changes to them until CancelUpdate.  It needs the
+// CONTEXT=SORT capability.
+func (imap *IMAP) UIDSortWindow(keys []string, charset, criteria string, from, to uint32) (*SortContext, error) {
+	if err := imap.require("CONTEXT=SORT"); err != nil {
+		return nil, err
+	}
+	resp, err := imap.SendSync("UID SORT RETURN (PARTIAL %d:%d UPDATE) (%s) %s %s",
+		from, to, strings.Join(keys, " "), charset, criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SortContext{Start: int(from), Size: int(to - from + 1)}
+	var search *ResponseESearch
+	for _, extra := range resp.extra {
+		if s, ok := extra.(*ResponseESearch); ok && search == nil {
+			search = s
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	if search == nil || search.Tag == "" {
+		return nil, fmt.Errorf("imap: no ESEARCH response to SORT")
+	}
+	c.Tag = search.Tag
+	if search.Partial != nil && search.Partial.Set != nil {
+		if c.Window, err = sortedNums(search.Partial.Set); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// CancelUpdate stops the updates to the results of the commands
+// tagged tags, such as a SortContext's.
+func (imap *IMAP) CancelUpdate(tags ...string) error {
+	if err := imap.require("CONTEXT=SORT"); err != nil {
+		return err
+	}
+	quoted := make([]string, len(tags))
+	for i, tag := range tags {
+		quoted[i] = quote(tag)
+	}
+	return imap.simple("CANCELUPDATE " + strings.Join(quoted, " "))
+}
+
+// Apply applies the updates in r to the window, and reports whether r
+// was for this context.
+func (c *SortContext) Apply(r *ResponseESearch) bool {
+	if r.Tag != c.Tag {
+		return false
+	}
+	for _, u := range r.Updates {
+		for i, num := range u.Nums {
+			pos := u.Position
+			if pos != 0 && !u.Removed {
+				pos += i
+			}
+			if u.Removed {
+				c.remove(pos, num)
+			} else {
+				c.add(pos, num)
+			}
+		}
+	}
+	return true
+}
+
+func (c *SortContext) add(pos int, num uint32) {
+	end := c.Start + len(c.Window)
+	switch {
+	case pos == 0:
+		c.Stale = true
+	case pos < c.Start:
+		// The window's messages are now one further down.
+		c.Start++
+	case pos < end || pos == end && len(c.Window) < c.Size:
+		i := pos - c.Start
+		c.Window = append(c.Window[:i], append([]uint32{num}, c.Window[i:]...)...)
+		if len(c.Window) > c.Size {
+			c.Window = c.Window[:c.Size]
+		}
+	}
+}
+
+func (c *SortContext) remove(pos int, num uint32) {
+	for i, n := range c.Window {
+		if n == num {
+			c.Window = append(c.Window[:i], c.Window[i+1:]...)
+			return
+		}
+	}
+	switch {
+	case pos == 0:
+		// It may have been before the window.
+		c.Stale = true
+	case pos < c.Start:
+		c.Start--
+	}
+}
+
+// sortedNums returns the numbers of set in the order written, as a
+// set in sort order is.  Ranges may run either way.
+func sortedNums(set *SeqSet) ([]uint32, error) {
+	var nums []uint32
+	for _, r := range set.Ranges {
+		if r.Start == 0 || r.Stop == 0 {
+			return nil, fmt.Errorf("imap: %q in sorted results", set.String())
+		}
+		for n := r.Start; ; {
+			nums = append(nums, n)
+			if n == r.Stop {
+				break
+			} else if n < r.Stop {
+				n++
+			} else {
+				n--
+			}
+		}
+	}
+	return nums, nil
+}
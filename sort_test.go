@@ -0,0 +1,75 @@
+package imap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUIDSortWindow(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 CONTEXT=SORT")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("UID SORT RETURN (PARTIAL 1:4 UPDATE) (REVERSE DATE) UTF-8 UNDELETED")
+	s.Send(`* ESEARCH (TAG "1") UID PARTIAL (1:4 50,40,30:29)`)
+	s.Done("OK SORT completed")
+	s.Expect(`CANCELUPDATE "1"`)
+	s.Done("OK CANCELUPDATE completed")
+
+	c, err := im.UIDSortWindow([]string{"REVERSE", "DATE"}, "UTF-8", "UNDELETED", 1, 4)
+	if err != nil {
+		t.Fatalf("sort: %s", err)
+	}
+	if c.Tag != "1" || c.Start != 1 || !reflect.DeepEqual(c.Window, []uint32{50, 40, 30, 29}) {
+		t.Fatalf("unexpected context %#v", c)
+	}
+	if err := im.CancelUpdate(c.Tag); err != nil {
+		t.Fatalf("cancelupdate: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestSortContextApply(t *testing.T) {
+	tests := []struct {
+		resp   string
+		start  int
+		window []uint32
+		stale  bool
+	}{
+		// New mail at its top pushes the window's last messages out,
+		// and above it moves it down.
+		{`* ESEARCH (TAG "a3") UID ADDTO (11 62:61)`, 11, []uint32{62, 61, 50, 40}, false},
+		{`* ESEARCH (TAG "a3") UID ADDTO (1 62:61)`, 13, []uint32{50, 40, 30, 20}, false},
+		{`* ESEARCH (TAG "a3") UID ADDTO (13 45)`, 11, []uint32{50, 40, 45, 30}, false},
+		{`* ESEARCH (TAG "a3") UID ADDTO (2 70)`, 12, []uint32{50, 40, 30, 20}, false},
+		{`* ESEARCH (TAG "a3") UID ADDTO (15 10)`, 11, []uint32{50, 40, 30, 20}, false},
+		{`* ESEARCH (TAG "a3") UID ADDTO (0 70)`, 11, []uint32{50, 40, 30, 20}, true},
+		{`* ESEARCH (TAG "a3") UID REMOVEFROM (12 40)`, 11, []uint32{50, 30, 20}, false},
+		{`* ESEARCH (TAG "a3") UID REMOVEFROM (3 90)`, 10, []uint32{50, 40, 30, 20}, false},
+		{`* ESEARCH (TAG "a3") UID REMOVEFROM (0 40) ADDTO (14 35)`, 11, []uint32{50, 30, 20, 35}, false},
+	}
+	read := func(line string) *ResponseESearch {
+		r := &reader{parser: newParser(strings.NewReader(line + "\r\n"))}
+		_, resp, err := r.readResponse()
+		if err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+		return resp.(*ResponseESearch)
+	}
+	for _, test := range tests {
+		resp := read(test.resp)
+		c := &SortContext{Tag: "a3", Start: 11, Window: []uint32{50, 40, 30, 20}, Size: 4}
+		if !c.Apply(resp) {
+			t.Fatalf("%s: not applied", test.resp)
+		}
+		if c.Start != test.start || !reflect.DeepEqual(c.Window, test.window) || c.Stale != test.stale {
+			t.Fatalf("%s: got %#v", test.resp, c)
+		}
+	}
+
+	c := &SortContext{Tag: "a3", Start: 1, Window: []uint32{1}, Size: 1}
+	if c.Apply(read(`* ESEARCH (TAG "a4") UID ADDTO (1 2)`)) {
+		t.Fatalf("another command's update applied")
+	}
+}
@@ -0,0 +1,67 @@
+package imap
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// StartTLS upgrades the connection to TLS with STARTTLS (RFC 3501
+// section 6.2.1), as for port 143.  A nil config, or one without a
+// ServerName, verifies the certificate against the host dialed by a
+// Dial function.  The capabilities are asked for afresh afterwards,
+// as those sent in the clear can't be trusted.  It needs the STARTTLS
+// capability, and a connection made with New on a net.Conn.
+func (imap *IMAP) StartTLS(config *tls.Config) error {
+	if _, ok := imap.ConnectionState(); ok {
+		return errors.New("imap: the connection is already TLS")
+	}
+	if imap.Conn() == nil {
+		return errors.New("imap: STARTTLS needs a net.Conn")
+	}
+	if imap.deflate != nil {
+		return errors.New("imap: STARTTLS after COMPRESS")
+	}
+	if err := imap.require("STARTTLS"); err != nil {
+		return err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	upgraded := config.Clone()
+	upgraded.ServerName = ""
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName = imap.serverName
+	}
+
+	imap.pendingLock.Lock()
+	imap.startTLS = config
+	imap.pendingLock.Unlock()
+	if err := imap.simple("STARTTLS"); err != nil {
+		imap.pendingLock.Lock()
+		imap.startTLS = nil
+		imap.pendingLock.Unlock()
+		return err
+	}
+	imap.capabilities = nil
+	imap.upgradedTLS = upgraded
+	return nil
+}
+
+// handshake runs TLS over the connection, on the read thread once
+// STARTTLS has been accepted and before anything more is read, and
+// switches both directions over to it.
+func (imap *IMAP) handshake(config *tls.Config) error {
+	if imap.r.Buffered() > 0 {
+		// Injected by someone in the middle, to be read as if it
+		// came over TLS.
+		return errors.New("imap: data after STARTTLS's OK, before the TLS handshake")
+	}
+	conn := tls.Client(imap.Conn(), config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	imap.r.restart(&countingReader{conn, imap.bytesRead})
+	imap.w.w = conn
+	return nil
+}
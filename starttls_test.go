@@ -0,0 +1,64 @@
+package imap
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// tlsConfigs returns matching server and client configs for a
+// self-signed certificate for host.
+func tlsConfigs(t *testing.T, host string) (server, client *tls.Config) {
+	cert, pool := testCertificate(t, host)
+	return &tls.Config{Certificates: []tls.Certificate{cert}},
+		&tls.Config{RootCAs: pool, ServerName: host}
+}
+
+func TestStartTLS(t *testing.T) {
+	serverConfig, clientConfig := tlsConfigs(t, "imap.example.com")
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("STARTTLS")
+	s.Done("OK Begin TLS negotiation now")
+	s.StartTLS(serverConfig)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 AUTH=PLAIN")
+	s.Done("OK CAPABILITY completed")
+
+	if err := im.StartTLS(clientConfig); err != nil {
+		t.Fatalf("starttls: %s", err)
+	}
+	state, ok := im.ConnectionState()
+	if !ok || state.ServerName != "imap.example.com" {
+		t.Fatalf("expected a TLS connection, got %v %#v", ok, state)
+	}
+	// The capabilities from before don't count.
+	if ok, err := im.supports("LOGINDISABLED"); err != nil || ok {
+		t.Fatalf("expected LOGINDISABLED gone, got %v %v", ok, err)
+	}
+	if err := im.StartTLS(clientConfig); err == nil {
+		t.Fatalf("expected an error starting TLS twice")
+	}
+	waitFake(t, s)
+}
+
+func TestStartTLSInjected(t *testing.T) {
+	_, clientConfig := tlsConfigs(t, "imap.example.com")
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 STARTTLS")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("STARTTLS")
+	// Sent in the clear along with the OK, this mustn't be taken to
+	// have come over TLS.
+	s.Done("OK Begin TLS negotiation now\r\n* CAPABILITY IMAP4rev1 AUTH=PLAIN")
+
+	if err := im.StartTLS(clientConfig); err == nil {
+		t.Fatalf("expected an error for data before the handshake")
+	}
+	if err := im.Noop(); err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+	waitFake(t, s)
+}
@@ -0,0 +1,108 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ThreadNode is a message in a thread returned by THREAD (RFC 5256).
+// Its children are its replies, or for a message with a single reply,
+// that reply.  Num is a message number, or a UID for UIDThread; it is
+// zero for a parent that isn't in the results, whose children are
+// siblings.
+type ThreadNode struct {
+	Num      uint32
+	Children []*ThreadNode
+}
+
+// Thread groups the messages matching criteria into threads with
+// algorithm ("REFERENCES" or "ORDEREDSUBJECT"), comparing strings in
+// charset.  It returns the root of each thread, and needs the
+// THREAD=algorithm capability.
+func (imap *IMAP) Thread(algorithm, charset, criteria string) ([]*ThreadNode, error) {
+	return imap.thread("THREAD", algorithm, charset, criteria)
+}
+
+// UIDThread is like Thread, but its nodes are UIDs.
+func (imap *IMAP) UIDThread(algorithm, charset, criteria string) ([]*ThreadNode, error) {
+	return imap.thread("UID THREAD", algorithm, charset, criteria)
+}
+
+func (imap *IMAP) thread(command, algorithm, charset, criteria string) ([]*ThreadNode, error) {
+	if err := imap.require("THREAD=" + strings.ToUpper(algorithm)); err != nil {
+		return nil, err
+	}
+	resp, err := imap.SendSync("%s %s %s %s", command, algorithm, charset, criteria)
+	if err != nil {
+		return nil, err
+	}
+
+	var threads []*ThreadNode
+	for _, extra := range resp.extra {
+		if t, ok := extra.(*ResponseThread); ok {
+			threads = t.Threads
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	return threads, nil
+}
+
+// ResponseThread contains the threads from a THREAD response.
+type ResponseThread struct {
+	Threads []*ThreadNode
+}
+
+func (r *reader) readTHREAD() *ResponseThread {
+	/*
+		thread-data     = "THREAD" [SP 1*thread-list]
+		thread-list     = "(" (thread-members / thread-nested) ")"
+	*/
+	thread := &ResponseThread{}
+	for {
+		peek, err := r.ReadByte()
+		check(err)
+		check(r.UnreadByte())
+		if peek != '(' {
+			break
+		}
+		list, err := r.readSexp()
+		check(err)
+		thread.Threads = append(thread.Threads, threadFromSexp(list))
+	}
+	check(r.expectEOL())
+	return thread
+}
+
+func threadFromSexp(list []sexp) *ThreadNode {
+	/*
+		thread-members  = nz-number *(SP nz-number) [SP thread-nested]
+		thread-nested   = 2*thread-list
+	*/
+	root := &ThreadNode{}
+	node := root
+	for i, s := range list {
+		if nested, ok := s.([]sexp); ok {
+			for _, s := range list[i:] {
+				nested, ok = s.([]sexp)
+				if !ok {
+					panic(fmt.Errorf("thread member %#v after nested threads", s))
+				}
+				node.Children = append(node.Children, threadFromSexp(nested))
+			}
+			break
+		}
+		num, ok := parseNzNumber(sexpString(s))
+		if !ok {
+			panic(fmt.Errorf("bad thread member %#v", s))
+		}
+		if i == 0 {
+			node.Num = num
+		} else {
+			child := &ThreadNode{Num: num}
+			node.Children = []*ThreadNode{child}
+			node = child
+		}
+	}
+	return root
+}
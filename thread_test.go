@@ -0,0 +1,83 @@
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReadThread(t *testing.T) {
+	n := func(num uint32, children ...*ThreadNode) *ThreadNode {
+		return &ThreadNode{num, children}
+	}
+	tests := []struct {
+		input    string
+		expected []*ThreadNode
+	}{
+		{"* THREAD\r\n", nil},
+		{
+			// From RFC 5256.
+			"* THREAD (2)(3 6 (4 23)(44 7 96))\r\n",
+			[]*ThreadNode{
+				n(2),
+				n(3, n(6, n(4, n(23)), n(44, n(7, n(96))))),
+			},
+		},
+		{
+			"* THREAD ((3)(5))\r\n",
+			[]*ThreadNode{n(0, n(3), n(5))},
+		},
+		{
+			"* THREAD (4294967294 4294967295)\r\n",
+			[]*ThreadNode{n(4294967294, n(4294967295))},
+		},
+	}
+	for _, test := range tests {
+		r := &reader{parser: newParser(bytes.NewBufferString(test.input))}
+		_, resp, err := r.readResponse()
+		if err != nil {
+			t.Fatalf("parsing %q: %s", test.input, err)
+		}
+		if got := resp.(*ResponseThread).Threads; !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("parsing %q: DeepEqual(%#v, %#v)", test.input, got, test.expected)
+		}
+	}
+}
+
+func TestReadThreadOutOfRange(t *testing.T) {
+	for _, input := range []string{
+		"* THREAD (4294967296)\r\n",
+		"* THREAD (1 0)\r\n",
+		"* THREAD (-1)\r\n",
+		"* THREAD ((1)(2) 3)\r\n",
+	} {
+		r := &reader{parser: newParser(bytes.NewBufferString(input))}
+		if _, resp, err := r.readResponse(); err == nil {
+			t.Errorf("parsing %q: expected an error, got %#v", input, resp)
+		}
+	}
+}
+
+func TestUIDThread(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 THREAD=REFERENCES")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("UID THREAD REFERENCES UTF-8 ALL")
+	s.Send("* THREAD (3000000000 (3000000001)(4294967295))")
+	s.Done("OK THREAD completed")
+
+	threads, err := im.UIDThread("REFERENCES", "UTF-8", "ALL")
+	if err != nil {
+		t.Fatalf("thread: %s", err)
+	}
+	expected := []*ThreadNode{{3000000000, []*ThreadNode{{3000000001, nil}, {4294967295, nil}}}}
+	if !reflect.DeepEqual(threads, expected) {
+		t.Fatalf("DeepEqual(%#v, %#v)", threads, expected)
+	}
+
+	if _, err := im.Thread("ORDEREDSUBJECT", "UTF-8", "ALL"); err == nil {
+		t.Fatalf("expected ORDEREDSUBJECT to be unsupported")
+	}
+	waitFake(t, s)
+}
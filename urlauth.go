@@ -0,0 +1,114 @@
+package imap
+
+import "strings"
+
+// GenURLAuth returns url with authorization added, for handing to
+// another server (say, for submission with BURL) to fetch the message
+// data from this one.  mechanism is the authorization mechanism, as
+// "INTERNAL".  It needs the URLAUTH capability (RFC 4467).
+func (imap *IMAP) GenURLAuth(url, mechanism string) (string, error) {
+	if err := imap.require("URLAUTH"); err != nil {
+		return "", err
+	}
+	resp, err := imap.SendSync("GENURLAUTH %s %s", quote(url), mechanism)
+	if err != nil {
+		return "", err
+	}
+
+	var authorized string
+	for _, extra := range resp.extra {
+		if gen, ok := extra.(*ResponseGenURLAuth); ok && len(gen.URLs) > 0 {
+			authorized = gen.URLs[0]
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	return authorized, nil
+}
+
+// URLFetch returns the data of each of urls, keyed by URL.  The data is
+// nil for a URL the server wouldn't resolve.  It needs the URLAUTH
+// capability.
+func (imap *IMAP) URLFetch(urls ...string) (map[string][]byte, error) {
+	if err := imap.require("URLAUTH"); err != nil {
+		return nil, err
+	}
+	quoted := make([]string, len(urls))
+	for i, url := range urls {
+		quoted[i] = quote(url)
+	}
+	resp, err := imap.SendSync("URLFETCH %s", strings.Join(quoted, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string][]byte)
+	for _, extra := range resp.extra {
+		if fetch, ok := extra.(*ResponseURLFetch); ok {
+			for url, d := range fetch.Data {
+				data[url] = d
+			}
+		} else {
+			imap.unsolicited(extra)
+		}
+	}
+	return data, nil
+}
+
+// ResetKey makes the server forget the keys of the URLs authorized for
+// mailbox, so that they stop working; with mechanisms, only those of
+// the given mechanisms.  With no mailbox, every key is reset.  It needs
+// the URLAUTH capability.
+func (imap *IMAP) ResetKey(mailbox string, mechanisms ...string) error {
+	if err := imap.require("URLAUTH"); err != nil {
+		return err
+	}
+	if mailbox == "" {
+		return imap.simple("RESETKEY")
+	}
+	cmd := ""
+	for _, mechanism := range mechanisms {
+		cmd += " " + mechanism
+	}
+	return imap.simple("RESETKEY ", imap.mailbox(mailbox), cmd)
+}
+
+// ResponseGenURLAuth contains the authorized URLs from a GENURLAUTH.
+type ResponseGenURLAuth struct {
+	URLs []string
+}
+
+func (r *reader) readGENURLAUTH() *ResponseGenURLAuth {
+	/* genurlauth-data = "*" SP "GENURLAUTH" 1*(SP url-full-authorized) */
+	gen := &ResponseGenURLAuth{}
+	for {
+		url, err := r.readAstring()
+		check(err)
+		gen.URLs = append(gen.URLs, url)
+		if !r.moreOnLine() {
+			return gen
+		}
+	}
+}
+
+// ResponseURLFetch contains the data of the URLs from a URLFETCH, which
+// is nil for a URL that couldn't be resolved.
+type ResponseURLFetch struct {
+	Data map[string][]byte
+}
+
+func (r *reader) readURLFETCH() *ResponseURLFetch {
+	/* urlfetch-data = "*" SP "URLFETCH" 1*(SP url-full SP nstring) */
+	fetch := &ResponseURLFetch{Data: make(map[string][]byte)}
+	for {
+		url, err := r.readAstring()
+		check(err)
+		check(r.expect(" "))
+		value, err := r.readNstring()
+		check(err)
+		fetch.Data[url] = value
+		if !r.moreOnLine() {
+			return fetch
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestURLAuth(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 URLAUTH")
+	s.Done("OK CAPABILITY completed")
+	s.Expect(`GENURLAUTH "imap://joe@example.com/INBOX/;uid=20/;section=1.2;urlauth=submit+joe" INTERNAL`)
+	s.Send(`* GENURLAUTH "imap://joe@example.com/INBOX/;uid=20/;section=1.2;urlauth=submit+joe:internal:91354a473744909de610943775f92038"`)
+	s.Done("OK GENURLAUTH completed")
+	s.Expect(`URLFETCH "imap://joe@example.com/INBOX/;uid=20/;section=1.2;urlauth=submit+joe:internal:91354a473744909de610943775f92038" "imap://joe@example.com/INBOX/;uid=21;urlauth=anonymous:internal:00"`)
+	s.Send("* URLFETCH \"imap://joe@example.com/INBOX/;uid=20/;section=1.2;urlauth=submit+joe:internal:91354a473744909de610943775f92038\" {11}\r\nHello world" +
+		` "imap://joe@example.com/INBOX/;uid=21;urlauth=anonymous:internal:00" NIL`)
+	s.Done("OK URLFETCH completed")
+	s.Expect(`RESETKEY "INBOX" INTERNAL`)
+	s.Done("OK RESETKEY completed")
+
+	url, err := im.GenURLAuth("imap://joe@example.com/INBOX/;uid=20/;section=1.2;urlauth=submit+joe", "INTERNAL")
+	if err != nil {
+		t.Fatalf("genurlauth: %s", err)
+	}
+	if url != "imap://joe@example.com/INBOX/;uid=20/;section=1.2;urlauth=submit+joe:internal:91354a473744909de610943775f92038" {
+		t.Fatalf("unexpected url %q", url)
+	}
+
+	bad := "imap://joe@example.com/INBOX/;uid=21;urlauth=anonymous:internal:00"
+	data, err := im.URLFetch(url, bad)
+	if err != nil {
+		t.Fatalf("urlfetch: %s", err)
+	}
+	expected := map[string][]byte{url: []byte("Hello world"), bad: nil}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("DeepEqual(%q, %q)", data, expected)
+	}
+
+	if err := im.ResetKey("INBOX", "INTERNAL"); err != nil {
+		t.Fatalf("resetkey: %s", err)
+	}
+	waitFake(t, s)
+}
+
+func TestURLAuthUnsupported(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1")
+	s.Done("OK CAPABILITY completed")
+
+	_, err := im.URLFetch("imap://example.com/INBOX/;uid=1")
+	if e, ok := err.(*CapabilityError); !ok || e.Capability != "URLAUTH" {
+		t.Fatalf("expected capability error, got %v", err)
+	}
+	waitFake(t, s)
+}
@@ -0,0 +1,114 @@
+package imap
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Mailbox names are sent in the modified UTF-7 of RFC 3501 section
+// 5.1.3: printable ASCII stands for itself, except that "&" is sent as
+// "&-", and anything else goes as UTF-16 in a variant of base64
+// between "&" and "-".
+
+var mutf7 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding).Strict()
+
+// encodeMailbox converts a mailbox name to modified UTF-7.
+func encodeMailbox(name string) string {
+	var b strings.Builder
+	var run []uint16 // characters waiting to be base64-encoded
+	flush := func() {
+		if run == nil {
+			return
+		}
+		buf := make([]byte, 2*len(run))
+		for i, c := range run {
+			buf[2*i], buf[2*i+1] = byte(c>>8), byte(c)
+		}
+		b.WriteString("&" + mutf7.EncodeToString(buf) + "-")
+		run = nil
+	}
+	for _, c := range name {
+		if c >= 0x20 && c <= 0x7e {
+			flush()
+			if c == '&' {
+				b.WriteString("&-")
+			} else {
+				b.WriteRune(c)
+			}
+			continue
+		}
+		run = utf16.AppendRune(run, c)
+	}
+	flush()
+	return b.String()
+}
+
+// decodeMailbox converts a mailbox name from modified UTF-7.
+func decodeMailbox(name string) (string, error) {
+	var b strings.Builder
+	for len(name) > 0 {
+		c := name[0]
+		if c < 0x20 || c > 0x7e {
+			return "", errors.New("imap: 8-bit mailbox name not in modified UTF-7")
+		}
+		if c != '&' {
+			b.WriteByte(c)
+			name = name[1:]
+			continue
+		}
+		end := strings.IndexByte(name, '-')
+		if end < 0 {
+			return "", errors.New("imap: unterminated modified UTF-7 in mailbox name")
+		}
+		encoded := name[1:end]
+		name = name[end+1:]
+		if encoded == "" {
+			b.WriteByte('&')
+			continue
+		}
+		buf, err := mutf7.DecodeString(encoded)
+		if err != nil || len(buf)%2 != 0 {
+			return "", errors.New("imap: bad modified UTF-7 in mailbox name")
+		}
+		run := make([]uint16, len(buf)/2)
+		for i := range run {
+			run[i] = uint16(buf[2*i])<<8 | uint16(buf[2*i+1])
+		}
+		for _, r := range utf16.Decode(run) {
+			if r == utf8.RuneError || (r >= 0x20 && r <= 0x7e) {
+				// Printable ASCII must stand for itself.
+				return "", errors.New("imap: bad modified UTF-7 in mailbox name")
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+// mailbox formats a mailbox name as a command part for sendSync:
+// encoded, unless UTF8=ACCEPT is enabled, and quoted, or a literal if
+// a quoted string can't carry it.
+func (imap *IMAP) mailbox(name string) interface{} {
+	if !imap.r.utf8.Load() {
+		name = encodeMailbox(name)
+	}
+	if quotable(name) {
+		return quote(name)
+	}
+	return literal(name)
+}
+
+// mailboxName decodes a mailbox name from a response, leaving it as it
+// was if it isn't valid modified UTF-7, as some servers send raw UTF-8.
+func (r *reader) mailboxName(name string) string {
+	if r.utf8.Load() {
+		return name
+	}
+	if decoded, err := decodeMailbox(name); err == nil {
+		return decoded
+	}
+	return name
+}
@@ -0,0 +1,74 @@
+package imap
+
+import "testing"
+
+type mailboxNameTest struct {
+	name, encoded string
+}
+
+func (m mailboxNameTest) Run(t *testing.T) {
+	if got := encodeMailbox(m.name); got != m.encoded {
+		t.Fatalf("encodeMailbox(%q) = %q, want %q", m.name, got, m.encoded)
+	}
+	got, err := decodeMailbox(m.encoded)
+	if err != nil || got != m.name {
+		t.Fatalf("decodeMailbox(%q) = %q, %v, want %q", m.encoded, got, err, m.name)
+	}
+}
+
+func TestMailboxNames(t *testing.T) {
+	tests := []mailboxNameTest{
+		{"INBOX", "INBOX"},
+		{"Tom & Jerry", "Tom &- Jerry"},
+		{"台北", "&U,BTFw-"},
+		{"~peter/mail/台北/日本語", "~peter/mail/&U,BTFw-/&ZeVnLIqe-"},
+		{"Entwürfe", "Entw&APw-rfe"},
+		{"😀", "&2D3eAA-"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	for _, bad := range []string{"&U,BTFw", "&AGE-", "&U,B-", "caf\xc3\xa9"} {
+		if got, err := decodeMailbox(bad); err == nil {
+			t.Fatalf("decoded bad name %q as %q", bad, got)
+		}
+	}
+}
+
+func TestMailboxNameRoundTrip(t *testing.T) {
+	im, s := startFake(t)
+	s.Expect(`CREATE "&ZeVnLIqe-"`)
+	s.Done("OK CREATE completed")
+	s.Expect(`LIST "" "&ZeVnLIqe-"`)
+	s.Send(`* LIST () "/" "&ZeVnLIqe-"`)
+	s.Done("OK LIST completed")
+	s.Expect("CAPABILITY")
+	s.Send("* CAPABILITY IMAP4rev1 ENABLE UTF8=ACCEPT")
+	s.Done("OK CAPABILITY completed")
+	s.Expect("ENABLE UTF8=ACCEPT")
+	s.Send("* ENABLED UTF8=ACCEPT")
+	s.Done("OK ENABLE completed")
+	s.Expect(`CREATE "Tom & Jerry"`)
+	s.Done("OK CREATE completed")
+
+	if err := im.Create("日本語"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	lists, err := im.List("", "日本語")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(lists) != 1 || lists[0].Name != "日本語" {
+		t.Fatalf("unexpected list %#v", lists)
+	}
+
+	enabled, err := im.Enable("UTF8=ACCEPT")
+	if err != nil || len(enabled) != 1 {
+		t.Fatalf("enable: %v, %v", enabled, err)
+	}
+	if err := im.Create("Tom & Jerry"); err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	waitFake(t, s)
+}